@@ -0,0 +1,178 @@
+package esatompubpg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//RequestIDHeader carries the id used to correlate a request with the server's log lines. An id
+//sent by the client or a proxy is used if it's well formed, otherwise one is generated, and it's
+//returned in the response either way.
+const (
+	RequestIDHeader    = "X-Request-Id"
+	maxRequestIDLength = 128
+)
+
+type requestContextKey int
+
+const requestRecordContextKey requestContextKey = 0
+
+//requestRecord holds what's known about a request for its access log entry. It's created by the
+//access log middleware and completed by the handlers it wraps, such as the authenticator, and
+//the trace handler, whose span is only in the context of the handlers it wraps in turn.
+type requestRecord struct {
+	id       string
+	consumer string
+	traceID  string
+}
+
+func requestRecordFromContext(ctx context.Context) *requestRecord {
+	record, _ := ctx.Value(requestRecordContextKey).(*requestRecord)
+	return record
+}
+
+//RequestID returns the id of the request, or the empty string if the request didn't pass
+//through the access log middleware.
+func RequestID(req *http.Request) string {
+	if record := requestRecordFromContext(req.Context()); record != nil {
+		return record.id
+	}
+
+	return ""
+}
+
+//requestLogger returns a logger for the request, which adds the request id, and the trace and
+//span ids for requests that are being traced, to log lines.
+func requestLogger(req *http.Request) *log.Entry {
+	return contextLogger(req.Context())
+}
+
+func contextLogger(ctx context.Context) *log.Entry {
+	fields := log.Fields{}
+	if record := requestRecordFromContext(ctx); record != nil {
+		fields["request_id"] = record.id
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields["trace_id"] = sc.TraceID().String()
+		fields["span_id"] = sc.SpanID().String()
+	}
+
+	return log.WithFields(fields)
+}
+
+//validRequestID checks an incoming request id is short and only has characters that are safe
+//to log and echo in a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+//AccessLogger is middleware that logs each request as a JSON object. It's the outermost
+//handler, so requests rejected by other middleware, such as the authenticator, are logged too.
+type AccessLogger struct {
+	logger *log.Logger
+	router *mux.Router
+}
+
+//NewAccessLogger creates an access logger writing to out. The router is used to log the route
+//template and feed id of requests; it may be nil.
+func NewAccessLogger(out io.Writer, router *mux.Router) *AccessLogger {
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Level = log.InfoLevel
+
+	return &AccessLogger{logger: logger, router: router}
+}
+
+//Middleware assigns each request its id and logs the request once it's been served by next
+func (a *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		rw.Header().Set(RequestIDHeader, id)
+
+		record := &requestRecord{id: id}
+		w := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestRecordContextKey, record)))
+
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		fields := log.Fields{
+			"request_id":  id,
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"status":      status,
+			"bytes":       w.size,
+			"duration_ms": float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond),
+			"remote_addr": req.RemoteAddr,
+		}
+
+		if a.router != nil {
+			var match mux.RouteMatch
+			if a.router.Match(req, &match) && match.Route != nil {
+				if template, err := match.Route.GetPathTemplate(); err == nil {
+					fields["route"] = template
+				}
+
+				if feedID := match.Vars["feedId"]; feedID != "" {
+					fields["feed_id"] = feedID
+				}
+			}
+		}
+
+		if record.consumer != "" {
+			fields["consumer"] = record.consumer
+		}
+
+		if record.traceID != "" {
+			fields["trace_id"] = record.traceID
+		} else if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+
+		if subject := ClientCertSubject(req); subject != "" {
+			fields["client_cert"] = subject
+		}
+
+		a.logger.WithFields(fields).Info("request")
+	})
+}
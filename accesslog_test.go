@@ -0,0 +1,82 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+func TestAccessLogger(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+	store.CreateFeed("feed1")
+
+	env, _ := envinject.NewInjectedEnv()
+	archiveHandler, _ := NewArchiveHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+
+	var requestID string
+	var logFields map[string]interface{}
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, func(rw http.ResponseWriter, req *http.Request) {
+		requestID = RequestID(req)
+		logFields = requestLogger(req).Data
+		archiveHandler(rw, req)
+	})
+
+	a := new(Authenticator)
+	a.SetAPIKeys(map[string]string{"billing": "s3cr3t"})
+
+	var out bytes.Buffer
+	handler := NewAccessLogger(&out, router).Middleware(a.Middleware(router))
+
+	get := func(uri string, headers map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		out.Reset()
+		r, _ := http.NewRequest("GET", uri, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		return w, entry
+	}
+
+	//An incoming request id is used for the request, and its log lines
+	w, entry := get("/notifications/feed1", map[string]string{APIKeyHeader: "s3cr3t", RequestIDHeader: "abc-123"})
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "abc-123", w.Header().Get(RequestIDHeader))
+	assert.Equal(t, "abc-123", requestID)
+	assert.Equal(t, "abc-123", logFields["request_id"])
+
+	assert.Equal(t, "abc-123", entry["request_id"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/notifications/feed1", entry["path"])
+	assert.Equal(t, ArchiveHandlerURI, entry["route"])
+	assert.Equal(t, "feed1", entry["feed_id"])
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+	assert.Equal(t, float64(w.Body.Len()), entry["bytes"])
+	assert.Equal(t, "billing", entry["consumer"])
+	assert.Contains(t, entry, "duration_ms")
+
+	//Requests refused by the authenticator are logged, and malformed ids are replaced
+	w, entry = get("/notifications/feed1", map[string]string{RequestIDHeader: strings.Repeat("x", 200)})
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	generated := w.Header().Get(RequestIDHeader)
+	assert.Equal(t, 32, len(generated))
+	assert.Equal(t, generated, entry["request_id"])
+	assert.Equal(t, float64(http.StatusUnauthorized), entry["status"])
+	assert.NotContains(t, entry, "consumer")
+
+	w, _ = get("/notifications/feed1", map[string]string{APIKeyHeader: "s3cr3t", RequestIDHeader: "bad\nid"})
+	assert.NotEqual(t, "bad\nid", w.Header().Get(RequestIDHeader))
+	assert.NotEqual(t, generated, w.Header().Get(RequestIDHeader))
+}
@@ -0,0 +1,263 @@
+package esatompubpg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//RetrieveAggregateHandlerURI is the URI for retrieving the events of an aggregate. The
+//versions returned are restricted with the from and to query parameters, and pages hold up
+//to AGGREGATE_PAGE_SIZE events, which defaults to DefaultAggregatePageSize.
+const (
+	RetrieveAggregateHandlerURI = "/events/{aggregateId}"
+	AggregatePageSize           = "AGGREGATE_PAGE_SIZE"
+	DefaultAggregatePageSize    = 100
+)
+
+//AggregateEvents is a page of the events for an aggregate, in version order. The link
+//relations are atom links: self, next for the page of later versions when there is one, and
+//prev for the page of earlier versions.
+type AggregateEvents struct {
+	XMLName     xml.Name            `xml:"http://github.com/xtracdev/goes events" json:"-"`
+	AggregateId string              `xml:"aggregateId" json:"aggregateId"`
+	Links       []AggregateLink     `xml:"http://www.w3.org/2005/Atom link" json:"links"`
+	Events      []EventStoreContent `xml:"http://github.com/xtracdev/goes event" json:"events"`
+}
+
+type AggregateLink struct {
+	Rel  string `xml:"rel,attr" json:"rel"`
+	Href string `xml:"href,attr" json:"href"`
+}
+
+//marshalAggregateEvents renders the page in the representation indicated by the content type
+func marshalAggregateEvents(events *AggregateEvents, contentType string) ([]byte, error) {
+	if contentType == XMLContentType {
+		return xml.Marshal(events)
+	}
+
+	return json.Marshal(events)
+}
+
+//versionRange reads the from and to query parameters. From defaults to the first version,
+//and a to of 0 means there is no upper bound.
+func versionRange(req *http.Request) (int, int, error) {
+	from, to := 1, 0
+	query := req.URL.Query()
+
+	if val := query.Get("from"); val != "" {
+		var err error
+		from, err = strconv.Atoi(val)
+		if err != nil || from < 1 {
+			return 0, 0, fmt.Errorf("Invalid from version: %s", val)
+		}
+	}
+
+	if val := query.Get("to"); val != "" {
+		var err error
+		to, err = strconv.Atoi(val)
+		if err != nil || to < from {
+			return 0, 0, fmt.Errorf("Invalid to version: %s", val)
+		}
+	}
+
+	return from, to, nil
+}
+
+func aggregatePageURI(proto string, linkhostport string, aggregateID string, from int, to int) string {
+	query := url.Values{"from": []string{strconv.Itoa(from)}}
+	if to != 0 {
+		query.Set("to", strconv.Itoa(to))
+	}
+
+	return fmt.Sprintf("%s://%s/events/%s?%s", proto, linkhostport, url.PathEscape(aggregateID), query.Encode())
+}
+
+//NewAggregateRetrieveHandler instantiates a handler for retrieving the events of an aggregate in
+//version order, for consumers rebuilding an aggregate. This will be served at /events/{aggregateId}
+//The events are encoded as for the single event handler and the page is encrypted in the same
+//way. A page that is followed by a next page can't change, so it may be cached; the last page
+//grows as new versions are added and is not cacheable.
+func NewAggregateRetrieveHandler(store FeedStore, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
+	}
+
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	if ae == nil {
+		return nil, ErrMissingAtomEncrypter
+	}
+
+	linkProto := env.Getenv(LinkProto)
+	if linkProto == "" {
+		linkProto = "https"
+	}
+
+	pageSize := DefaultAggregatePageSize
+	if val := env.Getenv(AggregatePageSize); val != "" {
+		var err error
+		pageSize, err = strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+
+		if pageSize < 1 {
+			return nil, fmt.Errorf("%s must be positive", AggregatePageSize)
+		}
+	}
+
+	redactionPolicy, err := NewRedactionPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		logger := requestLogger(req)
+		store := traceFeedStore(req.Context(), store)
+
+		aggregateID := mux.Vars(req)["aggregateId"]
+		from, to, err := versionRange(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Infof("Retrieving events for %s from version %d", aggregateID, from)
+
+		//Ask for one more than a page to know if there is a next page
+		events, err := store.RetrieveAggregate(aggregateID, from, to, pageSize+1)
+		if err != nil {
+			logger.Warnf("Error retrieving aggregate events: %s", err.Error())
+			http.Error(rw, "Error retrieving aggregate events", http.StatusInternalServerError)
+			return
+		}
+
+		//An aggregate without events does not exist. Versions start at 1, so that's known when
+		//the range starts there, otherwise an empty page is only served for an aggregate with
+		//earlier versions.
+		if len(events) == 0 {
+			exists := false
+			if from > 1 {
+				first, err := store.RetrieveAggregate(aggregateID, 1, 0, 1)
+				if err != nil {
+					logger.Warnf("Error retrieving aggregate events: %s", err.Error())
+					http.Error(rw, "Error retrieving aggregate events", http.StatusInternalServerError)
+					return
+				}
+
+				exists = len(first) > 0
+			}
+
+			if !exists {
+				http.Error(rw, "", http.StatusNotFound)
+				return
+			}
+		}
+
+		more := len(events) > pageSize
+		if more {
+			events = events[:pageSize]
+		}
+
+		last := from - 1
+		if len(events) > 0 {
+			last = events[len(events)-1].Version
+		}
+
+		//The paging is done before events the consumer may not see are removed, so the links
+		//are the same for all consumers
+		selection := entrySelection{grant: grantFromRequest(req), redaction: redactionPolicy.forRequest(req)}
+		contentType := negotiateContentType(req, eventContentTypes)
+		encoding := negotiateEncoding(req)
+		etag := entityTag(encodingTagID(selection.tagID(fmt.Sprintf("%s:%d-%d", aggregateID, from, last)), encoding), !more, contentType, XMLContentType)
+		cacheDirectives := "no-store"
+		if more {
+			cacheDirectives = cacheControl(req, "max-age=2592000")
+		}
+
+		if ifNoneMatch(req, etag) {
+			writeNotModified(rw, etag, cacheDirectives)
+			return
+		}
+
+		page := newAggregateEvents(aggregateID, selection.apply(events), selection.redaction)
+		observeEntries(req, len(page.Events))
+		page.Links = append(page.Links, AggregateLink{
+			Rel:  "self",
+			Href: aggregatePageURI(linkProto, linkhostport, aggregateID, from, to),
+		})
+
+		if from > 1 {
+			prevFrom := from - pageSize
+			if prevFrom < 1 {
+				prevFrom = 1
+			}
+
+			page.Links = append(page.Links, AggregateLink{
+				Rel:  "prev",
+				Href: aggregatePageURI(linkProto, linkhostport, aggregateID, prevFrom, from-1),
+			})
+		}
+
+		if more {
+			page.Links = append(page.Links, AggregateLink{
+				Rel:  "next",
+				Href: aggregatePageURI(linkProto, linkhostport, aggregateID, last+1, to),
+			})
+		}
+
+		_, span := startSpan(req.Context(), "render", attribute.String("atompub.content_type", contentType))
+		marshalled, err := marshalAggregateEvents(page, contentType)
+		endSpan(span, err)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		encodedOut, contentEncoding, err := ae.encodeOutput(req.Context(), marshalled, encoding)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setContentEncoding(rw, contentEncoding)
+		rw.Header().Add("Vary", "Accept, Accept-Encoding")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("ETag", etag)
+		rw.Header().Add("Cache-Control", cacheDirectives)
+
+		rw.Write(encodedOut)
+	}, nil
+}
+
+func newAggregateEvents(aggregateID string, events []atomdata.TimestampedEvent, r *redaction) *AggregateEvents {
+	page := &AggregateEvents{
+		AggregateId: aggregateID,
+		Links:       []AggregateLink{},
+		Events:      []EventStoreContent{},
+	}
+
+	for _, event := range events {
+		page.Events = append(page.Events, EventStoreContent{
+			AggregateId: aggregateID,
+			Version:     event.Version,
+			TypeCode:    event.TypeCode,
+			Published:   event.Timestamp,
+			Content:     base64.StdEncoding.EncodeToString(r.payload(event)),
+		})
+	}
+
+	return page
+}
@@ -0,0 +1,198 @@
+package esatompubpg
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func aggregateRouter(t *testing.T, store FeedStore) *mux.Router {
+	os.Setenv(AggregatePageSize, "2")
+	defer os.Unsetenv(AggregatePageSize)
+	env, _ := envinject.NewInjectedEnv()
+
+	aggregateHandler, err := NewAggregateRetrieveHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(RetrieveAggregateHandlerURI, aggregateHandler)
+	return router
+}
+
+func aggregateLinks(page *AggregateEvents) map[string]string {
+	links := make(map[string]string)
+	for _, l := range page.Links {
+		links[l.Rel] = l.Href
+	}
+
+	return links
+}
+
+func TestAggregateRetrieve(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("other", 1), testEvent("agg", 2))
+	store.CreateFeed("feed1")
+	store.Add(testEvent("agg", 3), testEvent("agg", 4), testEvent("agg", 5))
+
+	router := aggregateRouter(t, store)
+	get := func(uri string, accept string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	versions := func(page *AggregateEvents) []int {
+		var v []int
+		for _, e := range page.Events {
+			v = append(v, e.Version)
+		}
+		return v
+	}
+
+	//The first page is full, so it's immutable and links to the next
+	w := get("/events/agg", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, XMLContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `"agg:1-2"`, w.Header().Get("ETag"))
+
+	var page AggregateEvents
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, []int{1, 2}, versions(&page))
+		assert.Equal(t, "eWVhaCBvaw==", page.Events[0].Content)
+		links := aggregateLinks(&page)
+		assert.Equal(t, "https://testhost:12345/events/agg?from=1", links["self"])
+		assert.Equal(t, "https://testhost:12345/events/agg?from=3", links["next"])
+		assert.Equal(t, "", links["prev"])
+	}
+
+	w = get("/events/agg?from=3", JSONContentType)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	page = AggregateEvents{}
+	if assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, []int{3, 4}, versions(&page))
+		links := aggregateLinks(&page)
+		assert.Equal(t, "https://testhost:12345/events/agg?from=1&to=2", links["prev"])
+		assert.Equal(t, "https://testhost:12345/events/agg?from=5", links["next"])
+	}
+
+	//The last page grows as versions are added
+	w = get("/events/agg?from=5", "")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, `W/"agg:5-5"`, w.Header().Get("ETag"))
+	page = AggregateEvents{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, []int{5}, versions(&page))
+		assert.Equal(t, "", aggregateLinks(&page)["next"])
+	}
+
+	r, _ := http.NewRequest("GET", "/events/agg?from=5", nil)
+	r.Header.Set("If-None-Match", `W/"agg:5-5"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	//A bounded range that fits on a page has no next page
+	w = get("/events/agg?from=2&to=3", "")
+	page = AggregateEvents{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, []int{2, 3}, versions(&page))
+		assert.Equal(t, "https://testhost:12345/events/agg?from=2&to=3", aggregateLinks(&page)["self"])
+		assert.Equal(t, "https://testhost:12345/events/agg?from=1&to=1", aggregateLinks(&page)["prev"])
+	}
+
+	//Past the latest version there's an empty page to poll
+	w = get("/events/agg?from=6", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	page = AggregateEvents{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, 0, len(page.Events))
+	}
+
+	//An aggregate without events doesn't exist, whatever the query
+	for _, uri := range []string{"/events/nope", "/events/nope?foo=1", "/events/nope?from=1&to=3", "/events/nope?from=6"} {
+		assert.Equal(t, http.StatusNotFound, get(uri, "").Result().StatusCode, uri)
+	}
+	assert.Equal(t, http.StatusOK, get("/events/agg?foo=1", "").Result().StatusCode)
+
+	assert.Equal(t, http.StatusBadRequest, get("/events/agg?from=0", "").Result().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get("/events/agg?from=3&to=2", "").Result().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, get("/events/agg?to=x", "").Result().StatusCode)
+}
+
+func TestPGRetrieveAggregate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+		AddRow(time.Now(), "agg", 2, "foo", []byte("yeah ok")).
+		AddRow(time.Now(), "agg", 3, "foo", []byte("yeah ok"))
+	mock.ExpectQuery("select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event").
+		WithArgs("agg", 2, 0, 3).WillReturnRows(rows)
+
+	router := aggregateRouter(t, pgFeedStore(t, db))
+	r, _ := http.NewRequest("GET", "/events/agg?from=2", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var page AggregateEvents
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) && assert.Equal(t, 2, len(page.Events)) {
+		assert.Equal(t, 3, page.Events[1].Version)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGRetrieveMissingAggregate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"event_time", "aggregate_id", "version", "typecode", "payload"}
+	mock.ExpectQuery("select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event").
+		WithArgs("nope", 4, 0, 3).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery("select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event").
+		WithArgs("nope", 1, 0, 1).WillReturnRows(sqlmock.NewRows(columns))
+
+	router := aggregateRouter(t, pgFeedStore(t, db))
+	r, _ := http.NewRequest("GET", "/events/nope?from=4", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAggregateHandlerConfig(t *testing.T) {
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	_, err := NewAggregateRetrieveHandler(nil, "testhost:12345", env, ae)
+	assert.Equal(t, ErrMissingFeedStore, err)
+
+	os.Setenv(AggregatePageSize, "0")
+	defer os.Unsetenv(AggregatePageSize)
+	env, _ = envinject.NewInjectedEnv()
+	_, err = NewAggregateRetrieveHandler(NewMemoryFeedStore(), "testhost:12345", env, ae)
+	assert.NotNil(t, err)
+}
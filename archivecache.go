@@ -0,0 +1,149 @@
+package esatompubpg
+
+import (
+	"container/list"
+	"expvar"
+	"strconv"
+	"sync"
+
+	"github.com/xtracdev/envinject"
+)
+
+//ArchiveCacheSize is the environment variable used to set the maximum size in bytes of the
+//rendered archive pages cached by the archive handler. If not set DefaultArchiveCacheSize is
+//used; a value of 0 disables the cache.
+const (
+	ArchiveCacheSize        = "ARCHIVE_CACHE_SIZE"
+	DefaultArchiveCacheSize = 32 * 1024 * 1024
+)
+
+//Archive cache counters, exposed via expvar as atompub.archivecache
+var (
+	archiveCacheHits      = new(expvar.Int)
+	archiveCacheMisses    = new(expvar.Int)
+	archiveCacheEvictions = new(expvar.Int)
+)
+
+func init() {
+	stats := expvar.NewMap("atompub.archivecache")
+	stats.Set("hits", archiveCacheHits)
+	stats.Set("misses", archiveCacheMisses)
+	stats.Set("evictions", archiveCacheEvictions)
+}
+
+//archivePage is a rendered archive page prior to document encryption. The newest archive has a
+//next-archive link to recent, which changes once a newer feed is archived; newest flags
+//those pages so the link can be rechecked before the cached page is served. The number of
+//entries is kept for metrics.
+type archivePage struct {
+	key     string
+	body    []byte
+	entries int
+	newest  bool
+}
+
+func (p *archivePage) size() int {
+	return len(p.key) + len(p.body)
+}
+
+//archiveCache is an LRU cache of rendered archive pages bounded by the total size of the
+//cached pages.
+type archiveCache struct {
+	sync.Mutex
+	maxBytes int
+	bytes    int
+	lru      *list.List
+	pages    map[string]*list.Element
+}
+
+func newArchiveCache(maxBytes int) *archiveCache {
+	return &archiveCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		pages:    make(map[string]*list.Element),
+	}
+}
+
+//archiveCacheKey identifies an archive page by feed id, representation, content coding and
+//the entries selected for the request
+func archiveCacheKey(feedID string, contentType string, encoding string, selection entrySelection) string {
+	key := feedID + " " + contentType + " " + encoding
+	if selected := selection.key(); selected != "" {
+		key += " " + selected
+	}
+
+	return key
+}
+
+func (c *archiveCache) get(key string) (*archivePage, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.pages[key]
+	if !ok {
+		archiveCacheMisses.Add(1)
+		return nil, false
+	}
+
+	archiveCacheHits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*archivePage), true
+}
+
+//add caches the page, evicting the least recently used pages as needed to keep within the
+//size limit. Pages larger than the limit are not cached.
+func (c *archiveCache) add(page *archivePage) {
+	if page.size() > c.maxBytes {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.pages[page.key]; ok {
+		c.removeElement(elem)
+	}
+
+	c.pages[page.key] = c.lru.PushFront(page)
+	c.bytes += page.size()
+
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		archiveCacheEvictions.Add(1)
+	}
+}
+
+func (c *archiveCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.pages[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+//removeElement drops a page from the cache. The caller must hold the lock.
+func (c *archiveCache) removeElement(elem *list.Element) {
+	page := c.lru.Remove(elem).(*archivePage)
+	delete(c.pages, page.key)
+	c.bytes -= page.size()
+}
+
+//archiveCacheFromEnv creates the archive cache configured via the environment, or returns
+//nil if caching is disabled.
+func archiveCacheFromEnv(env *envinject.InjectedEnv) (*archiveCache, error) {
+	maxBytes := DefaultArchiveCacheSize
+	if val := env.Getenv(ArchiveCacheSize); val != "" {
+		var err error
+		maxBytes, err = strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if maxBytes <= 0 {
+		return nil, nil
+	}
+
+	return newArchiveCache(maxBytes), nil
+}
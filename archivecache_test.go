@@ -0,0 +1,142 @@
+package esatompubpg
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestArchiveCacheEviction(t *testing.T) {
+	cache := newArchiveCache(30)
+	evictions := archiveCacheEvictions.Value()
+
+	cache.add(&archivePage{key: "a", body: []byte("0123456789")})
+	cache.add(&archivePage{key: "b", body: []byte("0123456789")})
+
+	//Touch a so b is the least recently used page
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+
+	cache.add(&archivePage{key: "c", body: []byte("0123456789")})
+	assert.Equal(t, evictions+1, archiveCacheEvictions.Value())
+	assert.Equal(t, 22, cache.bytes)
+
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+
+	//Pages that exceed the cache size are not cached
+	cache.add(&archivePage{key: "d", body: make([]byte, 30)})
+	_, ok = cache.get("d")
+	assert.False(t, ok)
+	assert.Equal(t, 22, cache.bytes)
+
+	cache.remove("a")
+	assert.Equal(t, 11, cache.bytes)
+}
+
+func TestArchiveCacheFromEnv(t *testing.T) {
+	defer os.Unsetenv(ArchiveCacheSize)
+
+	env, _ := envinject.NewInjectedEnv()
+	cache, err := archiveCacheFromEnv(env)
+	if assert.Nil(t, err) && assert.NotNil(t, cache) {
+		assert.Equal(t, DefaultArchiveCacheSize, cache.maxBytes)
+	}
+
+	os.Setenv(ArchiveCacheSize, "0")
+	env, _ = envinject.NewInjectedEnv()
+	cache, err = archiveCacheFromEnv(env)
+	assert.Nil(t, err)
+	assert.Nil(t, cache)
+
+	os.Setenv(ArchiveCacheSize, "lots")
+	env, _ = envinject.NewInjectedEnv()
+	_, err = NewArchiveHandler(nil, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+	assert.NotNil(t, err)
+}
+
+func expectArchiveQueries(mock sqlmock.Sqlmock, next string) {
+	mock.ExpectQuery("select event_time").WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+			AddRow([]driver.Value{time.Now(), "1x2x333", 3, "foo", []byte("yeah ok")}...),
+	)
+	mock.ExpectQuery("select previous").WillReturnRows(sqlmock.NewRows([]string{"previous"}).AddRow("prev-xxx"))
+	expectNextFeedQuery(mock, next)
+}
+
+func expectNextFeedQuery(mock sqlmock.Sqlmock, next string) {
+	rows := sqlmock.NewRows([]string{"feedid"})
+	if next != "" {
+		rows = rows.AddRow(next)
+	}
+
+	mock.ExpectQuery("select feedid").WillReturnRows(rows)
+}
+
+func TestArchiveHandlerCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	env, _ := envinject.NewInjectedEnv()
+	archiveHandler, err := NewArchiveHandler(pgFeedStore(t, db), "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	get := func(uri string) string {
+		r, _ := http.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w.Body.String()
+	}
+
+	hits := archiveCacheHits.Value()
+
+	//An archive with a newer archive is rendered once, then served from the cache
+	//without touching the database.
+	expectArchiveQueries(mock, "next-xxx")
+	first := get("/notifications/foo")
+	second := get("/notifications/foo")
+	assert.Equal(t, first, second)
+	assert.Equal(t, hits+1, archiveCacheHits.Value())
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	//The newest archive links to recent, so the next feed is rechecked on each hit...
+	expectArchiveQueries(mock, "")
+	expectNextFeedQuery(mock, "")
+	first = get("/notifications/bar")
+	second = get("/notifications/bar")
+	assert.Equal(t, first, second)
+	assert.True(t, strings.Contains(second, `rel="next-archive" href="https://testhost:12345/notifications/recent"`))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	//...and the page is rebuilt once a newer feed has been archived
+	expectNextFeedQuery(mock, "baz")
+	expectArchiveQueries(mock, "baz")
+	third := get("/notifications/bar")
+	assert.False(t, strings.Contains(third, `rel="next-archive" href="https://testhost:12345/notifications/recent"`))
+	assert.True(t, strings.Contains(third, `rel="next-archive" href="https://testhost:12345/notifications/baz"`))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	fourth := get("/notifications/bar")
+	assert.Equal(t, third, fourth)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -1,7 +1,7 @@
 package esatompubpg
 
 import (
-	"database/sql"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
@@ -14,6 +14,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/xtracdev/envinject"
 	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/tools/blog/atom"
 )
 
@@ -33,31 +34,29 @@ const (
 
 //Used to serialize event store content when directly retrieving using aggregate id and version
 type EventStoreContent struct {
-	XMLName     xml.Name  `xml:"http://github.com/xtracdev/goes event"`
-	AggregateId string    `xml:"aggregateId"`
-	Version     int       `xml:"version"`
-	Published   time.Time `xml:"published"`
-	TypeCode    string    `xml:"typecode"`
-	Content     string    `xml:"content"`
+	XMLName     xml.Name  `xml:"http://github.com/xtracdev/goes event" json:"-"`
+	AggregateId string    `xml:"aggregateId" json:"aggregateId"`
+	Version     int       `xml:"version" json:"version"`
+	Published   time.Time `xml:"published" json:"published"`
+	TypeCode    string    `xml:"typecode" json:"typecode"`
+	Content     string    `xml:"content" json:"content"`
 }
 
-//Add the retrieved events for a given feed to the atom feed structure
-func addItemsToFeed(feed *atom.Feed, events []atomdata.TimestampedEvent, linkhostport, proto string) {
+//Add the retrieved events for a given feed to the atom feed structure, with their payloads
+//redacted for the consumer
+func addItemsToFeed(feed *Feed, events []atomdata.TimestampedEvent, r *redaction, linkhostport, proto string) {
 
 	for _, event := range events {
 
-		encodedPayload := base64.StdEncoding.EncodeToString(event.Payload.([]byte))
+		published := atom.TimeStr(event.Timestamp.Format(time.RFC3339Nano))
 
-		content := &atom.Text{
-			Type: event.TypeCode,
-			Body: encodedPayload,
-		}
-
-		entry := &atom.Entry{
+		entry := &Entry{
 			Title:     "event",
-			ID:        fmt.Sprintf("urn:esid:%s:%d", event.Source, event.Version),
-			Published: atom.TimeStr(event.Timestamp.Format(time.RFC3339Nano)),
-			Content:   content,
+			ID:        entryID(event),
+			Published: published,
+			Updated:   published,
+			Category:  []Category{{Term: event.TypeCode, Scheme: TypeCodeScheme}},
+			Content:   entryContent(event, r.payload(event)),
 		}
 
 		link := atom.Link{
@@ -73,14 +72,41 @@ func addItemsToFeed(feed *atom.Feed, events []atomdata.TimestampedEvent, linkhos
 
 }
 
+//archiveUpdated returns the time the newest of the events was published
+func archiveUpdated(events []atomdata.TimestampedEvent) atom.TimeStr {
+	var newest time.Time
+	for _, event := range events {
+		if event.Timestamp.After(newest) {
+			newest = event.Timestamp
+		}
+	}
+
+	return atom.TimeStr(newest.Format(time.RFC3339Nano))
+}
+
+//recentETagID identifies the state of the recent page by the id of its newest entry and the
+//id of the most recently archived feed.
+func recentETagID(latestFeed string, events []atomdata.TimestampedEvent) string {
+	var newest string
+	if len(events) > 0 {
+		newest = fmt.Sprintf("%s:%d", events[0].Source, events[0].Version)
+	}
+
+	return fmt.Sprintf("recent:%s:%s", latestFeed, newest)
+}
+
 //NewRecentHandler instantiates the handler for retrieve recent notifications, which are those that have not
 //yet been assigned a feed id. This will be served up at /notifications/recent
+//The feed is returned as atom unless the Accept header indicates a preference for JSON, in
+//which case the JSON Feed representation is returned.
+//The entries can be restricted to those with given typecodes using the typecode query
+//parameter, which may be repeated. The link relations carry the filter.
 //The linkhostport argument is used to set the host and port in the link relations URL. This is useful
 //when proxying the feed, in which case the link relation URLs can reflect the proxied URLs, not the
 //direct URL.
-func NewRecentHandler(db *sql.DB, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+func NewRecentHandler(store FeedStore, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
 	}
 
 	if env == nil {
@@ -96,76 +122,122 @@ func NewRecentHandler(db *sql.DB, linkhostport string, env *envinject.InjectedEn
 		linkProto = "https"
 	}
 
+	redactionPolicy, err := NewRedactionPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(rw http.ResponseWriter, req *http.Request) {
-		events, err := atomdata.RetrieveRecent(db)
+		logger := requestLogger(req)
+		store := traceFeedStore(req.Context(), store)
+
+		events, err := store.RetrieveRecent()
 		if err != nil {
-			log.Warnf("Error retrieving recent items: %s", err.Error())
+			logger.Warnf("Error retrieving recent items: %s", err.Error())
 			http.Error(rw, "Error retrieving feed items", http.StatusInternalServerError)
 			return
 		}
 
-		latestFeed, err := atomdata.RetrieveLastFeed(db)
+		latestFeed, err := store.RetrieveLastFeed()
 		if err != nil {
-			log.Warnf("Error retrieving last feed id: %s", err.Error())
+			logger.Warnf("Error retrieving last feed id: %s", err.Error())
 			http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
 			return
 		}
 
-		feed := atom.Feed{
+		//Only the entries with the requested typecodes that the consumer may see are served, so
+		//the ETag is derived from the newest of those.
+		selection := selectionFromRequest(req, redactionPolicy)
+		events = selection.apply(events)
+
+		//The recent page changes when events are added to it or it is archived, so derive a weak
+		//ETag from the newest entry and the latest feed id to let polling clients revalidate.
+		contentType := negotiateContentType(req, feedContentTypes)
+		encoding := negotiateEncoding(req)
+		etag := entityTag(encodingTagID(selection.tagID(recentETagID(latestFeed, events)), encoding), true, contentType, AtomContentType)
+		if ifNoneMatch(req, etag) {
+			writeNotModified(rw, etag, "no-store")
+			return
+		}
+
+		feed := Feed{
 			Title:   "Event store feed",
 			ID:      "recent",
 			Updated: atom.TimeStr(time.Now().Format(time.RFC3339)),
 		}
 
 		self := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/recent", linkProto, linkhostport),
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, selection.query()),
 			Rel:  "self",
 		}
 
 		via := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/recent", linkProto, linkhostport),
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, selection.query()),
 			Rel:  "related",
 		}
 
+		//The recent page is the subscription document RFC 5005 archives refer to as current
+		current := atom.Link{
+			Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, selection.query()),
+			Rel:  "current",
+		}
+
 		feed.Link = append(feed.Link, self)
 		feed.Link = append(feed.Link, via)
+		feed.Link = append(feed.Link, current)
 
 		if latestFeed != "" {
 			previous := atom.Link{
-				Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, latestFeed),
+				Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, latestFeed, selection.query()),
 				Rel:  "prev-archive",
 			}
 			feed.Link = append(feed.Link, previous)
 		}
 
-		addItemsToFeed(&feed, events, linkhostport, linkProto)
+		addItemsToFeed(&feed, events, selection.redaction, linkhostport, linkProto)
+		observeEntries(req, len(events))
 
-		out, err := xml.Marshal(&feed)
+		err = ae.encryptEntries(req.Context(), &feed)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		encodedOut, err := ae.EncryptOutput(out)
+		_, span := startSpan(req.Context(), "render", attribute.String("atompub.content_type", contentType))
+		out, err := marshalFeed(&feed, contentType)
+		endSpan(span, err)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		encodedOut, contentEncoding, err := ae.encodeFeed(req.Context(), out, encoding)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setContentEncoding(rw, contentEncoding)
+		rw.Header().Add("ETag", etag)
 		rw.Header().Add("Cache-Control", "no-store")
-		rw.Header().Add("Content-Type", "application/atom+xml")
+		rw.Header().Add("Vary", "Accept, Accept-Encoding")
+		rw.Header().Add("Content-Type", contentType)
 		rw.Write(encodedOut)
 	}, nil
 }
 
 //NewArchiveHandler instantiates a handler for retrieving feed archives, which is a set of events
 //associated with a specific feed id. This will be served up at /notifications/{feedId}
+//As with the recent handler, the representation is selected via the Accept header, and the
+//entries can be filtered by typecode.
+//Pages are RFC 5005 archive documents: they're marked with fh:archive, link to the recent page
+//as current, and are updated as of their newest entry.
 //The linkhostport argument is used to set the host and port in the link relations URL. This is useful
 //when proxying the feed, in which case the link relation URLs can reflect the proxied URLs, not the
 //direct URL.
-func NewArchiveHandler(db *sql.DB, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+func NewArchiveHandler(store FeedStore, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
 	}
 
 	if env == nil {
@@ -181,123 +253,268 @@ func NewArchiveHandler(db *sql.DB, linkhostport string, env *envinject.InjectedE
 		linkProto = "https"
 	}
 
+	cache, err := archiveCacheFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+
+	redactionPolicy, err := NewRedactionPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(rw http.ResponseWriter, req *http.Request) {
+		logger := requestLogger(req)
+		store := traceFeedStore(req.Context(), store)
+
 		feedID := mux.Vars(req)["feedId"]
 		if feedID == "" {
 			http.Error(rw, "No feed id in uri", http.StatusBadRequest)
 			return
 		}
 
-		log.Infof("processing request for feed %s", feedID)
-
-		//Retrieve events for the given feed id.
-		latestFeed, err := atomdata.RetrieveArchive(db, feedID)
-		if err != nil {
-			log.Warnf("Error retrieving last feed id: %s", err.Error())
-			http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
+		logger.Infof("processing request for feed %s", feedID)
+
+		//Archived feeds are immutable, so a client holding a matching ETag already has the
+		//current contents and we can answer without going to the database. A page filtered by
+		//typecode, or restricted to the events a consumer may see, is a different resource,
+		//with its own ETag and cache entry, as is each content coding of a page. If-None-Match: *
+		//is only honoured once the feed is known to exist.
+		selection := selectionFromRequest(req, redactionPolicy)
+		contentType := negotiateContentType(req, feedContentTypes)
+		encoding := negotiateEncoding(req)
+		etag := entityTag(encodingTagID(selection.tagID(feedID), encoding), false, contentType, AtomContentType)
+		if feedID != "recent" && ifNoneMatchTag(req, etag) {
+			logger.Infof("feed %s not modified", feedID)
+			writeNotModified(rw, etag, cacheControl(req, "max-age=2592000"))
 			return
 		}
 
-		//Did we get any events? We should not have a feed other than recent with no events, therefore
-		//if there are no events then the feed id does not exist.
-		if len(latestFeed) == 0 {
-			log.Infof("No data found for feed %s", feedID)
-			http.Error(rw, "", http.StatusNotFound)
-			return
+		var page *archivePage
+		var err error
+		if cache != nil && feedID != "recent" {
+			page, err = cachedArchivePage(store, cache, archiveCacheKey(feedID, contentType, encoding, selection), feedID)
+			if err != nil {
+				logger.Warnf("Error retrieving next feed id: %s", err.Error())
+				http.Error(rw, "Error retrieving next feed id", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		previousFeed, err := atomdata.RetrievePreviousFeed(db, feedID)
-		if err != nil {
-			log.Warnf("Error retrieving previous feed id: %s", err.Error())
-			http.Error(rw, "Error retrieving previous feed id", http.StatusInternalServerError)
+		if page == nil {
+			page = renderArchivePage(req.Context(), rw, store, ae, feedID, selection, contentType, encoding, linkhostport, linkProto)
+			if page == nil {
+				return
+			}
+
+			if cache != nil && feedID != "recent" {
+				cache.add(page)
+			}
+		}
+
+		if feedID != "recent" && ifNoneMatch(req, etag) {
+			logger.Infof("feed %s not modified", feedID)
+			writeNotModified(rw, etag, cacheControl(req, "max-age=2592000"))
 			return
 		}
 
-		nextFeed, err := atomdata.RetrieveNextFeed(db, feedID)
+		observeEntries(req, page.entries)
+
+		//Pages are cached compressed, with their entries encrypted if the feed is encrypted entry
+		//by entry, so at most need encrypting as a whole
+		encodedOut, contentEncoding, err := ae.sealFeed(req.Context(), page.body, encoding)
 		if err != nil {
-			log.Warnf("Error retrieving next feed id: %s", err.Error())
-			http.Error(rw, "Error retrieving next feed id", http.StatusInternalServerError)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		feed := atom.Feed{
-			Title: "Event store feed",
-			ID:    feedID,
+		//For all feeds except recent, we can indicate the page can be cached for a long time,
+		//e.g. 30 days. The recent page is mutable so we don't indicate caching for it. We could
+		//potentially attempt to load it from this method via link traversal.
+		if feedID != "recent" {
+			logger.Infof("setting Cache-Control max-age=2592000 for ETag %s", feedID)
+			rw.Header().Add("Cache-Control", cacheControl(req, "max-age=2592000")) //Contents are immutable, cache for a month
+			rw.Header().Add("ETag", etag)
+		} else {
+			rw.Header().Add("Cache-Control", "no-store")
 		}
 
-		self := atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, feedID),
-			Rel:  "self",
-		}
+		setContentEncoding(rw, contentEncoding)
+		rw.Header().Add("Vary", "Accept, Accept-Encoding")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Write(encodedOut)
 
-		feed.Link = append(feed.Link, self)
+	}, nil
+}
 
-		if previousFeed.Valid {
-			feed.Link = append(feed.Link, atom.Link{
-				Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, previousFeed.String),
-				Rel:  "prev-archive",
-			})
+//cachedArchivePage returns the cached page for the key, or nil if the page is not cached. The
+//newest archive page is only served from the cache while its next-archive link still refers
+//to recent; once a newer feed has been archived the page is evicted so it can be rebuilt.
+func cachedArchivePage(store FeedStore, cache *archiveCache, key string, feedID string) (*archivePage, error) {
+	page, ok := cache.get(key)
+	if !ok {
+		return nil, nil
+	}
+
+	if page.newest {
+		nextFeed, err := store.RetrieveNextFeed(feedID)
+		if err != nil {
+			return nil, err
 		}
 
-		var next string
-		if (nextFeed.Valid == true && nextFeed.String == "") || !nextFeed.Valid {
-			next = "recent"
-		} else {
-			next = nextFeed.String
+		if nextFeed != "" {
+			log.Infof("feed %s is no longer the newest archive", feedID)
+			cache.remove(key)
+			return nil, nil
 		}
+	}
+
+	return page, nil
+}
+
+//renderArchivePage retrieves the events and link relations for an archived feed and renders
+//the page in the given representation, with the entries selected for the request, compressed
+//with the given content coding. In entry encryption mode the entries are encrypted as the page
+//is rendered. If the page can't be rendered an error response is written and nil is returned.
+func renderArchivePage(ctx context.Context, rw http.ResponseWriter, store FeedStore, ae *AtomEncrypter, feedID string, selection entrySelection, contentType string, encoding string, linkhostport string, linkProto string) *archivePage {
+	logger := contextLogger(ctx)
+
+	//Retrieve events for the given feed id.
+	latestFeed, err := store.RetrieveArchive(feedID)
+	if err != nil {
+		logger.Warnf("Error retrieving last feed id: %s", err.Error())
+		http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
+		return nil
+	}
+
+	//Did we get any events? We should not have a feed other than recent with no events, therefore
+	//if there are no events then the feed id does not exist.
+	if len(latestFeed) == 0 {
+		logger.Infof("No data found for feed %s", feedID)
+		http.Error(rw, "", http.StatusNotFound)
+		return nil
+	}
+
+	previousFeed, err := store.RetrievePreviousFeed(feedID)
+	if err != nil {
+		logger.Warnf("Error retrieving previous feed id: %s", err.Error())
+		http.Error(rw, "Error retrieving previous feed id", http.StatusInternalServerError)
+		return nil
+	}
+
+	nextFeed, err := store.RetrieveNextFeed(feedID)
+	if err != nil {
+		logger.Warnf("Error retrieving next feed id: %s", err.Error())
+		http.Error(rw, "Error retrieving next feed id", http.StatusInternalServerError)
+		return nil
+	}
+
+	//An archive doesn't change, so it was last updated when its newest entry was published
+	feed := Feed{
+		Title:   "Event store feed",
+		ID:      feedID,
+		Updated: archiveUpdated(latestFeed),
+	}
+
+	if feedID != "recent" {
+		feed.Archive = &struct{}{}
+	}
 
+	self := atom.Link{
+		Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, feedID, selection.query()),
+		Rel:  "self",
+	}
+
+	current := atom.Link{
+		Href: fmt.Sprintf("%s://%s/notifications/recent%s", linkProto, linkhostport, selection.query()),
+		Rel:  "current",
+	}
+
+	feed.Link = append(feed.Link, self)
+	feed.Link = append(feed.Link, current)
+
+	if previousFeed != "" {
 		feed.Link = append(feed.Link, atom.Link{
-			Href: fmt.Sprintf("%s://%s/notifications/%s", linkProto, linkhostport, next),
-			Rel:  "next-archive",
+			Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, previousFeed, selection.query()),
+			Rel:  "prev-archive",
 		})
+	}
 
-		addItemsToFeed(&feed, latestFeed, linkhostport, linkProto)
+	next := nextFeed
+	if next == "" {
+		next = "recent"
+	}
 
-		out, err := xml.Marshal(&feed)
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	feed.Link = append(feed.Link, atom.Link{
+		Href: fmt.Sprintf("%s://%s/notifications/%s%s", linkProto, linkhostport, next, selection.query()),
+		Rel:  "next-archive",
+	})
 
-		encodedOut, err := ae.EncryptOutput(out)
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	//The feed exists even if none of its entries are selected, so the selection is applied
+	//after checking for the feed and an empty page returned in that case.
+	selected := selection.apply(latestFeed)
+	addItemsToFeed(&feed, selected, selection.redaction, linkhostport, linkProto)
 
-		//For all feeds except recent, we can indicate the page can be cached for a long time,
-		//e.g. 30 days. The recent page is mutable so we don't indicate caching for it. We could
-		//potentially attempt to load it from this method via link traversal.
-		if feedID != "recent" {
-			log.Infof("setting Cache-Control max-age=2592000 for ETag %s", feedID)
-			rw.Header().Add("Cache-Control", "max-age=2592000") //Contents are immutable, cache for a month
-			rw.Header().Add("ETag", feedID)
-		} else {
-			rw.Header().Add("Cache-Control", "no-store")
-		}
+	err = ae.encryptEntries(ctx, &feed)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
 
-		rw.Header().Add("Content-Type", "application/atom+xml")
-		rw.Write(encodedOut)
+	_, span := startSpan(ctx, "render", attribute.String("atompub.content_type", contentType))
+	out, err := marshalFeed(&feed, contentType)
+	endSpan(span, err)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
 
-	}, nil
+	_, span = startSpan(ctx, "compress", attribute.String("atompub.content_encoding", encoding))
+	out, err = compress(encoding, out)
+	endSpan(span, err)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return &archivePage{
+		key:     archiveCacheKey(feedID, contentType, encoding, selection),
+		body:    out,
+		entries: len(selected),
+		newest:  next == "recent",
+	}
 }
 
 //NewRetrieveHandler instantiates a handler for the retrieval of specific events by aggregate id
 //and version. This will be served at /notifications/{aggregateId}/{version}
-func NewEventRetrieveHandler(db *sql.DB, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
-	if db == nil {
-		return nil, ErrBadDBConnection
+//Consumers get a 403 response for events their grant doesn't allow them to see, and payloads
+//are redacted per the redaction policy, as in the feed.
+func NewEventRetrieveHandler(store FeedStore, env *envinject.InjectedEnv, ae *AtomEncrypter) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
+	}
+
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
 	}
 
 	if ae == nil {
 		return nil, ErrMissingAtomEncrypter
 	}
 
+	redactionPolicy, err := NewRedactionPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(rw http.ResponseWriter, req *http.Request) {
+		logger := requestLogger(req)
+		store := traceFeedStore(req.Context(), store)
+
 		aggregateID := mux.Vars(req)["aggregateId"]
 		versionParam := mux.Vars(req)["version"]
 
-		log.Infof("Retrieving event %s %s", aggregateID, versionParam)
+		logger.Infof("Retrieving event %s %s", aggregateID, versionParam)
 
 		version, err := strconv.Atoi(versionParam)
 		if err != nil {
@@ -305,42 +522,71 @@ func NewEventRetrieveHandler(db *sql.DB, ae *AtomEncrypter) (func(rw http.Respon
 			return
 		}
 
-		event, err := atomdata.RetrieveEvent(db, aggregateID, version)
+		//Events are immutable, so there's no need to retrieve the event if the client
+		//already has it. Consumers restricted to some events must be allowed to see it first,
+		//and If-None-Match: * is only honoured once the event is known to exist.
+		//The payload redacted for a consumer is a different representation, with its own tag.
+		grant := grantFromRequest(req)
+		selection := entrySelection{redaction: redactionPolicy.forRequest(req)}
+		contentType := negotiateContentType(req, eventContentTypes)
+		encoding := negotiateEncoding(req)
+		etag := entityTag(encodingTagID(selection.tagID(fmt.Sprintf("%s:%d", aggregateID, version)), encoding), false, contentType, XMLContentType)
+		if grant.allowsAll() && ifNoneMatchTag(req, etag) {
+			writeNotModified(rw, etag, cacheControl(req, "max-age=2592000"))
+			return
+		}
+
+		event, err := store.RetrieveEvent(aggregateID, version)
 		if err != nil {
 			switch err {
-			case sql.ErrNoRows:
+			case ErrEventNotFound:
 				http.Error(rw, "", http.StatusNotFound)
 			default:
-				log.Warnf("Error retrieving event: %s", err.Error())
+				logger.Warnf("Error retrieving event: %s", err.Error())
 				http.Error(rw, "Error retrieving event", http.StatusInternalServerError)
 			}
 
 			return
 		}
 
+		if !grant.allows(event) {
+			logger.Infof("Consumer %s may not see event %s %d", ConsumerID(req), aggregateID, version)
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+
+		if ifNoneMatch(req, etag) {
+			writeNotModified(rw, etag, cacheControl(req, "max-age=2592000"))
+			return
+		}
+
 		eventContent := EventStoreContent{
 			AggregateId: aggregateID,
 			Version:     version,
 			TypeCode:    event.TypeCode,
 			Published:   event.Timestamp,
-			Content:     base64.StdEncoding.EncodeToString(event.Payload.([]byte)),
+			Content:     base64.StdEncoding.EncodeToString(selection.redaction.payload(event)),
 		}
 
-		marshalled, err := xml.Marshal(&eventContent)
+		_, span := startSpan(req.Context(), "render", attribute.String("atompub.content_type", contentType))
+		marshalled, err := marshalEvent(&eventContent, contentType)
+		endSpan(span, err)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		encodedOut, err := ae.EncryptOutput(marshalled)
+		encodedOut, contentEncoding, err := ae.encodeOutput(req.Context(), marshalled, encoding)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		rw.Header().Add("Content-Type", "application/xml")
-		rw.Header().Add("ETag", fmt.Sprintf("%s:%d", aggregateID, version))
-		rw.Header().Add("Cache-Control", "max-age=2592000")
+		setContentEncoding(rw, contentEncoding)
+		rw.Header().Add("Vary", "Accept, Accept-Encoding")
+		rw.Header().Add("Content-Type", contentType)
+		rw.Header().Add("ETag", etag)
+		rw.Header().Add("Cache-Control", cacheControl(req, "max-age=2592000"))
 
 		rw.Write(encodedOut)
 
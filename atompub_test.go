@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -133,10 +134,10 @@ func TestRetrieve(t *testing.T) {
 			env, _ := envinject.NewInjectedEnv()
 			ae, _ := NewAtomEncrypter(env)
 			if test.nilDB == false {
-				eventHandler, err = NewEventRetrieveHandler(db, ae)
+				eventHandler, err = NewEventRetrieveHandler(pgFeedStore(t, db), env, ae)
 				assert.Nil(t, err)
 			} else {
-				eventHandler, err = NewEventRetrieveHandler(nil, ae)
+				eventHandler, err = NewEventRetrieveHandler(nil, env, ae)
 				assert.NotNil(t, err)
 				return
 			}
@@ -173,7 +174,7 @@ func TestRetrieve(t *testing.T) {
 				assert.Equal(t, "max-age=2592000", cc)
 
 				etag := w.Header().Get("ETag")
-				assert.Equal(t, "1234567:1", etag)
+				assert.Equal(t, `"1234567:1"`, etag)
 
 				//Validate content type
 				assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
@@ -185,8 +186,8 @@ func TestRetrieve(t *testing.T) {
 	}
 }
 
-func getLink(linkRelationship string, feed *atom.Feed) *string {
-	for _, l := range feed.Link {
+func getLink(linkRelationship string, links []atom.Link) *string {
+	for _, l := range links {
 		if l.Rel == linkRelationship {
 			return &l.Href
 		}
@@ -337,7 +338,7 @@ func TestRecentFeedHandler(t *testing.T) {
 			env, _ := envinject.NewInjectedEnv()
 			ae, _ := NewAtomEncrypter(env)
 			if test.nilDB == false {
-				eventHandler, err = NewRecentHandler(db, "testhost:12345", env, ae)
+				eventHandler, err = NewRecentHandler(pgFeedStore(t, db), "testhost:12345", env, ae)
 				assert.Nil(t, err)
 			} else {
 				eventHandler, err = NewRecentHandler(nil, "testhost:12345", env, ae)
@@ -368,26 +369,31 @@ func TestRecentFeedHandler(t *testing.T) {
 					assert.Equal(t, "recent", feed.ID)
 					_, err := time.Parse(time.RFC3339, string(feed.Updated))
 					assert.Nil(t, err)
-					prev := getLink("prev-archive", &feed)
+					prev := getLink("prev-archive", feed.Link)
 					if assert.NotNil(t, prev) {
 						assert.Equal(t, test.expectedPrev, *prev)
 					}
-					self := getLink("self", &feed)
+					self := getLink("self", feed.Link)
 					if assert.NotNil(t, self) {
 						assert.Equal(t, test.expectedSelf, *self)
 					}
 
-					related := getLink("related", &feed)
+					related := getLink("related", feed.Link)
 					if assert.NotNil(t, related) {
 						assert.Equal(t, *self, *related)
 					}
+
+					current := getLink("current", feed.Link)
+					if assert.NotNil(t, current) {
+						assert.Equal(t, *self, *current)
+					}
 				}
 
 				cc := w.Header().Get("Cache-Control")
 				assert.Equal(t, "no-store", cc)
 
 				etag := w.Header().Get("ETag")
-				assert.Equal(t, "", etag)
+				assert.Equal(t, `W/"recent:feed-xxx:1x2x333:3"`, etag)
 			}
 
 			err = mock.ExpectationsWereMet()
@@ -617,7 +623,7 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 			env, _ := envinject.NewInjectedEnv()
 			ae, _ := NewAtomEncrypter(env)
 			if test.nilDB == false {
-				archiveHandler, err = NewArchiveHandler(db, "testhost:12345", env, ae)
+				archiveHandler, err = NewArchiveHandler(pgFeedStore(t, db), "testhost:12345", env, ae)
 				assert.Nil(t, err)
 			} else {
 				archiveHandler, err = NewArchiveHandler(nil, "testhost:12345", env, ae)
@@ -650,38 +656,47 @@ func TestRetrieveArchiveHandler(t *testing.T) {
 			assert.Nil(t, err)
 
 			if test.expectedNext != "" {
-				var feed atom.Feed
+				var feed Feed
 				err = xml.Unmarshal(eventData, &feed)
 				if assert.Nil(t, err) {
 					assert.Equal(t, test.feedid, feed.ID)
-					assert.Equal(t, "", string(feed.Updated))
+					_, err = time.Parse(time.RFC3339Nano, string(feed.Updated))
 					assert.Nil(t, err)
-					prev := getLink("prev-archive", &feed)
+					current := getLink("current", feed.Link)
+					if assert.NotNil(t, current) {
+						assert.Equal(t, "https://testhost:12345/notifications/recent", *current)
+					}
+					prev := getLink("prev-archive", feed.Link)
 					if assert.NotNil(t, prev) {
 						assert.Equal(t, test.expectedPrev, *prev)
 					}
-					self := getLink("self", &feed)
+					self := getLink("self", feed.Link)
 					if assert.NotNil(t, self) {
 						assert.Equal(t, test.expectedSelf, *self)
 					}
-					next := getLink("next-archive", &feed)
+					next := getLink("next-archive", feed.Link)
 					if assert.NotNil(t, next) {
 						assert.Equal(t, test.expectedNext, *next)
 					}
 
 					if assert.Equal(t, 1, len(feed.Entry)) {
 						assert.Equal(t, "urn:esid:1x2x333:3", feed.Entry[0].ID)
-						assert.Equal(t, "foo", feed.Entry[0].Content.Type)
+						assert.Equal(t, "foo", feed.Entry[0].TypeCode())
+						assert.Equal(t, OctetStreamContentType, feed.Entry[0].Content.Type)
 						_, err = time.Parse(time.RFC3339Nano, string(feed.Entry[0].Published))
 						assert.Nil(t, err)
+						assert.Equal(t, feed.Entry[0].Published, feed.Updated)
 					}
 
+					archived := strings.Contains(string(eventData), `<archive xmlns="`+FeedHistoryNamespace+`"></archive>`)
+					assert.Equal(t, feed.ID != "recent", archived)
+
 					if feed.ID != "recent" {
 						cc := w.Header().Get("Cache-Control")
 						assert.Equal(t, "max-age=2592000", cc)
 
 						etag := w.Header().Get("ETag")
-						assert.Equal(t, "foo", etag)
+						assert.Equal(t, `"foo"`, etag)
 					} else {
 						cc := w.Header().Get("Cache-Control")
 						assert.Equal(t, "no-store", cc)
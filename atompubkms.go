@@ -1,18 +1,21 @@
 package esatompubpg
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/xtracdev/envinject"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -20,56 +23,150 @@ const (
 	KeyAlias     = "KEY_ALIAS"
 )
 
+var ErrMalformedCiphertext = errors.New("malformed ciphertext")
+
 type AtomEncrypter struct {
-	keyAlias string
-	kmsSvc   *kms.KMS
+	keyProvider KeyProvider
+	keyCache    *dataKeyCache
+	metrics     MetricsRecorder
+	entryMode   bool
 }
 
+//NewAtomEncrypter creates an encrypter using the key provider selected by the injected
+//environment. If no key provider is configured, output is passed through unencrypted.
 func NewAtomEncrypter(env *envinject.InjectedEnv) (*AtomEncrypter, error) {
 	if env == nil {
 		return nil, ErrMissingInjectedEnv
 	}
 
-	encrypter := AtomEncrypter{}
-	var kmsSvc *kms.KMS
+	keyProvider, err := NewKeyProvider(env)
+	if err != nil {
+		return nil, err
+	}
 
-	keyAlias := KeyAliasRoot + env.Getenv(KeyAlias)
-	if keyAlias != KeyAliasRoot {
-		encrypter.keyAlias = keyAlias
+	encrypter := NewAtomEncrypterWithKeyProvider(keyProvider)
 
-		log.Infof("Key alias specified: %s", keyAlias)
-		log.Infof("AWS_REGION: %s", env.Getenv("AWS_REGION"))
-		log.Infof("AWS_PROFILE: %s", env.Getenv("AWS_PROFILE"))
+	err = encrypter.SetEncryptionMode(env.Getenv(EncryptionMode))
+	if err != nil {
+		return nil, err
+	}
 
-		sess, err := session.NewSession()
-		if err != nil {
-			return nil, err
-		}
+	err = encrypter.CheckKMSConfig()
+	if err != nil {
+		return nil, err
+	}
 
-		kmsSvc = kms.New(sess)
-		encrypter.kmsSvc = kmsSvc
+	maxMessages, maxAge, err := keyCacheConfigFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
 
-		err = encrypter.CheckKMSConfig()
-		if err != nil {
-			return nil, err
-		}
+	if keyProvider != nil && (maxMessages > 0 || maxAge > 0) {
+		log.Infof("Caching data keys for %d messages or %s", maxMessages, maxAge)
+		encrypter.CacheDataKeys(maxMessages, maxAge)
 	}
 
-	return &encrypter, nil
+	return encrypter, nil
 }
 
+//NewAtomEncrypterWithKeyProvider creates an encrypter that obtains its data keys from the
+//given key provider. A nil key provider disables encryption.
+func NewAtomEncrypterWithKeyProvider(keyProvider KeyProvider) *AtomEncrypter {
+	return &AtomEncrypter{
+		keyProvider: keyProvider,
+	}
+}
+
+//SetMetricsRecorder sets the recorder for the latency of encrypting output and the errors
+//obtaining data keys. A nil recorder disables recording.
+func (ae *AtomEncrypter) SetMetricsRecorder(recorder MetricsRecorder) {
+	ae.metrics = recorder
+}
+
+//CheckKMSConfig verifies a data key can be obtained from the configured key provider. Despite
+//the name this applies to any key provider, not just KMS.
 func (ae *AtomEncrypter) CheckKMSConfig() error {
-	if ae.keyAlias == KeyAliasRoot {
+	if ae.keyProvider == nil {
 		return nil
 	}
 
+	dataKey, err := ae.keyProvider.GenerateDataKey()
+	if err != nil {
+		return err
+	}
+
+	dataKey.zero()
+	return nil
+}
+
+//KMSKeyProvider generates and decrypts data keys using an AWS KMS customer master key.
+type KMSKeyProvider struct {
+	keyAlias string
+	kmsSvc   *kms.KMS
+}
+
+//NewKMSKeyProvider creates a key provider for the KMS key with the given alias. The alias may be
+//given with or without the alias/ prefix. Decrypting data keys does not require the alias, so an
+//empty alias may be used by consumers that only decrypt.
+func NewKMSKeyProvider(keyAlias string) (*KMSKeyProvider, error) {
+	if keyAlias != "" && !strings.HasPrefix(keyAlias, KeyAliasRoot) {
+		keyAlias = KeyAliasRoot + keyAlias
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KMSKeyProvider{
+		keyAlias: keyAlias,
+		kmsSvc:   kms.New(sess),
+	}, nil
+}
+
+func (kp *KMSKeyProvider) GenerateDataKey() (*DataKey, error) {
 	params := &kms.GenerateDataKeyInput{
-		KeyId:   aws.String(ae.keyAlias), // Required
+		KeyId:   aws.String(kp.keyAlias), // Required
 		KeySpec: aws.String("AES_256"),
 	}
 
-	_, err := ae.kmsSvc.GenerateDataKey(params)
-	return err
+	resp, err := kp.kmsSvc.GenerateDataKey(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		Plaintext:    resp.Plaintext,
+		EncryptedKey: resp.CiphertextBlob,
+		Provider:     KMSKeyProviderType,
+		KeyID:        aws.StringValue(resp.KeyId),
+	}, nil
+}
+
+func (kp *KMSKeyProvider) DecryptDataKey(encryptedKey []byte) ([]byte, error) {
+	di := &kms.DecryptInput{
+		CiphertextBlob: encryptedKey,
+	}
+
+	resp, err := kp.kmsSvc.Decrypt(di)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Plaintext, nil
+}
+
+func newKMSKeyProviderFromEnv(env *envinject.InjectedEnv) (KeyProvider, error) {
+	keyAlias := KeyAliasRoot + env.Getenv(KeyAlias)
+	if keyAlias == KeyAliasRoot {
+		return nil, ErrMissingKeyAlias
+	}
+
+	log.Infof("Key alias specified: %s", keyAlias)
+	log.Infof("AWS_REGION: %s", env.Getenv("AWS_REGION"))
+	log.Infof("AWS_PROFILE: %s", env.Getenv("AWS_PROFILE"))
+
+	return NewKMSKeyProvider(keyAlias)
 }
 
 //Encrypt from cryptopasta commit bc3a108a5776376aa811eea34b93383837994340
@@ -94,46 +191,165 @@ func encrypt(plaintext []byte, key *[32]byte) ([]byte, error) {
 	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
+//Decrypt from cryptopasta commit bc3a108a5776376aa811eea34b93383837994340
+//used via the CC0 license. See https://github.com/gtank/cryptopasta
+func decrypt(ciphertext []byte, key *[32]byte) ([]byte, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return gcm.Open(nil,
+		ciphertext[:gcm.NonceSize()],
+		ciphertext[gcm.NonceSize():],
+		nil,
+	)
+}
+
+//dataKey returns the plaintext data key to encrypt with along with a description of the key
+//minus its plaintext, either from the data key cache or freshly generated by the key provider.
+func (ae *AtomEncrypter) dataKey() ([32]byte, *DataKey, error) {
+	if ae.keyCache != nil {
+		return ae.keyCache.dataKey()
+	}
+
+	key := [32]byte{}
+
+	dataKey, err := ae.keyProvider.GenerateDataKey()
+	if err != nil {
+		return key, nil, err
+	}
+
+	if len(dataKey.Plaintext) < 32 {
+		dataKey.zero()
+		return key, nil, ErrInvalidDataKey
+	}
+
+	copy(key[:], dataKey.Plaintext[0:32])
+	dataKey.zero()
+
+	return key, dataKey.withoutPlaintext(), nil
+}
+
 //EncryptOutput encrypts the output as indicated by the configuration settings, e.g.
-//KEY_ALIAS set to something. Here we obtain the encryption key from KMS, and append the
-//encrypted version of the key to the encoded output.
+//KEY_ALIAS set to something. Here we obtain the encryption key from the key provider, and
+//return the encrypted output along with the encrypted version of the key in an envelope.
+//See DecryptOutput for decrypting the envelope.
 func (ae *AtomEncrypter) EncryptOutput(out []byte) ([]byte, error) {
-	if ae.keyAlias == "" {
-		return out, nil
+	return ae.encryptOutput(context.Background(), out, IdentityEncoding)
+}
+
+//encodeOutput compresses the output with the content coding negotiated for the request, then
+//encrypts it if the feed is encrypted. It returns the response body and its content coding.
+func (ae *AtomEncrypter) encodeOutput(ctx context.Context, out []byte, encoding string) ([]byte, string, error) {
+	_, span := startSpan(ctx, "compress", attribute.String("atompub.content_encoding", encoding))
+	compressed, err := compress(encoding, out)
+	endSpan(span, err)
+	if err != nil {
+		return nil, "", err
 	}
 
-	//Get the encryption keys
-	params := &kms.GenerateDataKeyInput{
-		KeyId:   aws.String(ae.keyAlias), // Required
-		KeySpec: aws.String("AES_256"),
+	return ae.sealOutput(ctx, compressed, encoding)
+}
+
+//sealOutput encrypts output already compressed with the content coding if the feed is
+//encrypted. Ciphertext doesn't compress, so the plaintext is compressed and the coding given in
+//the envelope, and the response itself has no content coding.
+func (ae *AtomEncrypter) sealOutput(ctx context.Context, compressed []byte, encoding string) ([]byte, string, error) {
+	if ae.keyProvider == nil {
+		return compressed, encoding, nil
 	}
 
-	resp, err := ae.kmsSvc.GenerateDataKey(params)
+	encrypted, err := ae.encryptOutput(ctx, compressed, encoding)
+	return encrypted, IdentityEncoding, err
+}
+
+//encryptOutput encrypts the output, which has been compressed with the given content coding,
+//tracing the encryption and obtaining the data key as children of the context's span.
+func (ae *AtomEncrypter) encryptOutput(ctx context.Context, out []byte, encoding string) ([]byte, error) {
+	encrypted, err := ae.encryptOutputs(ctx, [][]byte{out}, encoding)
 	if err != nil {
 		return nil, err
 	}
 
-	key := [32]byte{}
-	copy(key[:], resp.Plaintext[0:32])
+	return encrypted[0], nil
+}
+
+//encryptOutputs encrypts several outputs, each in its own envelope, with a single data key, so
+//a batch of outputs such as the entries sent on the event stream costs one key provider call.
+func (ae *AtomEncrypter) encryptOutputs(ctx context.Context, outs [][]byte, encoding string) (encrypted [][]byte, err error) {
+	if ae.keyProvider == nil {
+		return outs, nil
+	}
+
+	plaintextBytes := 0
+	for _, out := range outs {
+		plaintextBytes += len(out)
+	}
 
-	//Encrypt the output
-	encrypted, err := encrypt(out, &key)
+	ctx, span := startSpan(ctx, "AtomEncrypter.EncryptOutput",
+		attribute.Int("atompub.plaintext_bytes", plaintextBytes),
+		attribute.Int("atompub.outputs", len(outs)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if ae.metrics != nil {
+		start := time.Now()
+		defer func() {
+			ae.metrics.ObserveEncryption(time.Since(start), err)
+		}()
+	}
+
+	//Get the encryption keys
+	key, dataKey, err := ae.generateDataKey(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	//Purge the key from memory
-	key = [32]byte{}
-	resp.Plaintext = nil
+	defer func() {
+		key = [32]byte{}
+	}()
 
-	//Encode the output
-	encodedOut := base64.StdEncoding.EncodeToString(encrypted)
+	//Encrypt the outputs
+	for _, out := range outs {
+		ciphertext, err := encrypt(out, &key)
+		if err != nil {
+			return nil, err
+		}
 
-	//Encode the encryptedKey - this will have to be decrypted using the KMS
-	//CMK before the payload can be decrypted with it
-	encodedKey := base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+		sealed, err := sealEnvelope(dataKey, ciphertext, encoding)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted = append(encrypted, sealed)
+	}
 
-	keyPlusText := fmt.Sprintf("%s::%s", encodedKey, encodedOut)
+	return encrypted, nil
+}
+
+//generateDataKey obtains the data key to encrypt with, tracing it as a child of the context's
+//span and recording key provider errors.
+func (ae *AtomEncrypter) generateDataKey(ctx context.Context) ([32]byte, *DataKey, error) {
+	_, keySpan := startSpan(ctx, "KeyProvider.GenerateDataKey",
+		attribute.String("atompub.key_provider", keyProviderType(ae.keyProvider)),
+		attribute.Bool("atompub.key_cache", ae.keyCache != nil))
+	key, dataKey, err := ae.dataKey()
+	endSpan(keySpan, err)
+	if err != nil && ae.metrics != nil {
+		ae.metrics.ObserveKeyProviderError(keyProviderType(ae.keyProvider), err)
+	}
 
-	return []byte(keyPlusText), nil
+	return key, dataKey, err
 }
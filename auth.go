@@ -0,0 +1,212 @@
+package esatompubpg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/xtracdev/envinject"
+)
+
+var ErrMissingCredentials = errors.New("No API key or bearer token presented")
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+var ErrPolicyWithoutAuth = errors.New("AUTH_POLICY_FILE requires AUTH_JWKS_FILE or AUTH_API_KEYS_FILE")
+
+//Consumers are authenticated with bearer JWTs signed by a key in the JSON web key set file
+//AUTH_JWKS_FILE, whose subject identifies the consumer, or with API keys read from
+//AUTH_API_KEYS_FILE, a JSON object mapping consumer names to their keys. Tokens must have the
+//issuer and audience given by AUTH_JWT_ISSUER and AUTH_JWT_AUDIENCE when these are set. The
+//events each consumer may see are given by the policy in AUTH_POLICY_FILE; without a policy
+//authenticated consumers may see all events.
+const (
+	AuthJWKSFile    = "AUTH_JWKS_FILE"
+	AuthJWTIssuer   = "AUTH_JWT_ISSUER"
+	AuthJWTAudience = "AUTH_JWT_AUDIENCE"
+	AuthAPIKeysFile = "AUTH_API_KEYS_FILE"
+	AuthPolicyFile  = "AUTH_POLICY_FILE"
+	APIKeyHeader    = "X-API-Key"
+)
+
+type authContextKey int
+
+const consumerContextKey authContextKey = 0
+
+//consumer is an authenticated consumer and the events it may see
+type consumer struct {
+	id    string
+	grant *Grant
+}
+
+//Authenticator is middleware that authenticates feed consumers and attaches their grant to
+//the request, for the handlers to serve only the events the consumer may see.
+type Authenticator struct {
+	jwt     *jwtVerifier
+	apiKeys map[[sha256.Size]byte]string
+	policy  *Policy
+}
+
+//NewAuthenticator creates the authenticator configured by the environment, or returns nil if
+//no authentication method is configured.
+func NewAuthenticator(env *envinject.InjectedEnv) (*Authenticator, error) {
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	a := new(Authenticator)
+
+	if file := env.Getenv(AuthJWKSFile); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		a.jwt, err = newJWTVerifier(f, env.Getenv(AuthJWTIssuer), env.Getenv(AuthJWTAudience))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if file := env.Getenv(AuthAPIKeysFile); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys map[string]string
+		err = json.NewDecoder(f).Decode(&keys)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		a.SetAPIKeys(keys)
+	}
+
+	if file := env.Getenv(AuthPolicyFile); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		a.policy, err = LoadPolicy(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.jwt == nil && a.apiKeys == nil {
+		if a.policy != nil {
+			return nil, ErrPolicyWithoutAuth
+		}
+
+		return nil, nil
+	}
+
+	return a, nil
+}
+
+//SetAPIKeys sets the API keys, given as a map of consumer names to keys. Only digests of the
+//keys are kept, which also means looking a key up takes no longer for a near miss.
+func (a *Authenticator) SetAPIKeys(keys map[string]string) {
+	a.apiKeys = make(map[[sha256.Size]byte]string)
+	for consumer, key := range keys {
+		a.apiKeys[sha256.Sum256([]byte(key))] = consumer
+	}
+}
+
+//SetPolicy sets the policy granting consumers access to events
+func (a *Authenticator) SetPolicy(policy *Policy) {
+	a.policy = policy
+}
+
+//authenticate returns the consumer presenting the request's credentials
+func (a *Authenticator) authenticate(req *http.Request) (string, error) {
+	if key := req.Header.Get(APIKeyHeader); key != "" && a.apiKeys != nil {
+		consumer, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return "", ErrInvalidAPIKey
+		}
+
+		return consumer, nil
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") && a.jwt != nil {
+		return a.jwt.verify(strings.TrimPrefix(authorization, "Bearer "))
+	}
+
+	return "", ErrMissingCredentials
+}
+
+//Middleware authenticates requests before passing them to the next handler. Requests without
+//valid credentials get a 401 response, and those from consumers without a grant in the policy
+//a 403 response. The ping resource is not authenticated.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == PingURI {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		id, err := a.authenticate(req)
+		if err != nil {
+			requestLogger(req).Infof("Authentication failed for %s: %s", req.URL.Path, err.Error())
+			if a.jwt != nil {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="atompub"`)
+			}
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		//The consumer is logged even if it isn't granted access
+		if record := requestRecordFromContext(req.Context()); record != nil {
+			record.consumer = id
+		}
+
+		grant, ok := a.policy.grant(id)
+		if !ok {
+			requestLogger(req).Infof("No grant for consumer %s", id)
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), consumerContextKey, &consumer{id: id, grant: grant})
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+//ConsumerID returns the id of the authenticated consumer making the request, or the empty
+//string if the request was not authenticated.
+func ConsumerID(req *http.Request) string {
+	if c, ok := req.Context().Value(consumerContextKey).(*consumer); ok {
+		return c.id
+	}
+
+	return ""
+}
+
+//grantFromRequest returns the grant of the authenticated consumer, which is nil if all events
+//may be seen.
+func grantFromRequest(req *http.Request) *Grant {
+	if c, ok := req.Context().Value(consumerContextKey).(*consumer); ok {
+		return c.grant
+	}
+
+	return nil
+}
+
+//cacheControl returns the Cache-Control header for a response to the request. Responses to
+//authenticated consumers are private so shared caches don't serve them to other consumers.
+func cacheControl(req *http.Request, directives string) string {
+	if ConsumerID(req) != "" && directives != "no-store" {
+		return "private, " + directives
+	}
+
+	return directives
+}
@@ -0,0 +1,113 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	verifier, _ := newJWTVerifier(bytes.NewReader(keys.jwks()), "", "")
+	a := &Authenticator{jwt: verifier}
+	a.SetAPIKeys(map[string]string{"billing": "s3cr3t"})
+
+	policy, err := LoadPolicy(strings.NewReader(`{"consumers": {"billing": {"typecodes": ["foo"]}, "audit": {"typecodes": ["*"]}}}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+	a.SetPolicy(policy)
+
+	var consumerID string
+	handler := a.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		consumerID = ConsumerID(req)
+	}))
+
+	get := func(uri string, header string, value string) *httptest.ResponseRecorder {
+		consumerID = ""
+		r, _ := http.NewRequest("GET", uri, nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/notifications/recent", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	assert.Equal(t, `Bearer realm="atompub"`, w.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, http.StatusOK, get(PingURI, "", "").Result().StatusCode)
+
+	assert.Equal(t, http.StatusOK, get("/notifications/recent", APIKeyHeader, "s3cr3t").Result().StatusCode)
+	assert.Equal(t, "billing", consumerID)
+	assert.Equal(t, http.StatusUnauthorized, get("/notifications/recent", APIKeyHeader, "guess").Result().StatusCode)
+
+	token := keys.sign(t, "ES256", "ec1", validClaims("audit"))
+	assert.Equal(t, http.StatusOK, get("/notifications/recent", "Authorization", "Bearer "+token).Result().StatusCode)
+	assert.Equal(t, "audit", consumerID)
+	assert.Equal(t, http.StatusUnauthorized, get("/notifications/recent", "Authorization", "Bearer "+token+"x").Result().StatusCode)
+
+	//Authenticated consumers without a grant are refused
+	token = keys.sign(t, "ES256", "ec1", validClaims("intruder"))
+	assert.Equal(t, http.StatusForbidden, get("/notifications/recent", "Authorization", "Bearer "+token).Result().StatusCode)
+	assert.Equal(t, "", consumerID)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	env, _ := envinject.NewInjectedEnv()
+	a, err := NewAuthenticator(env)
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	dir, err := ioutil.TempDir("", "atompubauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	keysFile := filepath.Join(dir, "keys.json")
+	policyFile := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(jwksFile, newTestSigningKeys(t).jwks(), 0600)
+	ioutil.WriteFile(keysFile, []byte(`{"billing": "s3cr3t"}`), 0600)
+	ioutil.WriteFile(policyFile, []byte(`{"consumers": {"billing": {"aggregatePrefixes": ["invoice-"]}}}`), 0600)
+
+	os.Setenv(AuthPolicyFile, policyFile)
+	defer os.Unsetenv(AuthPolicyFile)
+	env, _ = envinject.NewInjectedEnv()
+	_, err = NewAuthenticator(env)
+	assert.Equal(t, ErrPolicyWithoutAuth, err)
+
+	os.Setenv(AuthJWKSFile, jwksFile)
+	defer os.Unsetenv(AuthJWKSFile)
+	os.Setenv(AuthAPIKeysFile, keysFile)
+	defer os.Unsetenv(AuthAPIKeysFile)
+	env, _ = envinject.NewInjectedEnv()
+	a, err = NewAuthenticator(env)
+	if assert.Nil(t, err) && assert.NotNil(t, a) {
+		assert.NotNil(t, a.jwt)
+		r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+		r.Header.Set(APIKeyHeader, "s3cr3t")
+		consumer, err := a.authenticate(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "billing", consumer)
+		grant, ok := a.policy.grant("billing")
+		assert.True(t, ok)
+		assert.Equal(t, []string{"invoice-"}, grant.AggregatePrefixes)
+	}
+
+	os.Setenv(AuthJWKSFile, filepath.Join(dir, "nope.json"))
+	env, _ = envinject.NewInjectedEnv()
+	_, err = NewAuthenticator(env)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//Checkpoint records the position of a consumer in the feed: the id of the last entry processed
+//and the id of the feed page it was read from.
+type Checkpoint struct {
+	FeedID  string `json:"feedId"`
+	EntryID string `json:"entryId"`
+}
+
+//CheckpointStore persists a consumer's checkpoint. Load returns nil if no checkpoint has
+//been saved yet.
+type CheckpointStore interface {
+	Load() (*Checkpoint, error)
+	Save(checkpoint Checkpoint) error
+}
+
+//FileCheckpointStore stores the checkpoint as JSON in a file
+type FileCheckpointStore struct {
+	path string
+}
+
+//NewFileCheckpointStore creates a checkpoint store backed by the file at the given path
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+func (s *FileCheckpointStore) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	err = json.Unmarshal(data, &checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checkpoint, nil
+}
+
+//Save writes the checkpoint to a temporary file which is synced and then renamed over the
+//checkpoint file, so a crash never leaves a partially written checkpoint behind.
+func (s *FileCheckpointStore) Save(checkpoint Checkpoint) error {
+	data, err := json.Marshal(&checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,293 @@
+//Package client provides a consumer for the event store atom feed. It retrieves the recent and
+//archive pages, decompresses and decrypts the output, whether encrypted as a whole or entry by
+//entry, follows the archive link relations, and parses feed entries back into events.
+package client
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	atompub "github.com/xtracdev/es-atom-pub-pg"
+)
+
+var ErrMissingKeyProvider = errors.New("Feed content is encrypted but no key provider was given")
+var ErrMalformedEntryID = errors.New("Malformed entry id")
+var ErrResponseTooLarge = errors.New("Response exceeds the maximum response size")
+
+//Link relations used to navigate the feed
+const (
+	SelfRel        = "self"
+	PrevArchiveRel = "prev-archive"
+	NextArchiveRel = "next-archive"
+)
+
+//StatusError is returned when the feed server responds with a status other than 200
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("GET %s returned status %d", e.URL, e.StatusCode)
+}
+
+//Client retrieves and decodes feed pages. The key provider is used to decrypt encrypted pages, or
+//the encrypted entries of pages; it may be nil if the feed is not encrypted. Responses larger
+//than MaxResponseSize bytes, as received or once decompressed, are rejected.
+type Client struct {
+	HTTPClient      *http.Client
+	MaxResponseSize int64
+	baseURL         string
+	keyProvider     atompub.KeyProvider
+}
+
+//Event is an event store event parsed from a feed entry. The payload is rendered according to
+//the typecode by the feed, in the given content type; payloads the feed has no renderer for are
+//application/octet-stream, as is.
+type Event struct {
+	ID          string
+	AggregateID string
+	Version     int
+	TypeCode    string
+	ContentType string
+	Published   time.Time
+	Payload     []byte
+	Link        string
+}
+
+//Page is a decoded feed page. Events are in the order they were published, oldest first.
+type Page struct {
+	Feed   *atompub.Feed
+	ID     string
+	Events []Event
+}
+
+//NewClient creates a client for the feed served at baseURL, e.g. https://host:port
+func NewClient(baseURL string, keyProvider atompub.KeyProvider) *Client {
+	return &Client{
+		HTTPClient:      http.DefaultClient,
+		MaxResponseSize: atompub.DefaultMaxDecompressedSize,
+		baseURL:         strings.TrimSuffix(baseURL, "/"),
+		keyProvider:     keyProvider,
+	}
+}
+
+//RecentURL returns the URL of the recent page
+func (c *Client) RecentURL() string {
+	return c.baseURL + atompub.RecentHandlerURI
+}
+
+//ArchiveURL returns the URL of the archive page with the given feed id
+func (c *Client) ArchiveURL(feedID string) string {
+	return fmt.Sprintf("%s/notifications/%s", c.baseURL, feedID)
+}
+
+//Recent retrieves the recent page
+func (c *Client) Recent() (*Page, error) {
+	return c.Page(c.RecentURL())
+}
+
+//Archive retrieves the archive page with the given feed id
+func (c *Client) Archive(feedID string) (*Page, error) {
+	return c.Page(c.ArchiveURL(feedID))
+}
+
+//Page retrieves the feed page at the given URL, as found for instance in the
+//link relations of another page.
+func (c *Client) Page(url string) (*Page, error) {
+	body, err := c.get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var feed atompub.Feed
+	err = xml.Unmarshal(body, &feed)
+	if err != nil {
+		return nil, err
+	}
+
+	//Feeds encrypted entry by entry have their data key in the clear page
+	if feed.EncryptionKey != nil {
+		if c.keyProvider == nil {
+			return nil, ErrMissingKeyProvider
+		}
+
+		err = feed.DecryptEntries(c.keyProvider)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewPage(&feed)
+}
+
+//get retrieves the given resource, decompressing and decrypting it if needed
+func (c *Client) get(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", atompub.AtomContentType)
+	req.Header.Set("Accept-Encoding", atompub.BrotliEncoding+", "+atompub.GzipEncoding)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxResponseSize()+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > c.maxResponseSize() {
+		return nil, ErrResponseTooLarge
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	body, err = atompub.DecompressLimit(resp.Header.Get("Content-Encoding"), body, c.maxResponseSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decrypt(body)
+}
+
+func (c *Client) decrypt(body []byte) ([]byte, error) {
+	envelope, err := atompub.DecodeEnvelope(body)
+	if err == atompub.ErrNotEnvelope {
+		return body, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.keyProvider == nil {
+		return nil, ErrMissingKeyProvider
+	}
+
+	return envelope.OpenLimit(c.keyProvider, c.maxResponseSize())
+}
+
+func (c *Client) maxResponseSize() int64 {
+	if c.MaxResponseSize <= 0 {
+		return atompub.DefaultMaxDecompressedSize
+	}
+
+	return c.MaxResponseSize
+}
+
+//NewPage creates a page from an atom feed, parsing its entries into events
+func NewPage(feed *atompub.Feed) (*Page, error) {
+	page := &Page{
+		Feed: feed,
+		ID:   feed.ID,
+	}
+
+	//Entries are listed newest first
+	for i := len(feed.Entry) - 1; i >= 0; i-- {
+		event, err := ParseEntry(feed.Entry[i])
+		if err != nil {
+			return nil, err
+		}
+
+		page.Events = append(page.Events, *event)
+	}
+
+	return page, nil
+}
+
+//Link returns the href of the link with the given relation, or the empty string
+//if the page has no such link.
+func (p *Page) Link(rel string) string {
+	for _, l := range p.Feed.Link {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+
+	return ""
+}
+
+//ParseEntryID splits an entry id of the form urn:esid:aggregateId:version into its
+//aggregate id and version.
+func ParseEntryID(id string) (string, int, error) {
+	const prefix = "urn:esid:"
+	if !strings.HasPrefix(id, prefix) {
+		return "", 0, ErrMalformedEntryID
+	}
+
+	idAndVersion := id[len(prefix):]
+	sep := strings.LastIndex(idAndVersion, ":")
+	if sep <= 0 {
+		return "", 0, ErrMalformedEntryID
+	}
+
+	version, err := strconv.Atoi(idAndVersion[sep+1:])
+	if err != nil {
+		return "", 0, ErrMalformedEntryID
+	}
+
+	return idAndVersion[:sep], version, nil
+}
+
+//ParseEntry converts a feed entry into an event, decoding its payload. The payload is as
+//rendered by the feed for the typecode, in the content type given by the event.
+func ParseEntry(entry *atompub.Entry) (*Event, error) {
+	aggregateID, version, err := ParseEntryID(entry.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &Event{
+		ID:          entry.ID,
+		AggregateID: aggregateID,
+		Version:     version,
+	}
+
+	if entry.Published != "" {
+		event.Published, err = time.Parse(time.RFC3339Nano, string(entry.Published))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Entries from earlier versions of the feed have no typecode category; they give the
+	//typecode as the content type and the payload is always base64 encoded
+	event.TypeCode = entry.TypeCode()
+	if entry.Content != nil {
+		if event.TypeCode == "" {
+			event.TypeCode = entry.Content.Type
+			event.ContentType = atompub.OctetStreamContentType
+			event.Payload, err = base64.StdEncoding.DecodeString(entry.Content.Body)
+		} else {
+			event.ContentType = entry.Content.Type
+			event.Payload, err = entry.Content.Payload()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, l := range entry.Link {
+		if l.Rel == SelfRel {
+			event.Link = l.Href
+		}
+	}
+
+	return event, nil
+}
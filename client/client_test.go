@@ -0,0 +1,352 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	atompub "github.com/xtracdev/es-atom-pub-pg"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+type testPage struct {
+	prev, next string
+	aggregates []string
+}
+
+//Two archives and the recent page, each entry is version 1 of the named aggregate
+var testPages = map[string]testPage{
+	"f1":     {"", "f2", []string{"a", "b"}},
+	"f2":     {"f1", "recent", []string{"c", "d"}},
+	"recent": {"f2", "", []string{"e:x"}},
+}
+
+func newTestFeed(pages map[string]testPage, baseURL, feedID string) *atom.Feed {
+	page := pages[feedID]
+	feed := &atom.Feed{
+		Title: "Event store feed",
+		ID:    feedID,
+	}
+
+	feed.Link = append(feed.Link, atom.Link{Rel: "self", Href: fmt.Sprintf("%s/notifications/%s", baseURL, feedID)})
+	if page.prev != "" {
+		feed.Link = append(feed.Link, atom.Link{Rel: "prev-archive", Href: fmt.Sprintf("%s/notifications/%s", baseURL, page.prev)})
+	}
+	if page.next != "" {
+		feed.Link = append(feed.Link, atom.Link{Rel: "next-archive", Href: fmt.Sprintf("%s/notifications/%s", baseURL, page.next)})
+	}
+
+	//Entries are listed newest first
+	for i := len(page.aggregates) - 1; i >= 0; i-- {
+		agg := page.aggregates[i]
+		feed.Entry = append(feed.Entry, &atom.Entry{
+			Title:     "event",
+			ID:        fmt.Sprintf("urn:esid:%s:1", agg),
+			Published: atom.TimeStr(time.Now().Format(time.RFC3339Nano)),
+			Content: &atom.Text{
+				Type: "TypeCode" + agg,
+				Body: base64.StdEncoding.EncodeToString([]byte("payload " + agg)),
+			},
+			Link: []atom.Link{{Rel: "self", Href: fmt.Sprintf("%s/events/%s/1", baseURL, agg)}},
+		})
+	}
+
+	return feed
+}
+
+func newTestServer(ae *atompub.AtomEncrypter) *httptest.Server {
+	return newTestServerForPages(ae, func() map[string]testPage { return testPages })
+}
+
+func newTestServerForPages(ae *atompub.AtomEncrypter, pages func() map[string]testPage) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		feedID := strings.TrimPrefix(req.URL.Path, "/notifications/")
+		current := pages()
+		if _, ok := current[feedID]; !ok {
+			http.Error(rw, "", http.StatusNotFound)
+			return
+		}
+
+		out, _ := xml.Marshal(newTestFeed(current, "http://"+req.Host, feedID))
+		out, _ = ae.EncryptOutput(out)
+		rw.Write(out)
+	}))
+}
+
+func TestIterateFeed(t *testing.T) {
+	kp, _ := atompub.NewLocalKeyProvider(testMasterKey)
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted %v", encrypted), func(t *testing.T) {
+			var ae *atompub.AtomEncrypter
+			if encrypted {
+				ae = atompub.NewAtomEncrypterWithKeyProvider(kp)
+			} else {
+				ae = atompub.NewAtomEncrypterWithKeyProvider(nil)
+			}
+
+			ts := newTestServer(ae)
+			defer ts.Close()
+
+			c := NewClient(ts.URL+"/", kp)
+			it, err := c.Events()
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			var aggregates, pages []string
+			for it.Next() {
+				event := it.Event()
+				aggregates = append(aggregates, event.AggregateID)
+				pages = append(pages, it.Page().ID)
+
+				assert.Equal(t, 1, event.Version)
+				assert.Equal(t, "TypeCode"+event.AggregateID, event.TypeCode)
+				assert.Equal(t, "payload "+event.AggregateID, string(event.Payload))
+				assert.Equal(t, fmt.Sprintf("%s/events/%s/1", ts.URL, event.AggregateID), event.Link)
+				assert.False(t, event.Published.IsZero())
+			}
+
+			assert.Nil(t, it.Err())
+			assert.Equal(t, []string{"a", "b", "c", "d", "e:x"}, aggregates)
+			assert.Equal(t, []string{"f1", "f1", "f2", "f2", "recent"}, pages)
+		})
+	}
+}
+
+func TestCompressedFeed(t *testing.T) {
+	kp, _ := atompub.NewLocalKeyProvider(testMasterKey)
+
+	store := atompub.NewMemoryFeedStore()
+	store.Add(atomdata.TimestampedEvent{
+		Event:     goes.Event{Source: "a", Version: 1, TypeCode: "TypeCodea", Payload: []byte("payload a")},
+		Timestamp: time.Now(),
+	})
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted %v", encrypted), func(t *testing.T) {
+			ae := atompub.NewAtomEncrypterWithKeyProvider(nil)
+			if encrypted {
+				ae = atompub.NewAtomEncrypterWithKeyProvider(kp)
+			}
+
+			env, _ := envinject.NewInjectedEnv()
+			recentHandler, _ := atompub.NewRecentHandler(store, "testhost:12345", env, ae)
+
+			var contentEncoding string
+			ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				recentHandler(rw, req)
+				contentEncoding = rw.Header().Get("Content-Encoding")
+			}))
+			defer ts.Close()
+
+			page, err := NewClient(ts.URL, kp).Recent()
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			if encrypted {
+				assert.Equal(t, "", contentEncoding)
+			} else {
+				assert.Equal(t, atompub.BrotliEncoding, contentEncoding)
+			}
+
+			if assert.Equal(t, 1, len(page.Events)) {
+				assert.Equal(t, "payload a", string(page.Events[0].Payload))
+			}
+		})
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	kp, _ := atompub.NewLocalKeyProvider(testMasterKey)
+
+	store := atompub.NewMemoryFeedStore()
+	store.Add(atomdata.TimestampedEvent{
+		Event:     goes.Event{Source: "a", Version: 1, TypeCode: "TypeCodea", Payload: []byte(strings.Repeat("payload ", 1<<14))},
+		Timestamp: time.Now(),
+	})
+
+	for _, encrypted := range []bool{false, true} {
+		ae := atompub.NewAtomEncrypterWithKeyProvider(nil)
+		if encrypted {
+			ae = atompub.NewAtomEncrypterWithKeyProvider(kp)
+		}
+
+		env, _ := envinject.NewInjectedEnv()
+		recentHandler, _ := atompub.NewRecentHandler(store, "testhost:12345", env, ae)
+		ts := httptest.NewServer(http.HandlerFunc(recentHandler))
+
+		//The compressed page is well under the limit, but not once decompressed
+		c := NewClient(ts.URL, kp)
+		c.MaxResponseSize = 1 << 14
+		_, err := c.Recent()
+		assert.Equal(t, atompub.ErrDecompressedSizeExceeded, err, "encrypted %v", encrypted)
+
+		c.MaxResponseSize = 1 << 20
+		page, err := c.Recent()
+		if assert.Nil(t, err, "encrypted %v", encrypted) {
+			assert.Equal(t, 1, len(page.Events))
+		}
+
+		ts.Close()
+	}
+
+	//Uncompressed responses are limited as received
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(bytes.Repeat([]byte(" "), 1<<12))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, nil)
+	c.MaxResponseSize = 1 << 10
+	_, err := c.Recent()
+	assert.Equal(t, ErrResponseTooLarge, err)
+}
+
+func TestRenderedPayloads(t *testing.T) {
+	atompub.RegisterPayloadRenderer("ClientJSON", atompub.JSONPayloadRenderer)
+	atompub.RegisterPayloadRenderer("ClientXML", atompub.XMLPayloadRenderer)
+
+	store := atompub.NewMemoryFeedStore()
+	for i, e := range []struct{ typeCode, payload string }{
+		{"ClientJSON", `{"a":1}`},
+		{"ClientXML", `<a>1</a>`},
+		{"ClientOpaque", "opaque"},
+	} {
+		store.Add(atomdata.TimestampedEvent{
+			Event:     goes.Event{Source: "agg", Version: i + 1, TypeCode: e.typeCode, Payload: []byte(e.payload)},
+			Timestamp: time.Now(),
+		})
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	recentHandler, _ := atompub.NewRecentHandler(store, "testhost:12345", env, atompub.NewAtomEncrypterWithKeyProvider(nil))
+	ts := httptest.NewServer(http.HandlerFunc(recentHandler))
+	defer ts.Close()
+
+	page, err := NewClient(ts.URL, nil).Recent()
+	if !assert.Nil(t, err) || !assert.Equal(t, 3, len(page.Events)) {
+		return
+	}
+
+	assert.Equal(t, "ClientJSON", page.Events[0].TypeCode)
+	assert.Equal(t, atompub.JSONContentType, page.Events[0].ContentType)
+	assert.Equal(t, `{"a":1}`, string(page.Events[0].Payload))
+
+	assert.Equal(t, "ClientXML", page.Events[1].TypeCode)
+	assert.Equal(t, atompub.XMLContentType, page.Events[1].ContentType)
+	assert.Equal(t, `<a>1</a>`, string(page.Events[1].Payload))
+
+	assert.Equal(t, "ClientOpaque", page.Events[2].TypeCode)
+	assert.Equal(t, atompub.OctetStreamContentType, page.Events[2].ContentType)
+	assert.Equal(t, "opaque", string(page.Events[2].Payload))
+}
+
+func TestEntryEncryptedFeed(t *testing.T) {
+	kp, _ := atompub.NewLocalKeyProvider(testMasterKey)
+	ae := atompub.NewAtomEncrypterWithKeyProvider(kp)
+	ae.SetEncryptionMode(atompub.EntryEncryptionMode)
+
+	atompub.RegisterPayloadRenderer("ClientEntryJSON", atompub.JSONPayloadRenderer)
+
+	store := atompub.NewMemoryFeedStore()
+	store.Add(atomdata.TimestampedEvent{
+		Event:     goes.Event{Source: "a", Version: 1, TypeCode: "ClientEntryJSON", Payload: []byte(`{"a":1}`)},
+		Timestamp: time.Now(),
+	})
+	store.CreateFeed("feed1")
+	store.Add(atomdata.TimestampedEvent{
+		Event:     goes.Event{Source: "b", Version: 1, TypeCode: "ClientEntryOpaque", Payload: []byte("payload b")},
+		Timestamp: time.Now(),
+	})
+
+	env, _ := envinject.NewInjectedEnv()
+	recentHandler, _ := atompub.NewRecentHandler(store, "testhost:12345", env, ae)
+	archiveHandler, _ := atompub.NewArchiveHandler(store, "testhost:12345", env, ae)
+
+	router := mux.NewRouter()
+	router.HandleFunc(atompub.RecentHandlerURI, recentHandler)
+	router.HandleFunc(atompub.ArchiveHandlerURI, archiveHandler)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	c := NewClient(ts.URL, kp)
+
+	archive, err := c.Archive("feed1")
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(archive.Events)) {
+		assert.Nil(t, archive.Feed.EncryptionKey)
+		assert.Equal(t, "ClientEntryJSON", archive.Events[0].TypeCode)
+		assert.Equal(t, atompub.JSONContentType, archive.Events[0].ContentType)
+		assert.Equal(t, `{"a":1}`, string(archive.Events[0].Payload))
+	}
+
+	recent, err := c.Recent()
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(recent.Events)) {
+		assert.Equal(t, "ClientEntryOpaque", recent.Events[0].TypeCode)
+		assert.Equal(t, atompub.OctetStreamContentType, recent.Events[0].ContentType)
+		assert.Equal(t, "payload b", string(recent.Events[0].Payload))
+	}
+
+	_, err = NewClient(ts.URL, nil).Recent()
+	assert.Equal(t, ErrMissingKeyProvider, err)
+}
+
+func TestEncryptedFeedWithoutKeyProvider(t *testing.T) {
+	kp, _ := atompub.NewLocalKeyProvider(testMasterKey)
+	ts := newTestServer(atompub.NewAtomEncrypterWithKeyProvider(kp))
+	defer ts.Close()
+
+	_, err := NewClient(ts.URL, nil).Recent()
+	assert.Equal(t, ErrMissingKeyProvider, err)
+}
+
+func TestPageNotFound(t *testing.T) {
+	ts := newTestServer(atompub.NewAtomEncrypterWithKeyProvider(nil))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, nil)
+	_, err := c.Archive("nope")
+	if assert.NotNil(t, err) {
+		statusErr, ok := err.(*StatusError)
+		if assert.True(t, ok) {
+			assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+		}
+	}
+
+	it := c.Iterator(c.ArchiveURL("nope"))
+	assert.False(t, it.Next())
+	assert.NotNil(t, it.Err())
+}
+
+func TestParseEntryID(t *testing.T) {
+	aggregateID, version, err := ParseEntryID("urn:esid:1x2x333:3")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "1x2x333", aggregateID)
+		assert.Equal(t, 3, version)
+	}
+
+	aggregateID, version, err = ParseEntryID("urn:esid:with:colons:12")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "with:colons", aggregateID)
+		assert.Equal(t, 12, version)
+	}
+
+	for _, id := range []string{"urn:foo:x:1", "urn:esid:x", "urn:esid::1", "urn:esid:x:y"} {
+		_, _, err = ParseEntryID(id)
+		assert.Equal(t, ErrMalformedEntryID, err, id)
+	}
+}
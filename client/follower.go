@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrCheckpointNotFound = errors.New("Checkpointed entry not found in feed")
+
+//Default polling intervals for the follower. Polling starts at the minimum interval and
+//backs off to the maximum while there is nothing new or the feed cannot be read.
+const (
+	DefaultMinPollInterval = 1 * time.Second
+	DefaultMaxPollInterval = 30 * time.Second
+)
+
+//EventHandler processes an event read by a follower. If the handler returns an error the
+//follower stops without advancing its checkpoint past the event.
+type EventHandler func(event *Event) error
+
+//HandlerError is returned by the follower when the event handler fails
+type HandlerError struct {
+	Event *Event
+	Err   error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("Error handling event %s: %s", e.Event.ID, e.Err.Error())
+}
+
+//Follower hands each event in the feed to a handler exactly once and in order, persisting its
+//position in the feed via a checkpoint store so it can resume where it left off after a restart.
+type Follower struct {
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	client          *Client
+	store           CheckpointStore
+	handler         EventHandler
+}
+
+//NewFollower creates a follower that reads the feed using the given client
+func NewFollower(c *Client, store CheckpointStore, handler EventHandler) *Follower {
+	return &Follower{
+		MinPollInterval: DefaultMinPollInterval,
+		MaxPollInterval: DefaultMaxPollInterval,
+		client:          c,
+		store:           store,
+		handler:         handler,
+	}
+}
+
+//Run processes the feed until the context is cancelled or the handler returns an error. After
+//catching up with the feed the recent page is polled for new events.
+func (f *Follower) Run(ctx context.Context) error {
+	interval := f.MinPollInterval
+
+	for {
+		processed, err := f.CatchUp(ctx)
+		if _, ok := err.(*HandlerError); ok {
+			return err
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			log.Warnf("Error following feed: %s", err.Error())
+			interval = f.backoff(interval)
+		case processed > 0:
+			interval = f.MinPollInterval
+		default:
+			interval = f.backoff(interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (f *Follower) backoff(interval time.Duration) time.Duration {
+	interval *= 2
+	if interval > f.MaxPollInterval {
+		interval = f.MaxPollInterval
+	}
+
+	return interval
+}
+
+//CatchUp processes the events published since the last checkpoint, returning the
+//number of events processed.
+func (f *Follower) CatchUp(ctx context.Context) (int, error) {
+	checkpoint, err := f.store.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	start, err := f.findStart(ctx, checkpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	skipping := checkpoint != nil
+
+	it := f.client.Iterator(start)
+	for it.Next() {
+		if ctx.Err() != nil {
+			return processed, ctx.Err()
+		}
+
+		event := it.Event()
+
+		//Skip the events on the starting page up to and including the checkpointed entry
+		if skipping {
+			if event.ID == checkpoint.EntryID {
+				skipping = false
+			}
+			continue
+		}
+
+		err = f.handler(event)
+		if err != nil {
+			return processed, &HandlerError{Event: event, Err: err}
+		}
+
+		err = f.store.Save(Checkpoint{FeedID: it.Page().ID, EntryID: event.ID})
+		if err != nil {
+			return processed, err
+		}
+
+		processed++
+	}
+
+	return processed, it.Err()
+}
+
+//findStart returns the URL of the page holding the checkpointed entry, or of the oldest page
+//if there is no checkpoint yet. Archives don't change, so the archive the entry was read from
+//is tried first; if the entry was read from the recent page, or its archive can't be found, the
+//prev-archive links are walked back from the recent page.
+func (f *Follower) findStart(ctx context.Context, checkpoint *Checkpoint) (string, error) {
+	if checkpoint != nil && checkpoint.FeedID != "" && checkpoint.FeedID != "recent" {
+		url := f.client.ArchiveURL(checkpoint.FeedID)
+		page, err := f.client.Page(url)
+		if err == nil && page.contains(checkpoint.EntryID) {
+			return url, nil
+		}
+
+		if statusErr, ok := err.(*StatusError); err != nil && !(ok && statusErr.StatusCode == http.StatusNotFound) {
+			return "", err
+		}
+
+		log.Warnf("Checkpointed entry %s not found in feed %s, searching the feed", checkpoint.EntryID, checkpoint.FeedID)
+	}
+
+	return f.walkToStart(ctx, checkpoint)
+}
+
+//walkToStart walks back from the recent page via the prev-archive links to the page holding
+//the checkpointed entry, or to the oldest page if there is no checkpoint.
+func (f *Follower) walkToStart(ctx context.Context, checkpoint *Checkpoint) (string, error) {
+	url := f.client.RecentURL()
+	for {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		page, err := f.client.Page(url)
+		if err != nil {
+			return "", err
+		}
+
+		if checkpoint != nil && page.contains(checkpoint.EntryID) {
+			return url, nil
+		}
+
+		prev := page.Link(PrevArchiveRel)
+		if prev == "" {
+			if checkpoint != nil {
+				return "", ErrCheckpointNotFound
+			}
+
+			return url, nil
+		}
+
+		url = prev
+	}
+}
+
+func (p *Page) contains(entryID string) bool {
+	for _, e := range p.Events {
+		if e.ID == entryID {
+			return true
+		}
+	}
+
+	return false
+}
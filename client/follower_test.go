@@ -0,0 +1,291 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	atompub "github.com/xtracdev/es-atom-pub-pg"
+)
+
+type mutablePages struct {
+	sync.Mutex
+	pages map[string]testPage
+}
+
+func (m *mutablePages) get() map[string]testPage {
+	m.Lock()
+	defer m.Unlock()
+	return m.pages
+}
+
+func (m *mutablePages) set(pages map[string]testPage) {
+	m.Lock()
+	defer m.Unlock()
+	m.pages = pages
+}
+
+func newFollowerFixture(t *testing.T) (*mutablePages, *Client, *FileCheckpointStore, func()) {
+	pages := &mutablePages{pages: testPages}
+	ts := newTestServerForPages(atompub.NewAtomEncrypterWithKeyProvider(nil), pages.get)
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileCheckpointStore(filepath.Join(dir, "checkpoint.json"))
+
+	return pages, NewClient(ts.URL, nil), store, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func collect(seen *[]string) EventHandler {
+	return func(event *Event) error {
+		*seen = append(*seen, event.AggregateID)
+		return nil
+	}
+}
+
+func TestFollowerCatchUpAndResume(t *testing.T) {
+	pages, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	var seen []string
+	processed, err := NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, processed)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e:x"}, seen)
+
+	checkpoint, err := store.Load()
+	if assert.Nil(t, err) && assert.NotNil(t, checkpoint) {
+		assert.Equal(t, Checkpoint{FeedID: "recent", EntryID: "urn:esid:e:x:1"}, *checkpoint)
+	}
+
+	//A new follower using the same store picks up where the last one left off, including
+	//after the recent page has been archived.
+	pages.set(map[string]testPage{
+		"f1":     {"", "f2", []string{"a", "b"}},
+		"f2":     {"f1", "f3", []string{"c", "d"}},
+		"f3":     {"f2", "recent", []string{"e:x", "f"}},
+		"recent": {"f3", "", []string{"g"}},
+	})
+
+	seen = nil
+	processed, err = NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Equal(t, []string{"f", "g"}, seen)
+
+	//Nothing new
+	seen = nil
+	processed, err = NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, processed)
+}
+
+func TestFollowerHandlerError(t *testing.T) {
+	_, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	var seen []string
+	handler := func(event *Event) error {
+		if event.AggregateID == "c" {
+			return errors.New("kaboom")
+		}
+		seen = append(seen, event.AggregateID)
+		return nil
+	}
+
+	err := NewFollower(c, store, handler).Run(context.Background())
+	if assert.NotNil(t, err) {
+		handlerErr, ok := err.(*HandlerError)
+		if assert.True(t, ok) {
+			assert.Equal(t, "c", handlerErr.Event.AggregateID)
+		}
+	}
+
+	assert.Equal(t, []string{"a", "b"}, seen)
+
+	//The failed event is retried on the next run
+	seen = nil
+	_, err = NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "d", "e:x"}, seen)
+}
+
+func TestFollowerRunPollsRecent(t *testing.T) {
+	pages, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var seen []string
+	handler := func(event *Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, event.AggregateID)
+		if event.AggregateID == "f" {
+			cancel()
+		}
+		return nil
+	}
+
+	follower := NewFollower(c, store, handler)
+	follower.MinPollInterval = time.Millisecond
+	follower.MaxPollInterval = 5 * time.Millisecond
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pages.set(map[string]testPage{
+			"f1":     {"", "f2", []string{"a", "b"}},
+			"f2":     {"f1", "recent", []string{"c", "d"}},
+			"recent": {"f2", "", []string{"e:x", "f"}},
+		})
+	}()
+
+	err := follower.Run(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a", "b", "c", "d", "e:x", "f"}, seen)
+}
+
+func TestFollowerStartsFromCheckpointedArchive(t *testing.T) {
+	pages, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	pages.set(map[string]testPage{
+		"f1":     {"", "f2", []string{"a"}},
+		"f2":     {"f1", "f3", []string{"b", "c"}},
+		"f3":     {"f2", "f4", []string{"d"}},
+		"f4":     {"f3", "recent", []string{"e"}},
+		"recent": {"f4", "", []string{"f"}},
+	})
+
+	//Record the pages fetched
+	var mu sync.Mutex
+	var fetched []string
+	c.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		fetched = append(fetched, strings.TrimPrefix(req.URL.Path, "/notifications/"))
+		mu.Unlock()
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	//The archive the checkpointed entry was read from is fetched directly
+	assert.Nil(t, store.Save(Checkpoint{FeedID: "f2", EntryID: "urn:esid:b:1"}))
+
+	var seen []string
+	processed, err := NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, processed)
+	assert.Equal(t, []string{"c", "d", "e", "f"}, seen)
+	assert.Equal(t, []string{"f2", "f2", "f3", "f4", "recent"}, fetched)
+
+	//Without a feed id, or if the archive is gone, the feed is searched from recent
+	for _, feedID := range []string{"", "gone"} {
+		assert.Nil(t, store.Save(Checkpoint{FeedID: feedID, EntryID: "urn:esid:e:1"}))
+
+		fetched, seen = nil, nil
+		processed, err = NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+		assert.Nil(t, err, feedID)
+		assert.Equal(t, 1, processed)
+		assert.Equal(t, []string{"f"}, seen)
+
+		expected := []string{"recent", "f4", "f4", "recent"}
+		if feedID != "" {
+			expected = append([]string{feedID}, expected...)
+		}
+		assert.Equal(t, expected, fetched, feedID)
+	}
+}
+
+func TestFollowerPageArchivedBetweenFetches(t *testing.T) {
+	pages, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	//The recent page is archived, and a new event added, after the follower has read the
+	//newest archive but before it follows its next-archive link to recent
+	f2Fetches := 0
+	c.HTTPClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if strings.HasSuffix(req.URL.Path, "/f2") {
+			f2Fetches++
+			if f2Fetches == 2 {
+				pages.set(map[string]testPage{
+					"f1":     {"", "f2", []string{"a", "b"}},
+					"f2":     {"f1", "f3", []string{"c", "d"}},
+					"f3":     {"f2", "recent", []string{"e:x", "y"}},
+					"recent": {"f3", "", []string{"z"}},
+				})
+			}
+		}
+		return resp, err
+	})}
+
+	var seen []string
+	processed, err := NewFollower(c, store, collect(&seen)).CatchUp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, f2Fetches)
+	assert.Equal(t, 7, processed)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e:x", "y", "z"}, seen)
+
+	checkpoint, err := store.Load()
+	if assert.Nil(t, err) && assert.NotNil(t, checkpoint) {
+		assert.Equal(t, Checkpoint{FeedID: "recent", EntryID: "urn:esid:z:1"}, *checkpoint)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFollowerCheckpointNotFound(t *testing.T) {
+	_, c, store, cleanup := newFollowerFixture(t)
+	defer cleanup()
+
+	assert.Nil(t, store.Save(Checkpoint{FeedID: "gone", EntryID: "urn:esid:zzz:1"}))
+
+	_, err := NewFollower(c, store, collect(new([]string))).CatchUp(context.Background())
+	assert.Equal(t, ErrCheckpointNotFound, err)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileCheckpointStore(filepath.Join(dir, "checkpoint.json"))
+	checkpoint, err := store.Load()
+	assert.Nil(t, err)
+	assert.Nil(t, checkpoint)
+
+	assert.Nil(t, store.Save(Checkpoint{FeedID: "f1", EntryID: "urn:esid:a:1"}))
+	assert.Nil(t, store.Save(Checkpoint{FeedID: "f2", EntryID: "urn:esid:c:1"}))
+
+	checkpoint, err = store.Load()
+	if assert.Nil(t, err) && assert.NotNil(t, checkpoint) {
+		assert.Equal(t, Checkpoint{FeedID: "f2", EntryID: "urn:esid:c:1"}, *checkpoint)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+}
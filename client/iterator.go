@@ -0,0 +1,144 @@
+package client
+
+import "errors"
+
+var ErrBrokenArchiveChain = errors.New("Page does not follow the previous page in the archive chain")
+
+//Iterator walks the events in the feed in the order they were published, starting from a given
+//page and following next-archive links through to the recent page. Typical use is
+//
+//	it, err := c.Events()
+//	...
+//	for it.Next() {
+//	    event := it.Event()
+//	    ...
+//	}
+//	if it.Err() != nil {
+//	    ...
+//	}
+type Iterator struct {
+	client  *Client
+	nextURL string
+	page    *Page
+	pos     int
+	event   *Event
+	err     error
+}
+
+//Iterator returns an iterator starting with the first event on the page at startURL
+func (c *Client) Iterator(startURL string) *Iterator {
+	return &Iterator{
+		client:  c,
+		nextURL: startURL,
+	}
+}
+
+//Events returns an iterator over all the events in the feed, starting with the oldest archive
+func (c *Client) Events() (*Iterator, error) {
+	first, err := c.FirstPageURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Iterator(first), nil
+}
+
+//FirstPageURL walks the prev-archive links back from the recent page, returning the URL of
+//the oldest page in the feed.
+func (c *Client) FirstPageURL() (string, error) {
+	url := c.RecentURL()
+	for {
+		page, err := c.Page(url)
+		if err != nil {
+			return "", err
+		}
+
+		prev := page.Link(PrevArchiveRel)
+		if prev == "" {
+			return url, nil
+		}
+
+		url = prev
+	}
+}
+
+//Next advances to the next event, retrieving the next page if needed. It returns false when
+//there are no more events or an error occurs.
+func (it *Iterator) Next() bool {
+	for {
+		if it.page != nil && it.pos < len(it.page.Events) {
+			it.event = &it.page.Events[it.pos]
+			it.pos++
+			return true
+		}
+
+		it.event = nil
+		if it.err != nil || it.nextURL == "" {
+			return false
+		}
+
+		page, err := it.client.Page(it.nextURL)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		//The page must follow the one before it. If archives were created after the previous
+		//page was read, or it was served stale from a cache, its next-archive link skips them,
+		//so the missed archives are read first.
+		if it.page != nil && it.page.Link(SelfRel) != "" {
+			missed, err := it.missedArchive(it.page.Link(SelfRel), page)
+			if err != nil {
+				it.err = err
+				return false
+			}
+
+			if missed != "" {
+				it.nextURL = missed
+				continue
+			}
+		}
+
+		it.page = page
+		it.pos = 0
+		it.nextURL = page.Link(NextArchiveRel)
+	}
+}
+
+//Event returns the current event
+func (it *Iterator) Event() *Event {
+	return it.event
+}
+
+//Page returns the page the current event was read from
+func (it *Iterator) Page() *Page {
+	return it.page
+}
+
+//Err returns the error, if any, that stopped the iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+//missedArchive walks the prev-archive links back from the page to the page with the given self
+//link, returning the URL of the oldest archive in between, or the empty string if the page
+//directly follows it.
+func (it *Iterator) missedArchive(previousSelf string, page *Page) (string, error) {
+	missed := ""
+	for page.Link(PrevArchiveRel) != previousSelf {
+		prev := page.Link(PrevArchiveRel)
+		if prev == "" {
+			return "", ErrBrokenArchiveChain
+		}
+
+		var err error
+		page, err = it.client.Page(prev)
+		if err != nil {
+			return "", err
+		}
+
+		missed = prev
+	}
+
+	return missed, nil
+}
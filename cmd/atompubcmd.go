@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"expvar"
 	_ "expvar"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
@@ -24,6 +29,9 @@ var insecureConfigBanner = `
 |__| |__| \__| |_______/    |_______| \______| \______/  | _| '._____||_______|
  `
 
+//Requests are logged as JSON objects on standard output unless ACCESS_LOG is set to off
+const AccessLog = "ACCESS_LOG"
+
 type atomFeedPubConfig struct {
 	linkhost              string
 	listenerHostAndPort   string
@@ -77,8 +85,10 @@ func newAtomFeedPubConfig(env *envinject.InjectedEnv) *atomFeedPubConfig {
 	config.hcListenerHostAndPort = ":4567"
 
 	keyAlias := env.Getenv(atompub.KeyAlias)
-	if keyAlias == "" {
-		log.Println("Missing KEY_ALIAS environment variable value - required for secure config")
+	keyProvider := env.Getenv(atompub.KeyProviderType)
+	localKey := env.Getenv(atompub.KeyFile) + env.Getenv(atompub.LocalKey)
+	if keyAlias == "" && keyProvider == "" && localKey == "" {
+		log.Println("Missing KEY_ALIAS or KEY_PROVIDER environment variable value - required for secure config")
 		log.Println(insecureConfigBanner)
 	}
 
@@ -96,17 +106,27 @@ func CheckDBConfig(db *sql.DB) error {
 	return db.QueryRow("select 1").Scan(&one)
 }
 
-func makeHealthCheck(db *sql.DB, ae *atompub.AtomEncrypter) func(w http.ResponseWriter, r *http.Request) {
+//makeHealthCheck creates the health check handler. The db is nil when serving the demo from an
+//in-memory store. The check fails once the server starts shutting down, so load balancers stop
+//sending it requests.
+func makeHealthCheck(db *sql.DB, ae *atompub.AtomEncrypter, draining func() bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
 		wroteHeader := false
-		err := CheckDBConfig(db)
-		if err != nil {
-			wroteHeader = true
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Warnf("DB error on health check: %s", err.Error())
+		if db != nil {
+			err := CheckDBConfig(db)
+			if err != nil {
+				wroteHeader = true
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Warnf("DB error on health check: %s", err.Error())
+			}
 		}
 
-		err = ae.CheckKMSConfig()
+		err := ae.CheckKMSConfig()
 		if err != nil {
 			wroteHeader = true
 			w.WriteHeader(http.StatusInternalServerError)
@@ -121,6 +141,11 @@ func makeHealthCheck(db *sql.DB, ae *atompub.AtomEncrypter) func(w http.Response
 
 func main() {
 
+	demo := parseDemoFlags()
+	if demo.enabled {
+		setDemoEnvDefaults()
+	}
+
 	env, err := envinject.NewInjectedEnv()
 	if err != nil {
 		log.Fatalf("Failed environment init: %s", err.Error())
@@ -136,53 +161,184 @@ func main() {
 		log.Fatalf("Failed environment init: %s", err.Error())
 	}
 
-	log.Info("Connect to DB")
-	postgressConnection, err := pgconn.OpenAndConnect(env, 100)
-	if err != nil {
+	//Render the payloads of the typecodes given in PAYLOAD_FORMATS as JSON or XML
+	if err := atompub.RegisterPayloadRenderers(env); err != nil {
 		log.Fatalf("Failed environment init: %s", err.Error())
 	}
 
+	//Metrics are served in Prometheus format by the health check listener
+	metrics := newPromMetrics()
+	atomEncrypter.SetMetricsRecorder(metrics)
+
+	//The feed and health check listeners are run and shut down together, after which the
+	//resources used by the handlers are released
+	servers, err := newServerGroup(env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	//Trace requests if an exporter is configured. Spans still buffered are exported once the
+	//servers have shut down.
+	tracerProvider, err := newTracerProvider(env)
+	if err != nil {
+		log.Fatalf("Failed tracing init: %s", err.Error())
+	}
+
+	if tracerProvider != nil {
+		servers.onShutdown(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				log.Warnf("Error flushing traces: %s", err.Error())
+			}
+		})
+	}
+
+	//Create the feed store, and a notifier to signal changes to it
+	var db *sql.DB
+	var feedStore atompub.FeedStore
+	var notifier atompub.Notifier
+
+	if demo.enabled {
+		log.Info("Serving demo feed from memory")
+		memoryStore, err := newDemoStore(demo)
+		if err != nil {
+			log.Fatalf("Failed demo init: %s", err.Error())
+		}
+
+		feedStore = memoryStore
+		notifier = memoryStore
+	} else {
+		log.Info("Connect to DB")
+		postgressConnection, err := pgconn.OpenAndConnect(env, 100)
+		if err != nil {
+			log.Fatalf("Failed environment init: %s", err.Error())
+		}
+
+		db = postgressConnection.DB
+		servers.onShutdown(func() {
+			log.Info("Closing DB connections")
+			db.Close()
+		})
+
+		feedStore, err = atompub.NewPGFeedStore(db)
+		if err != nil {
+			log.Fatalf("Failed environment init: %s", err.Error())
+		}
+
+		pgNotifier, err := atompub.NewPGNotifier(db, env)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		ctx, stopNotifier := context.WithCancel(context.Background())
+		servers.onShutdown(stopNotifier)
+		go pgNotifier.Run(ctx)
+		notifier = pgNotifier
+	}
+
+	feedStore, err = atompub.NewInstrumentedFeedStore(feedStore, metrics)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	//Create handlers
 	log.Info("Create and register handlers")
-	recentHandler, err := atompub.NewRecentHandler(postgressConnection.DB, feedConfig.linkhost, env, atomEncrypter)
+	recentHandler, err := atompub.NewRecentHandler(feedStore, feedConfig.linkhost, env, atomEncrypter)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	archiveHandler, err := atompub.NewArchiveHandler(feedStore, feedConfig.linkhost, env, atomEncrypter)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	streamHandler, err := atompub.NewStreamHandler(feedStore, feedConfig.linkhost, env, atomEncrypter, notifier)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	archiveHandler, err := atompub.NewArchiveHandler(postgressConnection.DB, feedConfig.linkhost, env, atomEncrypter)
+	retrieveHandler, err := atompub.NewEventRetrieveHandler(feedStore, env, atomEncrypter)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	retrieveHandler, err := atompub.NewEventRetrieveHandler(postgressConnection.DB, atomEncrypter)
+	aggregateHandler, err := atompub.NewAggregateRetrieveHandler(feedStore, feedConfig.linkhost, env, atomEncrypter)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	//Record metrics for each route, and trace its requests if tracing is enabled
+	instrument := func(route string, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		h = atompub.InstrumentHandler(route, metrics, h)
+		if tracerProvider != nil {
+			h = atompub.TraceHandler(route, h)
+		}
+		return h
+	}
+
 	r := mux.NewRouter()
-	r.HandleFunc(atompub.RecentHandlerURI, recentHandler)
-	r.HandleFunc(atompub.ArchiveHandlerURI, archiveHandler)
-	r.HandleFunc(atompub.RetrieveEventHanderURI, retrieveHandler)
-	r.HandleFunc(atompub.PingURI, atompub.PingHandler)
+	r.HandleFunc(atompub.RecentHandlerURI, instrument("recent", recentHandler))
+	r.HandleFunc(atompub.StreamHandlerURI, servers.cancelOnShutdown(streamHandler))
+	r.HandleFunc(atompub.ArchiveHandlerURI, instrument("archive", archiveHandler))
+	r.HandleFunc(atompub.RetrieveEventHanderURI, instrument("event", retrieveHandler))
+	r.HandleFunc(atompub.RetrieveAggregateHandlerURI, instrument("aggregate", aggregateHandler))
+	r.HandleFunc(atompub.PingURI, instrument("ping", atompub.PingHandler))
+
+	//Authenticate consumers if configured, serving them only the events they may see
+	var handler http.Handler = r
+	authenticator, err := atompub.NewAuthenticator(env)
+	if err != nil {
+		log.Fatalf("Failed auth init: %s", err.Error())
+	}
+
+	if authenticator != nil {
+		log.Info("Authenticating feed consumers")
+		handler = authenticator.Middleware(r)
+	}
 
-	var server *http.Server
+	//Log requests, including those refused by the authenticator, with their request ids and, for
+	//traced requests, trace ids
+	if env.Getenv(AccessLog) != "off" {
+		handler = atompub.NewAccessLogger(os.Stdout, r).Middleware(handler)
+	}
 
-	go func() {
-		hcMux := http.NewServeMux()
-		healthCheck := makeHealthCheck(postgressConnection.DB, atomEncrypter)
-		hcMux.HandleFunc("/health", healthCheck)
-		hcMux.HandleFunc("/debug/vars", expvarHandler)
-		log.Infof("Health check and expvars listening on %s", feedConfig.hcListenerHostAndPort)
-		http.ListenAndServe(feedConfig.hcListenerHostAndPort, hcMux)
-	}()
+	//Serve TLS directly if configured, otherwise plain HTTP is served and TLS is expected to be
+	//terminated by a proxy
+	tlsConfig, certReloader, err := atompub.NewTLSConfig(env)
+	if err != nil {
+		log.Fatalf("Failed TLS init: %s", err.Error())
+	}
 
-	//Config server
-	server = &http.Server{
-		Handler: r,
-		Addr:    feedConfig.listenerHostAndPort,
+	if certReloader != nil {
+		ctx, stopReloader := context.WithCancel(context.Background())
+		servers.onShutdown(stopReloader)
+		go certReloader.Run(ctx)
 	}
 
+	//Config servers
+	servers.add(&http.Server{
+		Handler:   handler,
+		Addr:      feedConfig.listenerHostAndPort,
+		TLSConfig: tlsConfig,
+	})
+
+	hcMux := http.NewServeMux()
+	healthCheck := makeHealthCheck(db, atomEncrypter, servers.isDraining)
+	hcMux.HandleFunc("/health", healthCheck)
+	hcMux.HandleFunc("/debug/vars", expvarHandler)
+	hcMux.Handle("/metrics", metrics.handler())
+	servers.add(&http.Server{
+		Handler: hcMux,
+		Addr:    feedConfig.hcListenerHostAndPort,
+	})
+
 	//Listen up...
 	log.Info("Start server")
-	log.Fatal(server.ListenAndServe())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	if err := servers.run(signals); err != nil {
+		log.Fatal(err.Error())
+	}
 }
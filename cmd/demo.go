@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	atompub "github.com/xtracdev/es-atom-pub-pg"
+)
+
+//demoConfig holds the command line options for serving the feed from an in-memory store
+//instead of Postgres, for local development and demos.
+type demoConfig struct {
+	enabled    bool
+	fixture    string
+	generate   int
+	aggregates int
+	feedSize   int
+	interval   time.Duration
+}
+
+func parseDemoFlags() *demoConfig {
+	config := new(demoConfig)
+	flag.BoolVar(&config.enabled, "demo", false, "Serve the feed from an in-memory store instead of Postgres")
+	flag.StringVar(&config.fixture, "fixture", "", "Seed the in-memory store from a JSON or NDJSON file of events")
+	flag.IntVar(&config.generate, "generate", 0, "Seed the in-memory store with this many generated events")
+	flag.IntVar(&config.aggregates, "aggregates", 10, "Number of aggregates to spread generated events across")
+	flag.IntVar(&config.feedSize, "feed-size", 10, "Number of events per archived feed")
+	flag.DurationVar(&config.interval, "interval", 0, "Keep generating events at this interval, e.g. 2s")
+	flag.Parse()
+
+	return config
+}
+
+//setDemoEnvDefaults fills in the listener and link settings for serving the demo locally, so no
+//configuration is needed beyond the command line.
+func setDemoEnvDefaults() {
+	defaults := map[string]string{
+		"LISTENADDR":      ":8000",
+		"LINKHOST":        "localhost:8000",
+		atompub.LinkProto: "http",
+	}
+
+	for k, v := range defaults {
+		if os.Getenv(k) == "" {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+//newDemoStore creates an in-memory store seeded from the fixture file and/or the event
+//generator, as given by the demo options.
+func newDemoStore(config *demoConfig) (*atompub.MemoryFeedStore, error) {
+	store := atompub.NewMemoryFeedStore()
+	store.SetFeedThreshold(config.feedSize)
+
+	if config.fixture != "" {
+		f, err := os.Open(config.fixture)
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := atompub.LoadFixture(store, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Loaded %d events from %s", count, config.fixture)
+	}
+
+	generator := atompub.NewEventGenerator(config.aggregates)
+	for i := 0; i < config.generate; i++ {
+		if err := store.Add(generator.Next()); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.generate > 0 {
+		log.Infof("Generated %d events", config.generate)
+	}
+
+	if config.interval > 0 {
+		log.Infof("Generating an event every %s", config.interval)
+		go func() {
+			for range time.Tick(config.interval) {
+				if err := store.Add(generator.Next()); err != nil {
+					log.Warnf("Error adding generated event: %s", err.Error())
+				}
+			}
+		}()
+	}
+
+	return store, nil
+}
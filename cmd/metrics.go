@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//promMetrics records the feed metrics in Prometheus format. They are served with the Go runtime
+//and process metrics from /metrics on the health check listener.
+type promMetrics struct {
+	registry           *prometheus.Registry
+	requests           *prometheus.CounterVec
+	requestDuration    *prometheus.HistogramVec
+	responseSize       *prometheus.HistogramVec
+	entries            *prometheus.HistogramVec
+	queryDuration      *prometheus.HistogramVec
+	queryErrors        *prometheus.CounterVec
+	encryptionDuration prometheus.Histogram
+	encryptionErrors   prometheus.Counter
+	keyProviderErrors  *prometheus.CounterVec
+}
+
+func newPromMetrics() *promMetrics {
+	m := &promMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atompub_http_requests_total",
+			Help: "Requests served, by route and status code.",
+		}, []string{"route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "atompub_http_request_duration_seconds",
+			Help:    "Request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "atompub_http_response_size_bytes",
+			Help:    "Response body size by route.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"route"}),
+		entries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "atompub_entries_per_page",
+			Help:    "Entries served per page by route.",
+			Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"route"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "atompub_db_query_duration_seconds",
+			Help:    "Feed store query latency by call.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"call"}),
+		queryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atompub_db_query_errors_total",
+			Help: "Failed feed store queries by call.",
+		}, []string{"call"}),
+		encryptionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "atompub_encryption_duration_seconds",
+			Help:    "Latency of encrypting responses, including obtaining data keys.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		encryptionErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "atompub_encryption_errors_total",
+			Help: "Responses that could not be encrypted.",
+		}),
+		keyProviderErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atompub_key_provider_errors_total",
+			Help: "Failures obtaining data keys, by key provider type.",
+		}, []string{"provider"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.responseSize,
+		m.entries,
+		m.queryDuration,
+		m.queryErrors,
+		m.encryptionDuration,
+		m.encryptionErrors,
+		m.keyProviderErrors,
+	)
+
+	return m
+}
+
+func (m *promMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *promMetrics) ObserveRequest(route string, status int, duration time.Duration, size int) {
+	m.requests.WithLabelValues(route, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(route).Observe(duration.Seconds())
+	m.responseSize.WithLabelValues(route).Observe(float64(size))
+}
+
+func (m *promMetrics) ObserveEntries(route string, entries int) {
+	m.entries.WithLabelValues(route).Observe(float64(entries))
+}
+
+func (m *promMetrics) ObserveQuery(call string, duration time.Duration, err error) {
+	m.queryDuration.WithLabelValues(call).Observe(duration.Seconds())
+	if err != nil {
+		m.queryErrors.WithLabelValues(call).Inc()
+	}
+}
+
+func (m *promMetrics) ObserveEncryption(duration time.Duration, err error) {
+	m.encryptionDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.encryptionErrors.Inc()
+	}
+}
+
+func (m *promMetrics) ObserveKeyProviderError(provider string, err error) {
+	m.keyProviderErrors.WithLabelValues(provider).Inc()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+)
+
+//On SIGTERM or SIGINT the health check fails for SHUTDOWN_DRAIN_DELAY so load balancers stop
+//sending requests, then in-flight requests are given up to SHUTDOWN_TIMEOUT to complete.
+const (
+	ShutdownTimeout           = "SHUTDOWN_TIMEOUT"
+	ShutdownDrainDelay        = "SHUTDOWN_DRAIN_DELAY"
+	DefaultShutdownTimeout    = 30 * time.Second
+	DefaultShutdownDrainDelay = 5 * time.Second
+)
+
+//serverGroup runs the feed and health check listeners together, shutting both down when
+//signalled or when either of them fails.
+type serverGroup struct {
+	servers    []*http.Server
+	drainDelay time.Duration
+	timeout    time.Duration
+	draining   int32
+	stopping   chan struct{}
+	closers    []func()
+}
+
+func newServerGroup(env *envinject.InjectedEnv) (*serverGroup, error) {
+	group := &serverGroup{
+		drainDelay: DefaultShutdownDrainDelay,
+		timeout:    DefaultShutdownTimeout,
+		stopping:   make(chan struct{}),
+	}
+
+	var err error
+	if val := env.Getenv(ShutdownDrainDelay); val != "" {
+		group.drainDelay, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", ShutdownDrainDelay, err.Error())
+		}
+	}
+
+	if val := env.Getenv(ShutdownTimeout); val != "" {
+		group.timeout, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", ShutdownTimeout, err.Error())
+		}
+	}
+
+	return group, nil
+}
+
+//add adds a server to the group. Servers are shut down in the order they are added, so the
+//health check server should be added last to keep reporting while the others drain.
+func (g *serverGroup) add(server *http.Server) {
+	g.servers = append(g.servers, server)
+}
+
+//onShutdown registers a function to release a resource once the servers have shut down.
+//Functions are called in the reverse order they were registered.
+func (g *serverGroup) onShutdown(f func()) {
+	g.closers = append(g.closers, f)
+}
+
+//isDraining reports whether shutdown has started, in which case the health check fails
+func (g *serverGroup) isDraining() bool {
+	return atomic.LoadInt32(&g.draining) == 1
+}
+
+//cancelOnShutdown cancels the request context when shutdown starts. Long running requests,
+//such as event streams, never become idle so would otherwise hold up shutdown until the
+//timeout expires.
+func (g *serverGroup) cancelOnShutdown(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-g.stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		h(rw, req.WithContext(ctx))
+	}
+}
+
+//run starts the servers and blocks until a signal is received or a server fails, then shuts
+//the servers down. The error from a failed server is returned.
+func (g *serverGroup) run(signals <-chan os.Signal) error {
+	errs := make(chan error, len(g.servers))
+	for _, server := range g.servers {
+		go func(server *http.Server) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Infof("Listening on %s with TLS", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Infof("Listening on %s", server.Addr)
+				err = server.ListenAndServe()
+			}
+
+			if err != http.ErrServerClosed {
+				errs <- fmt.Errorf("Listener on %s failed: %s", server.Addr, err.Error())
+			}
+		}(server)
+	}
+
+	var runErr error
+	select {
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+		g.drain()
+	case runErr = <-errs:
+		log.Warn(runErr.Error())
+	}
+
+	g.shutdown()
+	return runErr
+}
+
+//drain fails the health check and waits for load balancers to notice
+func (g *serverGroup) drain() {
+	atomic.StoreInt32(&g.draining, 1)
+	if g.drainDelay > 0 {
+		log.Infof("Failing health check for %s to drain connections", g.drainDelay)
+		time.Sleep(g.drainDelay)
+	}
+}
+
+func (g *serverGroup) shutdown() {
+	atomic.StoreInt32(&g.draining, 1)
+	close(g.stopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	for _, server := range g.servers {
+		log.Infof("Shutting down listener on %s", server.Addr)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Error shutting down listener on %s: %s", server.Addr, err.Error())
+		}
+	}
+
+	for i := len(g.closers) - 1; i >= 0; i-- {
+		g.closers[i]()
+	}
+
+	log.Info("Shutdown complete")
+}
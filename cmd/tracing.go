@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+//Traces are exported as selected by OTEL_TRACES_EXPORTER: otlp sends them to the collector
+//given by the standard OTEL_EXPORTER_OTLP_* variables, stdout writes them to standard output
+//for local runs, and none (the default) disables tracing. The service name defaults to
+//DefaultServiceName unless OTEL_SERVICE_NAME is set.
+const (
+	TracesExporter     = "OTEL_TRACES_EXPORTER"
+	ServiceName        = "OTEL_SERVICE_NAME"
+	DefaultServiceName = "es-atom-pub-pg"
+)
+
+//newTracerProvider creates the tracer provider for the configured exporter, and installs it
+//and the W3C trace context propagator as the globals used by the handlers. It returns nil if
+//tracing is disabled.
+func newTracerProvider(env *envinject.InjectedEnv) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	exporterType := strings.ToLower(env.Getenv(TracesExporter))
+	switch exporterType {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("Unknown %s: %s", TracesExporter, exporterType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := env.Getenv(ServiceName)
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Exporting traces for %s via %s", serviceName, exporterType)
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp, nil
+}
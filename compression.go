@@ -0,0 +1,196 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+//Content codings used to compress feed and event responses. When output is encrypted the
+//plaintext is compressed before encryption and the coding is given in the envelope header, as
+//ciphertext doesn't compress; otherwise the response has a Content-Encoding header.
+const (
+	GzipEncoding     = "gzip"
+	BrotliEncoding   = "br"
+	IdentityEncoding = "identity"
+)
+
+//DefaultMaxDecompressedSize is the most Decompress will decompress a response or envelope to
+const DefaultMaxDecompressedSize = 64 << 20
+
+var ErrUnsupportedEncoding = errors.New("Unsupported content encoding")
+var ErrDecompressedSizeExceeded = errors.New("Decompressed content exceeds the size limit")
+
+//compressionEncodings are the codings offered, in order of preference
+var compressionEncodings = []string{BrotliEncoding, GzipEncoding}
+
+//negotiateEncoding returns the preferred content coding the request's Accept-Encoding header
+//accepts, or identity if it accepts none of them.
+func negotiateEncoding(req *http.Request) string {
+	header := req.Header.Get("Accept-Encoding")
+	if header == "" {
+		return IdentityEncoding
+	}
+
+	best := IdentityEncoding
+	bestQ := 0.0
+	for _, encoding := range compressionEncodings {
+		if q := encodingQuality(header, encoding); q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+//encodingQuality returns the quality value the Accept-Encoding header gives the coding, either
+//explicitly or via *.
+func encodingQuality(header string, encoding string) float64 {
+	q := 0.0
+	found := false
+
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != encoding && (name != "*" || found) {
+			continue
+		}
+
+		codingQ := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					codingQ = v
+				}
+			}
+		}
+
+		q = codingQ
+		if name == encoding {
+			found = true
+		}
+	}
+
+	return q
+}
+
+//compress compresses the data with the given coding
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch encoding {
+	case IdentityEncoding, "":
+		return data, nil
+	case GzipEncoding:
+		w = gzip.NewWriter(&buf)
+	case BrotliEncoding:
+		w = brotli.NewWriter(&buf)
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//Decompress reverses compression with the given content coding, for consumers reading
+//responses or envelopes compressed by the feed. The decompressed content is limited to
+//DefaultMaxDecompressedSize bytes.
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	return DecompressLimit(encoding, data, DefaultMaxDecompressedSize)
+}
+
+//DecompressLimit reverses compression with the given content coding, returning
+//ErrDecompressedSizeExceeded rather than decompressing more than limit bytes, so a small
+//hostile or broken response can't exhaust memory. A limit of 0 or less is the default limit.
+func DecompressLimit(encoding string, data []byte, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case IdentityEncoding, "":
+		return data, nil
+	case GzipEncoding:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case BrotliEncoding:
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	return readLimit(r, limit)
+}
+
+//readLimit reads all of r, returning ErrDecompressedSizeExceeded if there's more than limit bytes
+func readLimit(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, ErrDecompressedSizeExceeded
+	}
+
+	return data, nil
+}
+
+//encodingTagID qualifies an entity tag id with the content coding, as each coding of a
+//resource is a distinct representation.
+func encodingTagID(id string, encoding string) string {
+	if encoding == IdentityEncoding {
+		return id
+	}
+
+	return id + "-" + encoding
+}
+
+//setContentEncoding sets the Content-Encoding header for a response body compressed with
+//the given coding.
+func setContentEncoding(rw http.ResponseWriter, encoding string) {
+	if encoding != IdentityEncoding && encoding != "" {
+		rw.Header().Set("Content-Encoding", encoding)
+	}
+}
+
+//flushWriter is a compressing writer that can flush what's been written so far, for streaming
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+//newStreamCompressor returns a writer that compresses a stream written to w with the coding
+func newStreamCompressor(encoding string, w io.Writer) flushWriter {
+	switch encoding {
+	case GzipEncoding:
+		return gzip.NewWriter(w)
+	case BrotliEncoding:
+		return brotli.NewWriter(w)
+	default:
+		return nil
+	}
+}
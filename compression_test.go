@@ -0,0 +1,222 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	var negotiateTests = []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", IdentityEncoding},
+		{"gzip", GzipEncoding},
+		{"br", BrotliEncoding},
+		{"gzip, deflate, br", BrotliEncoding},
+		{"GZIP", GzipEncoding},
+		{"br;q=0.5, gzip", GzipEncoding},
+		{"br;q=0, gzip;q=0", IdentityEncoding},
+		{"*", BrotliEncoding},
+		{"br;q=0, *", GzipEncoding},
+		{"deflate, compress", IdentityEncoding},
+		{"identity", IdentityEncoding},
+	}
+
+	for _, test := range negotiateTests {
+		r, _ := http.NewRequest("GET", RecentHandlerURI, nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+
+		assert.Equal(t, test.expected, negotiateEncoding(r), test.acceptEncoding)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("<entry>event store content</entry>", 100))
+
+	for _, encoding := range []string{IdentityEncoding, GzipEncoding, BrotliEncoding} {
+		compressed, err := compress(encoding, content)
+		if !assert.Nil(t, err, encoding) {
+			continue
+		}
+
+		if encoding != IdentityEncoding {
+			assert.True(t, len(compressed) < len(content), encoding)
+		}
+
+		decompressed, err := Decompress(encoding, compressed)
+		assert.Nil(t, err, encoding)
+		assert.Equal(t, content, decompressed, encoding)
+	}
+
+	_, err := compress("zstd", content)
+	assert.Equal(t, ErrUnsupportedEncoding, err)
+
+	_, err = Decompress("zstd", content)
+	assert.Equal(t, ErrUnsupportedEncoding, err)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1<<20)
+
+	for _, encoding := range []string{GzipEncoding, BrotliEncoding} {
+		compressed, err := compress(encoding, content)
+		if !assert.Nil(t, err, encoding) {
+			continue
+		}
+
+		//A small body can decompress to far more than the limit
+		assert.True(t, len(compressed) < 1<<12, encoding)
+		_, err = DecompressLimit(encoding, compressed, 1<<16)
+		assert.Equal(t, ErrDecompressedSizeExceeded, err, encoding)
+
+		decompressed, err := DecompressLimit(encoding, compressed, int64(len(content)))
+		assert.Nil(t, err, encoding)
+		assert.Equal(t, len(content), len(decompressed), encoding)
+
+		_, err = DecompressLimit(encoding, compressed, int64(len(content))-1)
+		assert.Equal(t, ErrDecompressedSizeExceeded, err, encoding)
+	}
+}
+
+func TestCompressedArchive(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+	store.CreateFeed("feed1")
+	store.Add(testEvent("agg", 3))
+	store.CreateFeed("feed2")
+
+	env, _ := envinject.NewInjectedEnv()
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	get := func(acceptEncoding string, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/notifications/feed1", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	plain := get("", "")
+	assert.Equal(t, http.StatusOK, plain.Result().StatusCode)
+	assert.Equal(t, "", plain.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept, Accept-Encoding", plain.Header().Get("Vary"))
+
+	//Each coding is a distinct representation, rendered and compressed once then served from
+	//the cache
+	for _, encoding := range []string{GzipEncoding, BrotliEncoding} {
+		hits := archiveCacheHits.Value()
+
+		w := get(encoding, "")
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, `"feed1-`+encoding+`"`, w.Header().Get("ETag"))
+
+		body, err := Decompress(encoding, w.Body.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, plain.Body.String(), string(body))
+
+		cached := get(encoding, "")
+		assert.Equal(t, w.Body.Bytes(), cached.Body.Bytes())
+		assert.Equal(t, hits+1, archiveCacheHits.Value())
+
+		//The ETag only validates the representation it was given for
+		assert.Equal(t, http.StatusNotModified, get(encoding, w.Header().Get("ETag")).Result().StatusCode)
+		assert.Equal(t, http.StatusOK, get("", w.Header().Get("ETag")).Result().StatusCode)
+	}
+}
+
+func TestCompressedEncryptedOutput(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+
+	env, _ := envinject.NewInjectedEnv()
+	recentHandler, err := NewRecentHandler(store, "testhost:12345", env, ae)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", RecentHandlerURI, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		recentHandler(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w
+	}
+
+	plain, err := DecryptOutput(get("").Body.Bytes(), kp)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	//The plaintext is compressed inside the envelope, which says how, so the response itself
+	//has no content coding
+	w := get(GzipEncoding)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+
+	envelope, err := DecodeEnvelope(w.Body.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, CompressedEnvelopeVersion, envelope.Header.Version)
+	assert.Equal(t, GzipEncoding, envelope.Header.Encoding)
+
+	decrypted, err := DecryptOutput(w.Body.Bytes(), kp)
+	assert.Nil(t, err)
+	assert.Equal(t, string(plain), string(decrypted))
+
+	//Uncompressed output is still sealed in a version 1 envelope
+	envelope, _ = DecodeEnvelope(get("").Body.Bytes())
+	assert.Equal(t, EnvelopeVersion, envelope.Header.Version)
+	assert.Equal(t, "", envelope.Header.Encoding)
+}
+
+func TestCompressedStream(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, err := NewStreamHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("GET", StreamHandlerURI, nil)
+	r = r.WithContext(ctx)
+	r.Header.Set("Last-Event-ID", "urn:esid:agg:1")
+	r.Header.Set("Accept-Encoding", GzipEncoding)
+
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+	assert.Equal(t, GzipEncoding, w.Header().Get("Content-Encoding"))
+
+	body, err := Decompress(GzipEncoding, w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(body, []byte("id: urn:esid:agg:2\n")))
+}
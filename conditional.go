@@ -0,0 +1,78 @@
+package esatompubpg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//entityTag returns a quoted entity tag per RFC 7232 for a resource id and the representation
+//being served. Representations other than the default get a distinct tag, as required for
+//strong validators.
+func entityTag(id string, weak bool, contentType string, defaultContentType string) string {
+	id = escapeTagID(id)
+	if contentType != defaultContentType {
+		id = fmt.Sprintf("%s+%s", id, contentType[strings.LastIndex(contentType, "/")+1:])
+	}
+
+	if weak {
+		return fmt.Sprintf(`W/"%s"`, id)
+	}
+
+	return fmt.Sprintf(`"%s"`, id)
+}
+
+//escapeTagID percent-encodes the bytes of an id that aren't visible ASCII characters allowed in
+//an entity tag, such as quotes, control characters and non-ASCII bytes, along with % so distinct
+//ids keep distinct tags.
+func escapeTagID(id string) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c > 0x20 && c < 0x7f && c != '"' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+//ifNoneMatch reports whether the request's If-None-Match header matches the entity tag, using
+//the weak comparison specified for If-None-Match in RFC 7232. A * matches any current
+//representation, so must only be checked once the resource is known to exist.
+func ifNoneMatch(req *http.Request, etag string) bool {
+	if strings.TrimSpace(req.Header.Get("If-None-Match")) == "*" {
+		return true
+	}
+
+	return ifNoneMatchTag(req, etag)
+}
+
+//ifNoneMatchTag reports whether the request's If-None-Match header lists the entity tag,
+//ignoring *. It can be checked before the resource is known to exist.
+func ifNoneMatchTag(req *http.Request, etag string) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	opaque := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == opaque {
+			return true
+		}
+	}
+
+	return false
+}
+
+//writeNotModified sends a 304 response for the entity tag along with the cache headers that
+//would have accompanied a full response.
+func writeNotModified(rw http.ResponseWriter, etag string, cacheControl string) {
+	rw.Header().Add("ETag", etag)
+	rw.Header().Add("Cache-Control", cacheControl)
+	rw.Header().Add("Vary", "Accept, Accept-Encoding")
+	rw.WriteHeader(http.StatusNotModified)
+}
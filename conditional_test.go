@@ -0,0 +1,171 @@
+package esatompubpg
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestIfNoneMatch(t *testing.T) {
+	var matchTests = []struct {
+		header   string
+		etag     string
+		expected bool
+	}{
+		{"", `"foo"`, false},
+		{`"foo"`, `"foo"`, true},
+		{`"bar", "foo"`, `"foo"`, true},
+		{`W/"foo"`, `"foo"`, true},
+		{`"foo"`, `W/"foo"`, true},
+		{`"foo+json"`, `"foo"`, false},
+		{`*`, `"foo"`, true},
+		{`foo`, `"foo"`, false},
+	}
+
+	for _, test := range matchTests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", test.header)
+		assert.Equal(t, test.expected, ifNoneMatch(r, test.etag), test.header)
+	}
+
+	assert.Equal(t, `"foo"`, entityTag("foo", false, AtomContentType, AtomContentType))
+	assert.Equal(t, `"foo+feed+json"`, entityTag("foo", false, JSONFeedContentType, AtomContentType))
+	assert.Equal(t, `W/"f%22oo"`, entityTag(`f"oo`, true, AtomContentType, AtomContentType))
+	assert.Equal(t, `"a%0Ab%25c%C3%A9+json"`, entityTag("a\nb%c\u00e9", false, JSONContentType, XMLContentType))
+	assert.NotEqual(t, entityTag("a%22", false, AtomContentType, AtomContentType),
+		entityTag(`a"`, false, AtomContentType, AtomContentType))
+
+	//* matches any tag, but only ifNoneMatch honours it
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", "*")
+	assert.False(t, ifNoneMatchTag(r, `"foo"`))
+	r.Header.Set("If-None-Match", `"bar", W/"foo"`)
+	assert.True(t, ifNoneMatchTag(r, `"foo"`))
+}
+
+func TestConditionalAnyTag(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(redactionEvent("foo", 1, "yeah ok"))
+	store.CreateFeed("feed1")
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+	archiveHandler, _ := NewArchiveHandler(store, "testhost:12345", env, ae)
+	eventHandler, _ := NewEventRetrieveHandler(store, env, ae)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	//If-None-Match: * matches resources that exist, but not those that don't
+	for _, test := range []struct {
+		uri            string
+		expectedStatus int
+	}{
+		{"/notifications/feed1", http.StatusNotModified},
+		{"/notifications/feed1", http.StatusNotModified},
+		{"/notifications/nosuchfeed", http.StatusNotFound},
+		{"/events/customer-1/1", http.StatusNotModified},
+		{"/events/customer-1/2", http.StatusNotFound},
+	} {
+		r, _ := http.NewRequest("GET", test.uri, nil)
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, test.expectedStatus, w.Result().StatusCode, test.uri)
+	}
+}
+
+func TestConditionalArchiveAndEvent(t *testing.T) {
+	//No queries are expected, the handlers answer from the request alone
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	archiveHandler, err := NewArchiveHandler(pgFeedStore(t, db), "testhost:12345", env, ae)
+	assert.Nil(t, err)
+	eventHandler, err := NewEventRetrieveHandler(pgFeedStore(t, db), env, ae)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	var conditionalTests = []struct {
+		uri    string
+		accept string
+		etag   string
+	}{
+		{"/notifications/foo", "", `"foo"`},
+		{"/notifications/foo", JSONFeedContentType, `"foo+feed+json"`},
+		{"/events/1234567/1", "", `"1234567:1"`},
+		{"/events/1234567/1", JSONContentType, `"1234567:1+json"`},
+	}
+
+	for _, test := range conditionalTests {
+		r, _ := http.NewRequest("GET", test.uri, nil)
+		r.Header.Set("If-None-Match", test.etag)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotModified, w.Result().StatusCode, test.uri)
+		assert.Equal(t, test.etag, w.Header().Get("ETag"))
+		assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+		assert.Equal(t, 0, w.Body.Len())
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestConditionalRecent(t *testing.T) {
+	ts := time.Now()
+
+	for _, test := range []struct {
+		ifNoneMatch    string
+		expectedStatus int
+	}{
+		{`W/"recent:feed-xxx:1x2x333:3"`, http.StatusNotModified},
+		{`W/"recent:feed-xxx:1x2x333:2"`, http.StatusOK},
+	} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		mock.ExpectQuery("select event_time").WillReturnRows(
+			sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+				AddRow([]driver.Value{ts, "1x2x333", 3, "foo", []byte("yeah ok")}...),
+		)
+		mock.ExpectQuery("select feedid").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("feed-xxx"))
+
+		env, _ := envinject.NewInjectedEnv()
+		recentHandler, err := NewRecentHandler(pgFeedStore(t, db), "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil))
+		assert.Nil(t, err)
+
+		r, _ := http.NewRequest("GET", RecentHandlerURI, nil)
+		r.Header.Set("If-None-Match", test.ifNoneMatch)
+		w := httptest.NewRecorder()
+
+		recentHandler(w, r)
+		assert.Equal(t, test.expectedStatus, w.Result().StatusCode)
+		assert.Equal(t, `W/"recent:feed-xxx:1x2x333:3"`, w.Header().Get("ETag"))
+
+		assert.Nil(t, mock.ExpectationsWereMet())
+		db.Close()
+	}
+}
@@ -0,0 +1,230 @@
+package esatompubpg
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//ENCRYPTION_MODE selects how feed pages are encrypted when a key provider is configured. In
+//document mode, the default, the whole page is sealed in an envelope. In entry mode the feed
+//and entry metadata are left in the clear and only the content of each entry is encrypted,
+//with a data key shared by the entries of the page and given in the feed's encryptionKey
+//element.
+const (
+	EncryptionMode         = "ENCRYPTION_MODE"
+	DocumentEncryptionMode = "document"
+	EntryEncryptionMode    = "entry"
+	EncryptionNamespace    = "http://github.com/xtracdev/es-atom-pub-pg/encryption"
+)
+
+var ErrUnknownEncryptionMode = errors.New("Unknown encryption mode, expected document or entry")
+
+//EncryptionKey is the feed extension element giving the data key the entry content of the
+//page was encrypted with, as encrypted by the key provider and base64 encoded. For example
+//
+//	<encryptionKey xmlns="http://github.com/xtracdev/es-atom-pub-pg/encryption" alg="AES-256-GCM" kp="kms" kid="...">...</encryptionKey>
+type EncryptionKey struct {
+	Algorithm    string `xml:"alg,attr" json:"alg"`
+	KeyProvider  string `xml:"kp,attr" json:"kp"`
+	KeyID        string `xml:"kid,attr,omitempty" json:"kid,omitempty"`
+	EncryptedKey string `xml:",chardata" json:"ek"`
+}
+
+//SetEncryptionMode sets whether feed pages are encrypted as a whole or entry by entry
+func (ae *AtomEncrypter) SetEncryptionMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", DocumentEncryptionMode:
+		ae.entryMode = false
+	case EntryEncryptionMode:
+		ae.entryMode = true
+	default:
+		return ErrUnknownEncryptionMode
+	}
+
+	return nil
+}
+
+//encryptsEntries indicates feed pages are encrypted entry by entry rather than as a whole
+func (ae *AtomEncrypter) encryptsEntries() bool {
+	return ae.keyProvider != nil && ae.entryMode
+}
+
+//encodeFeed compresses a rendered feed page, and encrypts it unless its entries are encrypted
+func (ae *AtomEncrypter) encodeFeed(ctx context.Context, out []byte, encoding string) ([]byte, string, error) {
+	if !ae.encryptsEntries() {
+		return ae.encodeOutput(ctx, out, encoding)
+	}
+
+	_, span := startSpan(ctx, "compress", attribute.String("atompub.content_encoding", encoding))
+	compressed, err := compress(encoding, out)
+	endSpan(span, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return compressed, encoding, nil
+}
+
+//sealFeed encrypts a compressed feed page unless its entries are encrypted
+func (ae *AtomEncrypter) sealFeed(ctx context.Context, compressed []byte, encoding string) ([]byte, string, error) {
+	if ae.encryptsEntries() {
+		return compressed, encoding, nil
+	}
+
+	return ae.sealOutput(ctx, compressed, encoding)
+}
+
+//encryptEntries encrypts the content of the feed entries with a single data key, replacing it
+//with base64 encoded application/octet-stream content that gives the media type of the
+//plaintext, and adds the encrypted data key to the feed. Nothing is done unless the encrypter
+//is in entry mode.
+func (ae *AtomEncrypter) encryptEntries(ctx context.Context, feed *Feed) (err error) {
+	if !ae.encryptsEntries() || len(feed.Entry) == 0 {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "AtomEncrypter.EncryptEntries", attribute.Int("atompub.entries", len(feed.Entry)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if ae.metrics != nil {
+		start := time.Now()
+		defer func() {
+			ae.metrics.ObserveEncryption(time.Since(start), err)
+		}()
+	}
+
+	key, dataKey, err := ae.generateDataKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	//Purge the key from memory
+	defer func() {
+		key = [32]byte{}
+	}()
+
+	for _, entry := range feed.Entry {
+		if entry.Content == nil {
+			continue
+		}
+
+		payload, err := entry.Content.Payload()
+		if err != nil {
+			return err
+		}
+
+		ciphertext, err := encrypt(payload, &key)
+		if err != nil {
+			return err
+		}
+
+		entry.Content = &Content{
+			Type:          OctetStreamContentType,
+			EncryptedType: entry.Content.Type,
+			Body:          base64.StdEncoding.EncodeToString(ciphertext),
+		}
+	}
+
+	feed.EncryptionKey = &EncryptionKey{
+		Algorithm:    AlgAES256GCM,
+		KeyProvider:  dataKey.Provider,
+		KeyID:        dataKey.KeyID,
+		EncryptedKey: base64.StdEncoding.EncodeToString(dataKey.EncryptedKey),
+	}
+
+	return nil
+}
+
+//DecryptEntries decrypts the content of the entries of a feed page served in entry encryption
+//mode, using the given key provider to decrypt the data key, restoring the content as it was
+//before it was encrypted. Feeds without an encryptionKey element are left as is.
+func (f *Feed) DecryptEntries(keyProvider KeyProvider) error {
+	if f.EncryptionKey == nil {
+		return nil
+	}
+
+	key, err := f.EncryptionKey.open(keyProvider)
+	if err != nil {
+		return err
+	}
+
+	//Purge the key from memory
+	defer func() {
+		key = [32]byte{}
+	}()
+
+	for _, entry := range f.Entry {
+		if err := entry.decryptContent(&key); err != nil {
+			return err
+		}
+	}
+
+	f.EncryptionKey = nil
+	return nil
+}
+
+//DecryptContent decrypts the content of an entry sent on the event stream in entry encryption
+//mode, which carries its own encryptionKey element as there's no feed to give it. Entries
+//without an encryptionKey element are left as is.
+func (e *Entry) DecryptContent(keyProvider KeyProvider) error {
+	if e.EncryptionKey == nil {
+		return nil
+	}
+
+	key, err := e.EncryptionKey.open(keyProvider)
+	if err != nil {
+		return err
+	}
+
+	//Purge the key from memory
+	defer func() {
+		key = [32]byte{}
+	}()
+
+	if err := e.decryptContent(&key); err != nil {
+		return err
+	}
+
+	e.EncryptionKey = nil
+	return nil
+}
+
+//open decrypts the data key with the key provider
+func (k *EncryptionKey) open(keyProvider KeyProvider) ([32]byte, error) {
+	if k.Algorithm != AlgAES256GCM {
+		return [32]byte{}, ErrUnsupportedEnvelope
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k.EncryptedKey))
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return openDataKey(keyProvider, encryptedKey)
+}
+
+func (e *Entry) decryptContent(key *[32]byte) error {
+	if e.Content == nil || e.Content.EncryptedType == "" {
+		return nil
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(e.Content.Body))
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := decrypt(ciphertext, key)
+	if err != nil {
+		return err
+	}
+
+	e.Content = newContent(e.Content.EncryptedType, plaintext)
+	return nil
+}
@@ -0,0 +1,261 @@
+package esatompubpg
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/goes"
+)
+
+func TestSetEncryptionMode(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	assert.False(t, ae.encryptsEntries())
+
+	assert.Nil(t, ae.SetEncryptionMode("Entry"))
+	assert.True(t, ae.encryptsEntries())
+
+	assert.Nil(t, ae.SetEncryptionMode(DocumentEncryptionMode))
+	assert.False(t, ae.encryptsEntries())
+
+	assert.Equal(t, ErrUnknownEncryptionMode, ae.SetEncryptionMode("field"))
+
+	//Entries are only encrypted if there's a key to encrypt them with
+	plain := NewAtomEncrypterWithKeyProvider(nil)
+	assert.Nil(t, plain.SetEncryptionMode(EntryEncryptionMode))
+	assert.False(t, plain.encryptsEntries())
+
+	defer os.Unsetenv(EncryptionMode)
+	os.Setenv(EncryptionMode, "field")
+	env, _ := envinject.NewInjectedEnv()
+	_, err := NewAtomEncrypter(env)
+	assert.Equal(t, ErrUnknownEncryptionMode, err)
+}
+
+func TestEntryEncryptedFeed(t *testing.T) {
+	RegisterPayloadRenderer("entry-json", JSONPayloadRenderer)
+	RegisterPayloadRenderer("entry-xml", XMLPayloadRenderer)
+
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.SetEncryptionMode(EntryEncryptionMode)
+
+	var payloads = []struct {
+		typeCode    string
+		contentType string
+		payload     string
+	}{
+		{"entry-json", JSONContentType, `{"secret":"json"}`},
+		{"entry-xml", XMLContentType, `<secret>xml</secret>`},
+		{"entry-opaque", OctetStreamContentType, "secret opaque"},
+	}
+
+	store := NewMemoryFeedStore()
+	for i, p := range payloads {
+		store.Add(atomdata.TimestampedEvent{
+			Event:     goes.Event{Source: "entry-agg", Version: i + 1, TypeCode: p.typeCode, Payload: []byte(p.payload)},
+			Timestamp: time.Now(),
+		})
+	}
+
+	store.CreateFeed("feed1")
+
+	//version returns the index of the payload of an entry from the version in its id
+	version := func(entry *Entry) int {
+		v, _ := strconv.Atoi(entry.ID[strings.LastIndex(entry.ID, ":")+1:])
+		return v - 1
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	archiveHandler, _ := NewArchiveHandler(store, "testhost:12345", env, ae)
+	eventHandler, _ := NewEventRetrieveHandler(store, env, ae)
+
+	router := mux.NewRouter()
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	get := func(uri string, accept string, acceptEncoding string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.Header.Set("Accept", accept)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, uri)
+		return w
+	}
+
+	//The page is in the clear, but none of the payloads are
+	w := get("/notifications/feed1", AtomContentType, "")
+	_, err := DecodeEnvelope(w.Body.Bytes())
+	assert.Equal(t, ErrNotEnvelope, err)
+	assert.False(t, strings.Contains(w.Body.String(), "secret"))
+
+	var feed Feed
+	if !assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) || !assert.Equal(t, 3, len(feed.Entry)) {
+		return
+	}
+
+	assert.Equal(t, "feed1", feed.ID)
+	if assert.NotNil(t, feed.EncryptionKey) {
+		assert.Equal(t, AlgAES256GCM, feed.EncryptionKey.Algorithm)
+		assert.Equal(t, LocalKeyProviderType, feed.EncryptionKey.KeyProvider)
+	}
+
+	for _, entry := range feed.Entry {
+		p := payloads[version(entry)]
+		assert.Equal(t, p.typeCode, entry.TypeCode())
+		assert.NotEqual(t, "", string(entry.Published))
+		assert.Equal(t, OctetStreamContentType, entry.Content.Type)
+		assert.Equal(t, p.contentType, entry.Content.EncryptedType)
+	}
+
+	//Entries can't be decrypted with another key
+	otherKP, _ := NewLocalKeyProvider([]byte("fedcba9876543210fedcba9876543210"))
+	var other Feed
+	xml.Unmarshal(w.Body.Bytes(), &other)
+	assert.NotNil(t, other.DecryptEntries(otherKP))
+
+	if !assert.Nil(t, feed.DecryptEntries(kp)) {
+		return
+	}
+
+	assert.Nil(t, feed.EncryptionKey)
+	for _, entry := range feed.Entry {
+		p := payloads[version(entry)]
+		assert.Equal(t, p.contentType, entry.Content.Type)
+
+		payload, err := entry.Content.Payload()
+		assert.Nil(t, err)
+		assert.Equal(t, p.payload, string(payload))
+	}
+
+	//The page is cached with its entries encrypted, and as it's not encrypted as a whole it's
+	//compressed by the response's content coding
+	assert.Equal(t, w.Body.String(), get("/notifications/feed1", AtomContentType, "").Body.String())
+
+	compressed := get("/notifications/feed1", AtomContentType, GzipEncoding)
+	assert.Equal(t, GzipEncoding, compressed.Header().Get("Content-Encoding"))
+
+	//The JSON Feed representation carries the key and content types in its extension objects
+	var jsonFeed JSONFeed
+	if assert.Nil(t, json.Unmarshal(get("/notifications/feed1", JSONFeedContentType, "").Body.Bytes(), &jsonFeed)) {
+		assert.NotNil(t, jsonFeed.Atom.EncryptionKey)
+		for _, item := range jsonFeed.Items {
+			assert.Equal(t, OctetStreamContentType, item.Atom.ContentType)
+			assert.NotEqual(t, "", item.Atom.EncryptedContentType)
+			assert.Nil(t, item.Atom.Content)
+		}
+	}
+
+	//Events aren't feed pages, so are still encrypted as a whole
+	event := get("/events/entry-agg/1", XMLContentType, "")
+	decrypted, err := DecryptOutput(event.Body.Bytes(), kp)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(decrypted), "<aggregateId>entry-agg</aggregateId>"))
+}
+
+func TestEntryEncryptedEmptyFeed(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.SetEncryptionMode(EntryEncryptionMode)
+
+	env, _ := envinject.NewInjectedEnv()
+	recentHandler, _ := NewRecentHandler(NewMemoryFeedStore(), "testhost:12345", env, ae)
+
+	r, _ := http.NewRequest("GET", RecentHandlerURI, nil)
+	w := httptest.NewRecorder()
+	recentHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	//Without entries there's nothing to encrypt, so no key
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) {
+		assert.Equal(t, "recent", feed.ID)
+		assert.Nil(t, feed.EncryptionKey)
+	}
+}
+
+func TestEntryEncryptedStream(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.SetEncryptionMode(EntryEncryptionMode)
+
+	store := NewMemoryFeedStore()
+	for i, typeCode := range []string{"StreamA", "StreamB", "StreamA"} {
+		store.Add(atomdata.TimestampedEvent{
+			Event:     goes.Event{Source: "stream-agg", Version: i + 1, TypeCode: typeCode, Payload: []byte("secret " + strconv.Itoa(i+1))},
+			Timestamp: time.Now(),
+		})
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, _ := NewStreamHandler(store, "testhost:12345", env, ae, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("GET", StreamHandlerURI, nil)
+	r = r.WithContext(ctx)
+	r.Header.Set("Last-Event-ID", "urn:esid:stream-agg:1")
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.False(t, strings.Contains(w.Body.String(), "secret"))
+
+	ids, data := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:stream-agg:2", "urn:esid:stream-agg:3"}, ids)
+	if !assert.Equal(t, 2, len(data)) {
+		return
+	}
+
+	//The entry metadata is in the clear, and each entry carries the key of its content
+	for i, d := range data {
+		_, err := DecodeEnvelope([]byte(d))
+		assert.Equal(t, ErrNotEnvelope, err)
+
+		var entry Entry
+		if !assert.Nil(t, xml.Unmarshal([]byte(d), &entry)) {
+			continue
+		}
+
+		assert.Equal(t, ids[i], entry.ID)
+		assert.Equal(t, []string{"StreamB", "StreamA"}[i], entry.TypeCode())
+		assert.NotEqual(t, "", string(entry.Published))
+		assert.Equal(t, OctetStreamContentType, entry.Content.Type)
+		if !assert.NotNil(t, entry.EncryptionKey) {
+			continue
+		}
+		assert.Equal(t, LocalKeyProviderType, entry.EncryptionKey.KeyProvider)
+
+		if assert.Nil(t, entry.DecryptContent(kp)) {
+			assert.Nil(t, entry.EncryptionKey)
+			payload, err := entry.Content.Payload()
+			assert.Nil(t, err)
+			assert.Equal(t, "secret "+strconv.Itoa(i+2), string(payload))
+		}
+	}
+
+	//Entries of feed pages don't carry a key of their own
+	recentHandler, _ := NewRecentHandler(store, "testhost:12345", env, ae)
+	r, _ = http.NewRequest("GET", RecentHandlerURI, nil)
+	w = httptest.NewRecorder()
+	recentHandler(w, r)
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) && assert.Equal(t, 3, len(feed.Entry)) {
+		assert.NotNil(t, feed.EncryptionKey)
+		assert.Nil(t, feed.Entry[0].EncryptionKey)
+	}
+}
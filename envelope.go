@@ -0,0 +1,195 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+//Envelope versions and algorithms. Version 0 denotes the legacy base64(key)::base64(ciphertext)
+//format, which carries no header and always uses KMS and AES-256-GCM. Envelopes with compressed
+//plaintext are version 2, so consumers that predate compression reject them rather than
+//returning compressed data.
+const (
+	LegacyEnvelopeVersion     = 0
+	EnvelopeVersion           = 1
+	CompressedEnvelopeVersion = 2
+	AlgAES256GCM              = "AES-256-GCM"
+	gcmNonceSize              = 12
+)
+
+var ErrNotEnvelope = errors.New("Data is not an encrypted envelope")
+var ErrUnsupportedEnvelope = errors.New("Unsupported envelope version or algorithm")
+
+//EnvelopeHeader describes how the envelope ciphertext was produced: the envelope version, the
+//encryption algorithm, the key provider and master key id used to encrypt the data key, the
+//encrypted data key itself, the nonce, and the content coding the plaintext was compressed
+//with, if any.
+type EnvelopeHeader struct {
+	Version      int    `json:"v"`
+	Algorithm    string `json:"alg"`
+	KeyProvider  string `json:"kp"`
+	KeyID        string `json:"kid,omitempty"`
+	EncryptedKey []byte `json:"ek"`
+	Nonce        []byte `json:"n"`
+	Encoding     string `json:"ce,omitempty"`
+}
+
+//Envelope is the self describing container for encrypted output produced by EncryptOutput. It
+//is serialized as JSON, for example
+//
+//	{"envelope":{"v":1,"alg":"AES-256-GCM","kp":"kms","kid":"...","ek":"...","n":"..."},"ct":"..."}
+//
+//where the byte values are base64 encoded.
+type Envelope struct {
+	Header     EnvelopeHeader `json:"envelope"`
+	Ciphertext []byte         `json:"ct"`
+}
+
+//sealEnvelope wraps ciphertext produced by encrypt, which is prefixed with its nonce, in an
+//envelope for the given data key. The encoding is the content coding the plaintext was
+//compressed with before it was encrypted.
+func sealEnvelope(dataKey *DataKey, encrypted []byte, encoding string) ([]byte, error) {
+	if len(encrypted) < gcmNonceSize {
+		return nil, ErrMalformedCiphertext
+	}
+
+	version := EnvelopeVersion
+	if encoding == IdentityEncoding {
+		encoding = ""
+	}
+	if encoding != "" {
+		version = CompressedEnvelopeVersion
+	}
+
+	envelope := Envelope{
+		Header: EnvelopeHeader{
+			Version:      version,
+			Algorithm:    AlgAES256GCM,
+			KeyProvider:  dataKey.Provider,
+			KeyID:        dataKey.KeyID,
+			EncryptedKey: dataKey.EncryptedKey,
+			Nonce:        encrypted[:gcmNonceSize],
+			Encoding:     encoding,
+		},
+		Ciphertext: encrypted[gcmNonceSize:],
+	}
+
+	return json.Marshal(&envelope)
+}
+
+//DecodeEnvelope parses encrypted output in either the current envelope format or the legacy
+//base64(key)::base64(ciphertext) format. ErrNotEnvelope is returned if the data is in neither
+//format, which is the case when output is not encrypted.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		var envelope Envelope
+		err := json.Unmarshal(data, &envelope)
+		if err != nil || envelope.Header.Version == LegacyEnvelopeVersion {
+			return nil, ErrNotEnvelope
+		}
+
+		return &envelope, nil
+	}
+
+	return decodeLegacyEnvelope(data)
+}
+
+func decodeLegacyEnvelope(data []byte) (*Envelope, error) {
+	parts := bytes.Split(data, []byte("::"))
+	if len(parts) != 2 {
+		return nil, ErrNotEnvelope
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, ErrNotEnvelope
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	if err != nil || len(encrypted) < gcmNonceSize {
+		return nil, ErrNotEnvelope
+	}
+
+	return &Envelope{
+		Header: EnvelopeHeader{
+			Version:      LegacyEnvelopeVersion,
+			Algorithm:    AlgAES256GCM,
+			KeyProvider:  KMSKeyProviderType,
+			EncryptedKey: encryptedKey,
+			Nonce:        encrypted[:gcmNonceSize],
+		},
+		Ciphertext: encrypted[gcmNonceSize:],
+	}, nil
+}
+
+//Open decrypts the envelope contents, using the given key provider to decrypt the data key, and
+//decompresses them if they were compressed, to at most DefaultMaxDecompressedSize bytes.
+func (e *Envelope) Open(keyProvider KeyProvider) ([]byte, error) {
+	return e.OpenLimit(keyProvider, DefaultMaxDecompressedSize)
+}
+
+//OpenLimit opens the envelope as Open does, returning ErrDecompressedSizeExceeded if the
+//contents decompress to more than limit bytes.
+func (e *Envelope) OpenLimit(keyProvider KeyProvider, limit int64) ([]byte, error) {
+	if e.Header.Version > CompressedEnvelopeVersion || e.Header.Algorithm != AlgAES256GCM {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	key, err := openDataKey(keyProvider, e.Header.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 0, len(e.Header.Nonce)+len(e.Ciphertext))
+	ciphertext = append(ciphertext, e.Header.Nonce...)
+	ciphertext = append(ciphertext, e.Ciphertext...)
+
+	plaintext, err := decrypt(ciphertext, &key)
+
+	//Purge the key from memory
+	key = [32]byte{}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecompressLimit(e.Header.Encoding, plaintext, limit)
+}
+
+//openDataKey decrypts the encrypted data key with the key provider
+func openDataKey(keyProvider KeyProvider, encryptedKey []byte) ([32]byte, error) {
+	key := [32]byte{}
+
+	plaintextKey, err := keyProvider.DecryptDataKey(encryptedKey)
+	if err != nil {
+		return key, err
+	}
+
+	if len(plaintextKey) < 32 {
+		return key, ErrInvalidDataKey
+	}
+
+	copy(key[:], plaintextKey[0:32])
+
+	//Purge the plaintext key from memory, leaving only the copy
+	for i := range plaintextKey {
+		plaintextKey[i] = 0
+	}
+
+	return key, nil
+}
+
+//DecryptOutput decodes and decrypts output produced by EncryptOutput, in either the current or
+//legacy envelope format.
+func DecryptOutput(data []byte, keyProvider KeyProvider) ([]byte, error) {
+	envelope, err := DecodeEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope.Open(keyProvider)
+}
@@ -0,0 +1,103 @@
+package esatompubpg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+
+	out, err := ae.EncryptOutput([]byte("<feed>stuff</feed>"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	envelope, err := DecodeEnvelope(out)
+	if assert.Nil(t, err) {
+		assert.Equal(t, EnvelopeVersion, envelope.Header.Version)
+		assert.Equal(t, AlgAES256GCM, envelope.Header.Algorithm)
+		assert.Equal(t, LocalKeyProviderType, envelope.Header.KeyProvider)
+		assert.Equal(t, kp.keyID, envelope.Header.KeyID)
+		assert.Equal(t, gcmNonceSize, len(envelope.Header.Nonce))
+
+		plaintext, err := envelope.Open(kp)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "<feed>stuff</feed>", string(plaintext))
+		}
+	}
+}
+
+func TestDecodeLegacyEnvelope(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	dataKey, err := kp.GenerateDataKey()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	key := [32]byte{}
+	copy(key[:], dataKey.Plaintext)
+	encrypted, err := encrypt([]byte("legacy content"), &key)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	legacy := fmt.Sprintf("%s::%s",
+		base64.StdEncoding.EncodeToString(dataKey.EncryptedKey),
+		base64.StdEncoding.EncodeToString(encrypted))
+
+	envelope, err := DecodeEnvelope([]byte(legacy))
+	if assert.Nil(t, err) {
+		assert.Equal(t, LegacyEnvelopeVersion, envelope.Header.Version)
+		assert.Equal(t, KMSKeyProviderType, envelope.Header.KeyProvider)
+	}
+
+	plaintext, err := DecryptOutput([]byte(legacy), kp)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "legacy content", string(plaintext))
+	}
+}
+
+func TestDecodeNotEnvelope(t *testing.T) {
+	for _, data := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom"></feed>`,
+		`{"version":"https://jsonfeed.org/version/1.1"}`,
+		`not::base64`,
+		``,
+	} {
+		_, err := DecodeEnvelope([]byte(data))
+		assert.Equal(t, ErrNotEnvelope, err, data)
+	}
+}
+
+func TestOpenUnsupportedEnvelope(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+
+	out, err := ae.EncryptOutput([]byte("content"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	envelope, _ := DecodeEnvelope(out)
+	envelope.Header.Version = CompressedEnvelopeVersion + 1
+	_, err = envelope.Open(kp)
+	assert.Equal(t, ErrUnsupportedEnvelope, err)
+
+	envelope.Header.Version = EnvelopeVersion
+	envelope.Header.Algorithm = "ROT13"
+	_, err = envelope.Open(kp)
+	assert.Equal(t, ErrUnsupportedEnvelope, err)
+
+	//Tampering with the ciphertext is detected
+	envelope, _ = DecodeEnvelope(out)
+	envelope.Ciphertext[0] ^= 0xff
+	tampered, _ := json.Marshal(envelope)
+	_, err = DecryptOutput(tampered, kp)
+	assert.NotNil(t, err)
+}
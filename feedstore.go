@@ -0,0 +1,120 @@
+package esatompubpg
+
+import (
+	"database/sql"
+	"errors"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrMissingFeedStore = errors.New("Nil feed store passed to factory method")
+var ErrEventNotFound = errors.New("Event not found")
+
+//FeedStore provides the feed data served by the handlers. Events are returned newest first.
+type FeedStore interface {
+	//RetrieveRecent returns the events not yet assigned to a feed
+	RetrieveRecent() ([]atomdata.TimestampedEvent, error)
+
+	//RetrieveLastFeed returns the id of the most recently created feed, or the empty string if
+	//no feeds have been created
+	RetrieveLastFeed() (string, error)
+
+	//RetrieveArchive returns the events assigned to the feed, which are empty if there is no
+	//such feed
+	RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error)
+
+	//RetrievePreviousFeed returns the id of the feed created before the given feed, or the empty
+	//string if there is none
+	RetrievePreviousFeed(feedID string) (string, error)
+
+	//RetrieveNextFeed returns the id of the feed created after the given feed, or the empty
+	//string if there is none
+	RetrieveNextFeed(feedID string) (string, error)
+
+	//RetrieveEvent returns the event with the given aggregate id and version, or
+	//ErrEventNotFound if there is no such event
+	RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error)
+
+	//RetrieveAggregate returns up to limit events for the aggregate with versions from the from
+	//version through the to version, or with no upper bound if to is 0. Unlike the feed
+	//queries, the events are returned in version order.
+	RetrieveAggregate(aggregateID string, from int, to int, limit int) ([]atomdata.TimestampedEvent, error)
+}
+
+//PGFeedStore is a feed store backed by the Postgres tables maintained by es-atom-data-pg
+type PGFeedStore struct {
+	db *sql.DB
+}
+
+//NewPGFeedStore creates a feed store that reads from the given database
+func NewPGFeedStore(db *sql.DB) (*PGFeedStore, error) {
+	if db == nil {
+		return nil, ErrBadDBConnection
+	}
+
+	return &PGFeedStore{db: db}, nil
+}
+
+func (s *PGFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	return atomdata.RetrieveRecent(s.db)
+}
+
+func (s *PGFeedStore) RetrieveLastFeed() (string, error) {
+	return atomdata.RetrieveLastFeed(s.db)
+}
+
+func (s *PGFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	return atomdata.RetrieveArchive(s.db, feedID)
+}
+
+func (s *PGFeedStore) RetrievePreviousFeed(feedID string) (string, error) {
+	previous, err := atomdata.RetrievePreviousFeed(s.db, feedID)
+	if err != nil || !previous.Valid {
+		return "", err
+	}
+
+	return previous.String, nil
+}
+
+func (s *PGFeedStore) RetrieveNextFeed(feedID string) (string, error) {
+	next, err := atomdata.RetrieveNextFeed(s.db, feedID)
+	if err != nil || !next.Valid {
+		return "", err
+	}
+
+	return next.String, nil
+}
+
+func (s *PGFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	event, err := atomdata.RetrieveEvent(s.db, aggregateID, version)
+	if err == sql.ErrNoRows {
+		err = ErrEventNotFound
+	}
+
+	return event, err
+}
+
+func (s *PGFeedStore) RetrieveAggregate(aggregateID string, from int, to int, limit int) ([]atomdata.TimestampedEvent, error) {
+	rows, err := s.db.Query(`select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event
+		where aggregate_id = $1 and version >= $2 and ($3 = 0 or version <= $3) order by version limit $4`,
+		aggregateID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var events []atomdata.TimestampedEvent
+	for rows.Next() {
+		var event atomdata.TimestampedEvent
+		var payload []byte
+		if err := rows.Scan(&event.Timestamp, &event.Source, &event.Version, &event.TypeCode, &payload); err != nil {
+			return nil, err
+		}
+
+		event.Payload = payload
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
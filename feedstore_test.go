@@ -0,0 +1,181 @@
+package esatompubpg
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/goes"
+	"golang.org/x/tools/blog/atom"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+//pgFeedStore wraps a stub database in a PG feed store
+func pgFeedStore(t *testing.T, db *sql.DB) FeedStore {
+	store, err := NewPGFeedStore(db)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected creating the feed store", err)
+	}
+
+	return store
+}
+
+func testEvent(aggregateID string, version int) atomdata.TimestampedEvent {
+	return atomdata.TimestampedEvent{
+		Event: goes.Event{
+			Source:   aggregateID,
+			Version:  version,
+			TypeCode: "foo",
+			Payload:  []byte("yeah ok"),
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+func TestPGFeedStore(t *testing.T) {
+	_, err := NewPGFeedStore(nil)
+	assert.Equal(t, ErrBadDBConnection, err)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := pgFeedStore(t, db)
+
+	mock.ExpectQuery("select previous").WillReturnRows(sqlmock.NewRows([]string{"previous"}).AddRow(nil))
+	previous, err := store.RetrievePreviousFeed("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "", previous)
+
+	mock.ExpectQuery("select feedid").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("bar"))
+	next, err := store.RetrieveNextFeed("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", next)
+
+	mock.ExpectQuery("select").WillReturnError(sql.ErrNoRows)
+	_, err = store.RetrieveEvent("foo", 1)
+	assert.Equal(t, ErrEventNotFound, err)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMemoryFeedStore(t *testing.T) {
+	store := NewMemoryFeedStore()
+	subscription := store.Subscribe()
+	defer subscription.Close()
+
+	assert.Equal(t, ErrNoRecentEvents, store.CreateFeed("feed1"))
+
+	assert.Nil(t, store.Add(testEvent("agg", 1), testEvent("agg", 2)))
+	assert.Equal(t, SignalNewEvents, <-subscription.C)
+	assert.Nil(t, store.CreateFeed("feed1"))
+	assert.Equal(t, SignalNewFeed, <-subscription.C)
+
+	assert.Nil(t, store.Add(testEvent("agg", 3)))
+	assert.Nil(t, store.CreateFeed("feed2"))
+	assert.Nil(t, store.Add(testEvent("agg", 4)))
+
+	//Events already added and bad payloads are rejected, and nothing from the batch is added
+	assert.Equal(t, ErrDuplicateEvent, store.Add(testEvent("agg", 5), testEvent("agg", 1)))
+	assert.Equal(t, ErrDuplicateEvent, store.Add(testEvent("agg", 5), testEvent("agg", 5)))
+	badPayload := testEvent("agg", 5)
+	badPayload.Payload = "yeah ok"
+	assert.Equal(t, ErrInvalidPayload, store.Add(badPayload))
+
+	assert.Equal(t, ErrInvalidFeedID, store.CreateFeed("recent"))
+	assert.Equal(t, ErrDuplicateFeed, store.CreateFeed("feed1"))
+
+	versions := func(events []atomdata.TimestampedEvent) []int {
+		var v []int
+		for _, e := range events {
+			v = append(v, e.Version)
+		}
+		return v
+	}
+
+	recent, _ := store.RetrieveRecent()
+	assert.Equal(t, []int{4}, versions(recent))
+
+	archive, _ := store.RetrieveArchive("feed1")
+	assert.Equal(t, []int{2, 1}, versions(archive))
+
+	archive, _ = store.RetrieveArchive("nope")
+	assert.Equal(t, 0, len(archive))
+
+	last, _ := store.RetrieveLastFeed()
+	assert.Equal(t, "feed2", last)
+
+	previous, _ := store.RetrievePreviousFeed("feed2")
+	assert.Equal(t, "feed1", previous)
+	previous, _ = store.RetrievePreviousFeed("feed1")
+	assert.Equal(t, "", previous)
+
+	next, _ := store.RetrieveNextFeed("feed1")
+	assert.Equal(t, "feed2", next)
+	next, _ = store.RetrieveNextFeed("feed2")
+	assert.Equal(t, "", next)
+
+	event, err := store.RetrieveEvent("agg", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, event.Version)
+
+	_, err = store.RetrieveEvent("agg", 5)
+	assert.Equal(t, ErrEventNotFound, err)
+}
+
+func TestHandlersWithMemoryFeedStore(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+	store.CreateFeed("feed1")
+	store.Add(testEvent("agg", 3))
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345", env, ae)
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345", env, ae)
+	assert.Nil(t, err)
+	eventHandler, err := NewEventRetrieveHandler(store, env, ae)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	var feed atom.Feed
+	w := get("/notifications/recent")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) && assert.Equal(t, 1, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg:3", feed.Entry[0].ID)
+	}
+
+	w = get("/notifications/feed1")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	feed = atom.Feed{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) && assert.Equal(t, 2, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg:2", feed.Entry[0].ID)
+		assert.Equal(t, "https://testhost:12345/notifications/recent", feed.Link[len(feed.Link)-1].Href)
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/notifications/feed2").Result().StatusCode)
+	assert.Equal(t, http.StatusOK, get("/events/agg/1").Result().StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/events/agg/4").Result().StatusCode)
+}
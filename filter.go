@@ -0,0 +1,141 @@
+package esatompubpg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+//TypeCodeParam is the query parameter used to restrict the recent, archive and stream
+//resources to events with the given typecodes. It may be repeated to select several typecodes.
+const TypeCodeParam = "typecode"
+
+//typeCodeFilter selects events by typecode. The typecodes are sorted so the same selection
+//always gives the same cache key, entity tag and links. An empty filter selects all events.
+type typeCodeFilter []string
+
+func typeCodeFilterFromRequest(req *http.Request) typeCodeFilter {
+	selected := make(map[string]bool)
+	var filter typeCodeFilter
+	for _, typeCode := range req.URL.Query()[TypeCodeParam] {
+		if typeCode != "" && !selected[typeCode] {
+			selected[typeCode] = true
+			filter = append(filter, typeCode)
+		}
+	}
+
+	sort.Strings(filter)
+	return filter
+}
+
+func (f typeCodeFilter) matches(typeCode string) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	i := sort.SearchStrings(f, typeCode)
+	return i < len(f) && f[i] == typeCode
+}
+
+//apply returns the events selected by the filter, in the order given
+func (f typeCodeFilter) apply(events []atomdata.TimestampedEvent) []atomdata.TimestampedEvent {
+	if len(f) == 0 {
+		return events
+	}
+
+	var selected []atomdata.TimestampedEvent
+	for _, event := range events {
+		if f.matches(event.TypeCode) {
+			selected = append(selected, event)
+		}
+	}
+
+	return selected
+}
+
+//key identifies the selection, and is empty when all events are selected
+func (f typeCodeFilter) key() string {
+	return strings.Join(f, "\n")
+}
+
+//tagID qualifies an entity tag id with the selection. The typecodes are hashed as they may
+//contain characters that aren't allowed in entity tags.
+func (f typeCodeFilter) tagID(id string) string {
+	if len(f) == 0 {
+		return id
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(f.key()))
+	return fmt.Sprintf("%s;typecode=%x", id, h.Sum64())
+}
+
+//query returns the query string, including the leading ?, that carries the filter in link
+//relations so clients following them stay on the filtered feed.
+func (f typeCodeFilter) query() string {
+	if len(f) == 0 {
+		return ""
+	}
+
+	values := url.Values{TypeCodeParam: f}
+	return "?" + values.Encode()
+}
+
+//entrySelection is the entries served for a request: those selected by the typecode filter
+//that the consumer is allowed to see, with their payloads redacted for the consumer.
+type entrySelection struct {
+	filter    typeCodeFilter
+	grant     *Grant
+	redaction *redaction
+}
+
+func selectionFromRequest(req *http.Request, policy *RedactionPolicy) entrySelection {
+	return entrySelection{
+		filter:    typeCodeFilterFromRequest(req),
+		grant:     grantFromRequest(req),
+		redaction: policy.forRequest(req),
+	}
+}
+
+func (s entrySelection) apply(events []atomdata.TimestampedEvent) []atomdata.TimestampedEvent {
+	return s.grant.apply(s.filter.apply(events))
+}
+
+//key identifies the selection, and is empty when all events are selected as is
+func (s entrySelection) key() string {
+	key := s.filter.key()
+	if s.grant.key() != "" {
+		key += "\ngrant=" + s.grant.key()
+	}
+
+	if s.redaction.key() != "" {
+		key += "\nredaction=" + s.redaction.key()
+	}
+
+	return key
+}
+
+//tagID qualifies an entity tag id with the selection
+func (s entrySelection) tagID(id string) string {
+	id = s.filter.tagID(id)
+	if s.grant.key() != "" {
+		id = fmt.Sprintf("%s;grant=%s", id, s.grant.key())
+	}
+
+	if s.redaction.key() != "" {
+		id = fmt.Sprintf("%s;redaction=%s", id, s.redaction.key())
+	}
+
+	return id
+}
+
+//query returns the query string carrying the typecode filter in link relations. The grant is
+//not carried, as it comes from the consumer's credentials.
+func (s entrySelection) query() string {
+	return s.filter.query()
+}
@@ -0,0 +1,158 @@
+package esatompubpg
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"golang.org/x/tools/blog/atom"
+)
+
+func typedEvent(aggregateID string, version int, typeCode string) atomdata.TimestampedEvent {
+	event := testEvent(aggregateID, version)
+	event.TypeCode = typeCode
+	return event
+}
+
+func TestTypeCodeFilter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/notifications/recent?typecode=foo&typecode=bar&typecode=&typecode=foo", nil)
+	filter := typeCodeFilterFromRequest(r)
+	assert.Equal(t, typeCodeFilter{"bar", "foo"}, filter)
+	assert.True(t, filter.matches("foo"))
+	assert.False(t, filter.matches("baz"))
+	assert.Equal(t, "?typecode=bar&typecode=foo", filter.query())
+
+	events := []atomdata.TimestampedEvent{typedEvent("agg", 3, "foo"), typedEvent("agg", 2, "baz"), typedEvent("agg", 1, "bar")}
+	selected := filter.apply(events)
+	if assert.Equal(t, 2, len(selected)) {
+		assert.Equal(t, 3, selected[0].Version)
+		assert.Equal(t, 1, selected[1].Version)
+	}
+
+	//The order of the parameters doesn't change the selection
+	r, _ = http.NewRequest("GET", "/notifications/recent?typecode=foo&typecode=bar", nil)
+	assert.Equal(t, filter.tagID("feed1"), typeCodeFilterFromRequest(r).tagID("feed1"))
+	assert.NotEqual(t, "feed1", filter.tagID("feed1"))
+
+	r, _ = http.NewRequest("GET", "/notifications/recent", nil)
+	filter = typeCodeFilterFromRequest(r)
+	assert.Equal(t, 3, len(filter.apply(events)))
+	assert.Equal(t, "", filter.query())
+	assert.Equal(t, "feed1", filter.tagID("feed1"))
+	assert.Equal(t, archiveCacheKey("feed1", AtomContentType, IdentityEncoding, entrySelection{}), archiveCacheKey("feed1", AtomContentType, IdentityEncoding, selectionFromRequest(r, nil)))
+}
+
+func TestFilteredHandlers(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(typedEvent("agg", 1, "foo"), typedEvent("agg", 2, "bar"))
+	store.CreateFeed("feed1")
+	store.Add(typedEvent("agg", 3, "bar"), typedEvent("agg", 4, "baz"))
+	store.CreateFeed("feed2")
+	store.Add(typedEvent("agg", 5, "foo"), typedEvent("agg", 6, "baz"))
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	recentHandler, err := NewRecentHandler(store, "testhost:12345", env, ae)
+	assert.Nil(t, err)
+	archiveHandler, err := NewArchiveHandler(store, "testhost:12345", env, ae)
+	assert.Nil(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+	get := func(uri string, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	links := func(feed *atom.Feed) map[string]string {
+		l := make(map[string]string)
+		for _, link := range feed.Link {
+			l[link.Rel] = link.Href
+		}
+		return l
+	}
+
+	w := get("/notifications/recent?typecode=foo", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var feed atom.Feed
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) && assert.Equal(t, 1, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:agg:5", feed.Entry[0].ID)
+		assert.Equal(t, "https://testhost:12345/notifications/recent?typecode=foo", links(&feed)["self"])
+		assert.Equal(t, "https://testhost:12345/notifications/feed2?typecode=foo", links(&feed)["prev-archive"])
+	}
+
+	//A filtered recent page has its own ETag, which is unaffected by new entries that aren't
+	//selected
+	recentETag := w.Header().Get("ETag")
+	assert.NotEqual(t, get("/notifications/recent", "").Header().Get("ETag"), recentETag)
+	store.Add(typedEvent("agg", 7, "baz"))
+	assert.Equal(t, http.StatusNotModified, get("/notifications/recent?typecode=foo", recentETag).Result().StatusCode)
+
+	//The archive exists even though none of its entries are selected
+	w = get("/notifications/feed2?typecode=foo", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	feed = atom.Feed{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) {
+		assert.Equal(t, 0, len(feed.Entry))
+		assert.Equal(t, "https://testhost:12345/notifications/feed2?typecode=foo", links(&feed)["self"])
+		assert.Equal(t, "https://testhost:12345/notifications/feed1?typecode=foo", links(&feed)["prev-archive"])
+		assert.Equal(t, "https://testhost:12345/notifications/recent?typecode=foo", links(&feed)["next-archive"])
+	}
+
+	filteredETag := w.Header().Get("ETag")
+	assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+
+	//Filtered and unfiltered pages are cached separately
+	w = get("/notifications/feed2?typecode=bar&typecode=baz", "")
+	feed = atom.Feed{}
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) {
+		assert.Equal(t, 2, len(feed.Entry))
+	}
+
+	w = get("/notifications/feed2", "")
+	unfilteredETag := w.Header().Get("ETag")
+	assert.Equal(t, `"feed2"`, unfilteredETag)
+	assert.NotEqual(t, unfilteredETag, filteredETag)
+
+	assert.Equal(t, http.StatusNotModified, get("/notifications/feed2?typecode=foo", filteredETag).Result().StatusCode)
+	assert.Equal(t, http.StatusOK, get("/notifications/feed2?typecode=foo", unfilteredETag).Result().StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/notifications/feed3?typecode=foo", "").Result().StatusCode)
+}
+
+func TestFilteredStream(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(typedEvent("agg", 1, "foo"), typedEvent("agg", 2, "bar"))
+	store.CreateFeed("feed1")
+	store.Add(typedEvent("agg", 3, "foo"), typedEvent("agg", 4, "bar"))
+
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, err := NewStreamHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil), nil)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("GET", StreamHandlerURI+"?typecode=bar", nil)
+	r = r.WithContext(ctx)
+	r.Header.Set("Last-Event-ID", "urn:esid:agg:1")
+
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+
+	ids, _ := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:2", "urn:esid:agg:4"}, ids)
+}
@@ -0,0 +1,173 @@
+package esatompubpg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/goes"
+)
+
+var ErrMalformedFixture = errors.New("Fixture events need an aggregate id, version and typecode")
+
+//FixtureEvent is an event read from a fixture file. The payload is given either as JSON, where a
+//JSON string is taken as the payload text and anything else as the payload itself, or base64
+//encoded as content, as in the JSON representation of an event. If published is not given the
+//time the event is loaded is used.
+type FixtureEvent struct {
+	AggregateID string          `json:"aggregateId"`
+	Version     int             `json:"version"`
+	TypeCode    string          `json:"typecode"`
+	Published   time.Time       `json:"published"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Content     string          `json:"content,omitempty"`
+}
+
+//TimestampedEvent converts the fixture event to a timestamped event
+func (f *FixtureEvent) TimestampedEvent() (atomdata.TimestampedEvent, error) {
+	var event atomdata.TimestampedEvent
+	if f.AggregateID == "" || f.Version == 0 || f.TypeCode == "" {
+		return event, ErrMalformedFixture
+	}
+
+	var payload []byte
+	switch {
+	case f.Content != "":
+		var err error
+		payload, err = base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return event, err
+		}
+	case len(f.Payload) > 0 && f.Payload[0] == '"':
+		var text string
+		if err := json.Unmarshal(f.Payload, &text); err != nil {
+			return event, err
+		}
+		payload = []byte(text)
+	default:
+		payload = []byte(f.Payload)
+	}
+
+	published := f.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	event = atomdata.TimestampedEvent{
+		Event: goes.Event{
+			Source:   f.AggregateID,
+			Version:  f.Version,
+			TypeCode: f.TypeCode,
+			Payload:  payload,
+		},
+		Timestamp: published,
+	}
+
+	return event, nil
+}
+
+//LoadFixture adds the events read from r to the store in the order given, returning the
+//number of events added. The fixture is either a JSON array of events or newline delimited
+//JSON with an event per line.
+func LoadFixture(store *MemoryFeedStore, r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	dec := json.NewDecoder(reader)
+
+	isArray, err := startsWithArray(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if isArray {
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for dec.More() {
+		var fixture FixtureEvent
+		if err := dec.Decode(&fixture); err != nil {
+			return count, fmt.Errorf("fixture event %d: %s", count+1, err.Error())
+		}
+
+		event, err := fixture.TimestampedEvent()
+		if err != nil {
+			return count, fmt.Errorf("fixture event %d: %s", count+1, err.Error())
+		}
+
+		if err := store.Add(event); err != nil {
+			return count, fmt.Errorf("fixture event %d: %s", count+1, err.Error())
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+//startsWithArray reports whether the first non-space character is the start of a JSON array
+func startsWithArray(reader *bufio.Reader) (bool, error) {
+	for {
+		c, err := reader.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		switch c[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return c[0] == '[', nil
+		}
+	}
+}
+
+//EventGenerator generates synthetic events for demos and load testing, spreading them across a
+//fixed number of aggregates and a few typecodes.
+type EventGenerator struct {
+	aggregates int
+	versions   []int
+	count      int
+}
+
+var generatedTypeCodes = []string{"OrderPlaced", "OrderShipped", "OrderCancelled"}
+
+//NewEventGenerator creates a generator for the given number of aggregates
+func NewEventGenerator(aggregates int) *EventGenerator {
+	if aggregates < 1 {
+		aggregates = 1
+	}
+
+	return &EventGenerator{
+		aggregates: aggregates,
+		versions:   make([]int, aggregates),
+	}
+}
+
+//Next returns the next event
+func (g *EventGenerator) Next() atomdata.TimestampedEvent {
+	aggregate := g.count % g.aggregates
+	g.versions[aggregate]++
+	g.count++
+
+	typeCode := generatedTypeCodes[(g.versions[aggregate]-1)%len(generatedTypeCodes)]
+	payload := fmt.Sprintf(`{"order":"order-%d","seq":%d,"status":"%s"}`, aggregate+1, g.count, typeCode)
+
+	return atomdata.TimestampedEvent{
+		Event: goes.Event{
+			Source:   fmt.Sprintf("order-%d", aggregate+1),
+			Version:  g.versions[aggregate],
+			TypeCode: typeCode,
+			Payload:  []byte(payload),
+		},
+		Timestamp: time.Now(),
+	}
+}
@@ -0,0 +1,109 @@
+package esatompubpg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFixture(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.SetFeedThreshold(2)
+
+	fixture := `[
+		{"aggregateId":"agg1","version":1,"typecode":"foo","published":"2017-04-01T10:00:00Z","payload":{"a":1}},
+		{"aggregateId":"agg1","version":2,"typecode":"foo","payload":"yeah ok"},
+		{"aggregateId":"agg2","version":1,"typecode":"bar","content":"eWVhaCBvaw=="}
+	]`
+
+	count, err := LoadFixture(store, strings.NewReader(fixture))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	event, err := store.RetrieveEvent("agg1", 1)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte(`{"a":1}`), event.Payload)
+		assert.Equal(t, 2017, event.Timestamp.Year())
+	}
+
+	event, err = store.RetrieveEvent("agg1", 2)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("yeah ok"), event.Payload)
+		assert.False(t, event.Timestamp.IsZero())
+	}
+
+	event, err = store.RetrieveEvent("agg2", 1)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("yeah ok"), event.Payload)
+	}
+
+	//The feed threshold assigns the first two events to a feed
+	feedID, _ := store.RetrieveLastFeed()
+	archive, _ := store.RetrieveArchive(feedID)
+	assert.Equal(t, 2, len(archive))
+	recent, _ := store.RetrieveRecent()
+	assert.Equal(t, 1, len(recent))
+
+	//Newline delimited events are loaded the same way
+	store = NewMemoryFeedStore()
+	count, err = LoadFixture(store, strings.NewReader(`{"aggregateId":"agg1","version":1,"typecode":"foo","payload":"1"}
+{"aggregateId":"agg1","version":2,"typecode":"foo","payload":"2"}
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = LoadFixture(NewMemoryFeedStore(), strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestLoadFixtureErrors(t *testing.T) {
+	_, err := LoadFixture(NewMemoryFeedStore(), strings.NewReader(`[{"aggregateId":"agg1","typecode":"foo"}]`))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "fixture event 1: "+ErrMalformedFixture.Error(), err.Error())
+	}
+
+	count, err := LoadFixture(NewMemoryFeedStore(), strings.NewReader(`{"aggregateId":"agg1","version":1,"typecode":"foo"}
+{"aggregateId":"agg1","version":1,"typecode":"foo"}`))
+	assert.Equal(t, 1, count)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "fixture event 2: "+ErrDuplicateEvent.Error(), err.Error())
+	}
+
+	_, err = LoadFixture(NewMemoryFeedStore(), strings.NewReader(`[{"aggregateId":"agg1","version":1,"typecode":"foo","content":"!!"}]`))
+	assert.NotNil(t, err)
+
+	_, err = LoadFixture(NewMemoryFeedStore(), strings.NewReader(`{"aggregateId":`))
+	assert.NotNil(t, err)
+}
+
+func TestEventGenerator(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.SetFeedThreshold(4)
+
+	generator := NewEventGenerator(3)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, store.Add(generator.Next()))
+	}
+
+	//Events are spread round robin across the aggregates
+	event, err := store.RetrieveEvent("order-1", 4)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "OrderPlaced", event.TypeCode)
+	}
+
+	event, err = store.RetrieveEvent("order-3", 3)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "OrderCancelled", event.TypeCode)
+	}
+
+	_, err = store.RetrieveEvent("order-2", 4)
+	assert.Equal(t, ErrEventNotFound, err)
+
+	last, _ := store.RetrieveLastFeed()
+	previous, _ := store.RetrievePreviousFeed(last)
+	assert.NotEqual(t, "", previous)
+	recent, _ := store.RetrieveRecent()
+	assert.Equal(t, 2, len(recent))
+}
@@ -9,28 +9,22 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	. "github.com/gucumber/gucumber"
 	"github.com/stretchr/testify/assert"
 	"github.com/xtracdev/envinject"
-	atomdata "github.com/xtracdev/es-atom-data-pg"
 	atompub "github.com/xtracdev/es-atom-pub-pg"
 	"github.com/xtracdev/goes"
-	"github.com/xtracdev/pgconn"
-	"github.com/xtracdev/pgpublish"
-	"golang.org/x/tools/blog/atom"
 )
 
 func init() {
 
-	var atomProcessor *atomdata.AtomDataProcessor
 	var initFailed bool
 	var feedData, eventData []byte
 	var feedID string
-	var feed atom.Feed
+	var feed atompub.Feed
 	var cacheControl string
 	var etag string
 	var eventID string
@@ -44,7 +38,7 @@ func init() {
 		initFailed = true
 	}
 
-	db, err := pgconn.OpenAndConnect(env, 1)
+	store, err := newTestStore(env)
 	if err != nil {
 		log.Warnf("Failed environment init: %s", err.Error())
 		initFailed = true
@@ -65,13 +59,8 @@ func init() {
 			return
 		}
 
-		log.Info("Create atom pub processor")
-		atomProcessor, _ = atomdata.NewAtomDataProcessor(db.DB, env)
-
-		log.Info("clean out tables")
-		_, err = db.Exec("delete from t_aeae_atom_event")
-		assert.Nil(T, err)
-		_, err = db.Exec("delete from t_aefd_feed")
+		log.Info("clean out events and feeds")
+		err = store.reset()
 		assert.Nil(T, err)
 
 		log.Info("add some events")
@@ -82,9 +71,7 @@ func init() {
 			Payload:  []byte("ok"),
 		}
 
-		encodedEvent := pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 		eventPtr = &goes.Event{
@@ -94,20 +81,18 @@ func init() {
 			Payload:  []byte("ok ok"),
 		}
 
-		encodedEvent = pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 	})
 
 	When(`^I do a get on the feed resource id$`, func() {
 		var err error
-		feedID, err = atomdata.RetrieveLastFeed(db.DB)
+		feedID, err = store.feedStore().RetrieveLastFeed()
 		assert.Nil(T, err)
 		log.Infof("get feed it %s", feedID)
 
-		archiveHandler, err := atompub.NewArchiveHandler(db.DB, "server:12345", env, atomEncrypter)
+		archiveHandler, err := atompub.NewArchiveHandler(store.feedStore(), "server:12345", env, atomEncrypter)
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -162,7 +147,7 @@ func init() {
 			}
 		}
 
-		assert.Equal(T, feedID, etag)
+		assert.Equal(T, fmt.Sprintf(`"%s"`, feedID), etag)
 	})
 
 	Given(`^feedX with prior and next feeds$`, func() {
@@ -174,9 +159,7 @@ func init() {
 			Payload:  []byte("ok"),
 		}
 
-		encodedEvent := pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 		eventPtr = &goes.Event{
@@ -186,18 +169,16 @@ func init() {
 			Payload:  []byte("ok ok"),
 		}
 
-		encodedEvent = pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
-		lastFeed, err := atomdata.RetrieveLastFeed(db.DB)
+		lastFeed, err := store.feedStore().RetrieveLastFeed()
 		assert.Nil(T, err)
 
-		prevOfLast, err := atomdata.RetrievePreviousFeed(db.DB, lastFeed)
+		prevOfLast, err := store.feedStore().RetrievePreviousFeed(lastFeed)
 		assert.Nil(T, err)
 
-		assert.Equal(T, feedID, prevOfLast.String)
+		assert.Equal(T, feedID, prevOfLast)
 
 		log.Info("add 2 more events")
 		eventPtr = &goes.Event{
@@ -207,9 +188,7 @@ func init() {
 			Payload:  []byte("ok"),
 		}
 
-		encodedEvent = pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 		eventPtr = &goes.Event{
@@ -219,9 +198,7 @@ func init() {
 			Payload:  []byte("ok ok"),
 		}
 
-		encodedEvent = pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 		//After this update latest feed will have assigned feed ids for both next
@@ -232,7 +209,7 @@ func init() {
 	When(`^I do a get on the feedX resource id$`, func() {
 		var err error
 
-		archiveHandler, err := atompub.NewArchiveHandler(db.DB, "server:12345", env, atomEncrypter)
+		archiveHandler, err := atompub.NewArchiveHandler(store.feedStore(), "server:12345", env, atomEncrypter)
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -260,7 +237,7 @@ func init() {
 	Then(`^all the events associated with the updated feed are returned$`, func() {
 		//Note that we order the events in the feed by id desc, so agg3 will be the second
 		//entry, agg4 will be the first entry.
-		feed = atom.Feed{}
+		feed = atompub.Feed{}
 		err = xml.Unmarshal(feedData, &feed)
 		if assert.Nil(T, err) && assert.Equal(T, 2, len(feed.Entry), "Should be 2 events in the current feed") {
 			log.Infof("got %v", feed.Entry)
@@ -271,22 +248,22 @@ func init() {
 	})
 
 	And(`^the previous link relationship refers to the previous feed$`, func() {
-		prevfeed, err := atomdata.RetrievePreviousFeed(db.DB, feedID)
-		if assert.Nil(T, err) && assert.True(T, prevfeed.Valid) {
+		prevfeed, err := store.feedStore().RetrievePreviousFeed(feedID)
+		if assert.Nil(T, err) && assert.NotEqual(T, "", prevfeed) {
 			prev := getLink("prev-archive", &feed)
 			if assert.NotNil(T, prev) {
-				assert.Equal(T, fmt.Sprintf("https://server:12345/notifications/%s", prevfeed.String), *prev)
+				assert.Equal(T, fmt.Sprintf("https://server:12345/notifications/%s", prevfeed), *prev)
 			}
 
 		}
 	})
 
 	And(`^the next link relationship refers to the next feed$`, func() {
-		nextfeed, err := atomdata.RetrieveNextFeed(db.DB, feedID)
-		if assert.Nil(T, err) && assert.True(T, nextfeed.Valid) {
+		nextfeed, err := store.feedStore().RetrieveNextFeed(feedID)
+		if assert.Nil(T, err) && assert.NotEqual(T, "", nextfeed) {
 			next := getLink("next-archive", &feed)
 			if assert.NotNil(T, next) {
-				assert.Equal(T, fmt.Sprintf("https://server:12345/notifications/%s", nextfeed.String), *next)
+				assert.Equal(T, fmt.Sprintf("https://server:12345/notifications/%s", nextfeed), *next)
 			}
 
 		}
@@ -301,7 +278,7 @@ func init() {
 	When(`^I retrieve the event by its id$`, func() {
 		var err error
 
-		eventHandler, err := atompub.NewEventRetrieveHandler(db.DB, atomEncrypter)
+		eventHandler, err := atompub.NewEventRetrieveHandler(store.feedStore(), env, atomEncrypter)
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -348,7 +325,7 @@ func init() {
 			}
 		}
 
-		assert.Equal(T, "agg3:1", etag)
+		assert.Equal(T, `"agg3:1"`, etag)
 	})
 
 }
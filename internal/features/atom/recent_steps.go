@@ -14,17 +14,12 @@ import (
 	. "github.com/gucumber/gucumber"
 	"github.com/stretchr/testify/assert"
 	"github.com/xtracdev/envinject"
-	atomdata "github.com/xtracdev/es-atom-data-pg"
 	atompub "github.com/xtracdev/es-atom-pub-pg"
 	"github.com/xtracdev/goes"
-	"github.com/xtracdev/pgconn"
-	"github.com/xtracdev/pgpublish"
-	"golang.org/x/tools/blog/atom"
 )
 
 func init() {
 	var initFailed bool
-	var atomProcessor *atomdata.AtomDataProcessor
 	var atomEncrypter *atompub.AtomEncrypter
 
 	log.Info("Init test envionment")
@@ -35,14 +30,14 @@ func init() {
 		initFailed = true
 	}
 
-	db, err := pgconn.OpenAndConnect(env, 1)
+	store, err := newTestStore(env)
 	if err != nil {
 		log.Warnf("Failed environment init: %s", err.Error())
 		initFailed = true
 	}
 
 	var feedData []byte
-	var feed atom.Feed
+	var feed atompub.Feed
 	var cacheControl string
 
 	os.Unsetenv(atompub.KeyAlias)
@@ -60,13 +55,8 @@ func init() {
 			return
 		}
 
-		atomProcessor, _ = atomdata.NewAtomDataProcessor(db.DB, env)
-		assert.Nil(T, err, "Failed to initialize atom publisher")
-
-		log.Info("clean out tables")
-		_, err = db.Exec("delete from t_aeae_atom_event")
-		assert.Nil(T, err)
-		_, err = db.Exec("delete from t_aefd_feed")
+		log.Info("clean out events and feeds")
+		err = store.reset()
 		assert.Nil(T, err)
 
 		log.Info("add some events")
@@ -77,9 +67,7 @@ func init() {
 			Payload:  []byte("ok"),
 		}
 
-		encodedEvent := pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 	})
 
@@ -89,7 +77,7 @@ func init() {
 
 	When(`^I retrieve the recent resource$`, func() {
 		//Create a test server
-		recentHandler, err := atompub.NewRecentHandler(db.DB, "server:12345", env, atomEncrypter)
+		recentHandler, err := atompub.NewRecentHandler(store.feedStore(), "server:12345", env, atomEncrypter)
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -119,7 +107,7 @@ func init() {
 			feedEntry := feed.Entry[0]
 			assert.Equal(T, "event", feedEntry.Title)
 			assert.Equal(T, fmt.Sprintf("urn:esid:%s:%d", "agg1", 1), feedEntry.ID)
-			assert.Equal(T, "foo", feedEntry.Content.Type)
+			assert.Equal(T, "foo", feedEntry.TypeCode())
 			assert.Equal(T, base64.StdEncoding.EncodeToString([]byte("ok")), feedEntry.Content.Body)
 			_, err = time.Parse(time.RFC3339Nano, string(feedEntry.Published))
 			assert.Nil(T, err)
@@ -146,9 +134,7 @@ func init() {
 			Payload:  []byte("ok ok"),
 		}
 
-		encodedEvent := pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 
 		eventPtr = &goes.Event{
@@ -158,9 +144,7 @@ func init() {
 			Payload:  []byte("ok ok ok"),
 		}
 
-		encodedEvent = pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version,
-			(eventPtr.Payload).([]byte), eventPtr.TypeCode, time.Now())
-		err = atomProcessor.ProcessMessage(encodedEvent)
+		err = store.publish(eventPtr)
 		assert.Nil(T, err)
 	})
 
@@ -170,7 +154,7 @@ func init() {
 	})
 
 	When(`^I again retrieve the recent resource$`, func() {
-		recentHandler, err := atompub.NewRecentHandler(db.DB, "server:12345", env, atomEncrypter)
+		recentHandler, err := atompub.NewRecentHandler(store.feedStore(), "server:12345", env, atomEncrypter)
 		if !assert.Nil(T, err) {
 			return
 		}
@@ -191,7 +175,7 @@ func init() {
 
 		assert.True(T, len(feedData) > 0, "Empty feed data returned unexpectedly")
 
-		feed = atom.Feed{}
+		feed = atompub.Feed{}
 		err = xml.Unmarshal(feedData, &feed)
 		assert.Nil(T, err)
 	})
@@ -201,7 +185,7 @@ func init() {
 			feedEntry := feed.Entry[0]
 			assert.Equal(T, "event", feedEntry.Title)
 			assert.Equal(T, fmt.Sprintf("urn:esid:%s:%d", "agg3", 1), feedEntry.ID)
-			assert.Equal(T, "baz", feedEntry.Content.Type)
+			assert.Equal(T, "baz", feedEntry.TypeCode())
 			assert.Equal(T, base64.StdEncoding.EncodeToString([]byte("ok ok ok")), feedEntry.Content.Body)
 			_, err = time.Parse(time.RFC3339Nano, string(feedEntry.Published))
 			assert.Nil(T, err)
@@ -0,0 +1,102 @@
+package atom
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	atompub "github.com/xtracdev/es-atom-pub-pg"
+	"github.com/xtracdev/goes"
+	"github.com/xtracdev/pgconn"
+	"github.com/xtracdev/pgpublish"
+)
+
+//testStore is the event store the scenarios run against. Set FEED_STORE=memory to run the
+//scenarios against an in-memory store instead of Postgres.
+type testStore interface {
+	//reset removes all events and feeds
+	reset() error
+
+	//publish adds an event, assigning the recent events to a feed once FEED_THRESHOLD is reached
+	publish(event *goes.Event) error
+
+	//feedStore returns the store to pass to the handlers
+	feedStore() atompub.FeedStore
+}
+
+func newTestStore(env *envinject.InjectedEnv) (testStore, error) {
+	if os.Getenv("FEED_STORE") == "memory" {
+		threshold, err := strconv.Atoi(env.Getenv("FEED_THRESHOLD"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &memoryTestStore{threshold: threshold}, nil
+	}
+
+	db, err := pgconn.OpenAndConnect(env, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := atompub.NewPGFeedStore(db.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgTestStore{db: db, env: env, store: store}, nil
+}
+
+type pgTestStore struct {
+	db            *pgconn.PostgresDB
+	env           *envinject.InjectedEnv
+	store         *atompub.PGFeedStore
+	atomProcessor *atomdata.AtomDataProcessor
+}
+
+func (s *pgTestStore) reset() error {
+	var err error
+	s.atomProcessor, err = atomdata.NewAtomDataProcessor(s.db.DB, s.env)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("delete from t_aeae_atom_event")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("delete from t_aefd_feed")
+	return err
+}
+
+func (s *pgTestStore) publish(event *goes.Event) error {
+	encodedEvent := pgpublish.EncodePGEvent(event.Source, event.Version,
+		(event.Payload).([]byte), event.TypeCode, time.Now())
+	return s.atomProcessor.ProcessMessage(encodedEvent)
+}
+
+func (s *pgTestStore) feedStore() atompub.FeedStore {
+	return s.store
+}
+
+type memoryTestStore struct {
+	threshold int
+	store     *atompub.MemoryFeedStore
+}
+
+func (s *memoryTestStore) reset() error {
+	s.store = atompub.NewMemoryFeedStore()
+	s.store.SetFeedThreshold(s.threshold)
+	return nil
+}
+
+func (s *memoryTestStore) publish(event *goes.Event) error {
+	return s.store.Add(atomdata.TimestampedEvent{Event: *event, Timestamp: time.Now()})
+}
+
+func (s *memoryTestStore) feedStore() atompub.FeedStore {
+	return s.store
+}
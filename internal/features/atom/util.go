@@ -1,8 +1,8 @@
 package atom
 
-import "golang.org/x/tools/blog/atom"
+import atompub "github.com/xtracdev/es-atom-pub-pg"
 
-func getLink(linkRelationship string, feed *atom.Feed) *string {
+func getLink(linkRelationship string, feed *atompub.Feed) *string {
 	for _, l := range feed.Link {
 		if l.Rel == linkRelationship {
 			return &l.Href
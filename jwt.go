@@ -0,0 +1,300 @@
+package esatompubpg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("Invalid bearer token")
+var ErrTokenExpired = errors.New("Bearer token expired or not yet valid")
+var ErrUnknownSigningKey = errors.New("Bearer token signed with an unknown key")
+var ErrUnsupportedAlgorithm = errors.New("Unsupported bearer token signing algorithm")
+var ErrMalformedJWKS = errors.New("Malformed JSON web key set")
+var ErrWeakSigningKey = errors.New("RSA signing key shorter than 2048 bits")
+
+//jwtLeeway allows for clock skew when checking token expiry, and RSA keys shorter than
+//minRSAKeyBits are refused
+const (
+	jwtLeeway     = 30 * time.Second
+	minRSAKeyBits = 2048
+)
+
+//jwtAlgorithms maps the supported JWS algorithms to their hashes. Only asymmetric algorithms
+//are supported, as the keys are public keys from a key set.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+//jwtCurves maps the ECDSA algorithms to the curves they are defined for, so a token can't pick
+//a hash that doesn't match the strength of the key
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+//jwk is a JSON web key, with the fields used by RSA and EC public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//jwtVerifier verifies bearer tokens signed with the keys of a JSON web key set, optionally
+//requiring a given issuer and audience.
+type jwtVerifier struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func newJWTVerifier(jwks io.Reader, issuer string, audience string) (*jwtVerifier, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.NewDecoder(jwks).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	v := &jwtVerifier{
+		keys:     make(map[string]crypto.PublicKey),
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, err
+		}
+
+		v.keys[key.Kid] = publicKey
+	}
+
+	if len(v.keys) == 0 {
+		return nil, ErrMalformedJWKS
+	}
+
+	return v, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, ErrMalformedJWKS
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, ErrMalformedJWKS
+		}
+
+		if n.BitLen() < minRSAKeyBits {
+			return nil, ErrWeakSigningKey
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrMalformedJWKS
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, ErrMalformedJWKS
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, ErrMalformedJWKS
+}
+
+//jwtClaims are the registered claims checked by the verifier. The audience may be a string or
+//an array of strings.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if json.Unmarshal(c.Audience, &single) == nil {
+		return single == audience
+	}
+
+	var multiple []string
+	if json.Unmarshal(c.Audience, &multiple) == nil {
+		for _, aud := range multiple {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//verify checks the token signature and claims, returning the token subject
+func (v *jwtVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return "", ErrUnknownSigningKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	//The key type must match the algorithm, and an EC key's curve the algorithm's, so a key
+	//can't be used with an algorithm it wasn't meant for
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return "", ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if jwtCurves[header.Alg] != key.Curve.Params().Name || len(signature) != 2*size {
+			return "", ErrInvalidToken
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return "", ErrInvalidToken
+		}
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+
+	//Tokens must expire, so a leaked token can't be used indefinitely
+	if claims.ExpiresAt == nil {
+		return "", ErrInvalidToken
+	}
+
+	now := v.now()
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return "", ErrTokenExpired
+	}
+
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-jwtLeeway)) {
+		return "", ErrTokenExpired
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return "", ErrInvalidToken
+	}
+
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return "", ErrInvalidToken
+	}
+
+	if claims.Subject == "" {
+		return "", ErrInvalidToken
+	}
+
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(decoded, v); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSigningKeys struct {
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	ec384 *ecdsa.PrivateKey
+}
+
+func newTestSigningKeys(t *testing.T) *testSigningKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testSigningKeys{rsa: rsaKey, ec: ecKey, ec384: ec384Key}
+}
+
+func (k *testSigningKeys) jwks() []byte {
+	b64 := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+
+	set := map[string][]map[string]string{
+		"keys": {
+			{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(k.rsa.N), "e": b64(big.NewInt(int64(k.rsa.E)))},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(k.ec.X), "y": b64(k.ec.Y)},
+			{"kty": "EC", "kid": "ec2", "crv": "P-384", "x": b64(k.ec384.X), "y": b64(k.ec384.Y)},
+		},
+	}
+
+	out, _ := json.Marshal(set)
+	return out
+}
+
+//sign creates a token with the given claims, signed by the key with the given id. EC tokens
+//are signed with the P-384 key for ec2 and the P-256 key otherwise, whatever the algorithm.
+func (k *testSigningKeys) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		t.Fatalf("no hash for %s", alg)
+	}
+	digest := hash.New()
+	digest.Write([]byte(signingInput))
+
+	var signature []byte
+	var err error
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, hash, digest.Sum(nil))
+	case strings.HasPrefix(alg, "ES"):
+		key := k.ec
+		if kid == "ec2" {
+			key = k.ec384
+		}
+
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		if err == nil {
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(signature[size-len(rb):size], rb)
+			copy(signature[2*size-len(sb):], sb)
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims(sub string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub": sub,
+		"iss": "https://issuer.example.com",
+		"aud": []string{"atompub", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	v, err := newJWTVerifier(bytes.NewReader(keys.jwks()), "https://issuer.example.com", "atompub")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sub, err := v.verify(keys.sign(t, "RS256", "rsa1", validClaims("billing")))
+	assert.Nil(t, err)
+	assert.Equal(t, "billing", sub)
+
+	sub, err = v.verify(keys.sign(t, "ES256", "ec1", validClaims("audit")))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", sub)
+
+	claims := validClaims("billing")
+	claims["aud"] = "atompub"
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Nil(t, err)
+
+	//Tokens must be signed by a key in the set with the algorithm for that key
+	_, err = v.verify(keys.sign(t, "RS256", "nope", validClaims("billing")))
+	assert.Equal(t, ErrUnknownSigningKey, err)
+	_, err = v.verify(keys.sign(t, "ES256", "rsa1", validClaims("billing")))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	token := keys.sign(t, "RS256", "rsa1", validClaims("billing"))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(validClaims("admin"))
+	_, err = v.verify(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2])
+	assert.Equal(t, ErrInvalidToken, err)
+
+	none, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa1"})
+	_, err = v.verify(base64.RawURLEncoding.EncodeToString(none) + "." + parts[1] + ".")
+	assert.Equal(t, ErrUnsupportedAlgorithm, err)
+
+	_, err = v.verify("not a token")
+	assert.Equal(t, ErrInvalidToken, err)
+
+	//Claims are checked
+	claims = validClaims("billing")
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	claims = validClaims("billing")
+	claims["nbf"] = time.Now().Add(time.Hour).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	claims = validClaims("billing")
+	delete(claims, "exp")
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	claims = validClaims("billing")
+	claims["iss"] = "https://elsewhere.example.com"
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	claims = validClaims("billing")
+	claims["aud"] = "other"
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = newJWTVerifier(strings.NewReader(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`), "", "")
+	assert.Equal(t, ErrMalformedJWKS, err)
+	_, err = newJWTVerifier(strings.NewReader(`{"keys":[]}`), "", "")
+	assert.Equal(t, ErrMalformedJWKS, err)
+}
+
+func TestJWTAlgorithmMustMatchCurve(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	v, err := newJWTVerifier(bytes.NewReader(keys.jwks()), "", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	sub, err := v.verify(keys.sign(t, "ES384", "ec2", validClaims("audit")))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", sub)
+
+	//Signatures made with the right key but the hash of another curve are refused
+	_, err = v.verify(keys.sign(t, "ES384", "ec1", validClaims("audit")))
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = v.verify(keys.sign(t, "ES512", "ec1", validClaims("audit")))
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = v.verify(keys.sign(t, "ES256", "ec2", validClaims("audit")))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	//As are EC keys used with RSA algorithms
+	_, err = v.verify(keys.sign(t, "RS256", "ec1", validClaims("audit")))
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestJWTBadSignature(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	v, err := newJWTVerifier(bytes.NewReader(keys.jwks()), "", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	//A token signed by another key with the same id
+	other := newTestSigningKeys(t)
+	for _, kid := range []string{"rsa1", "ec1", "ec2"} {
+		alg := map[string]string{"rsa1": "RS256", "ec1": "ES256", "ec2": "ES384"}[kid]
+		_, err = v.verify(other.sign(t, alg, kid, validClaims("billing")))
+		assert.Equal(t, ErrInvalidToken, err, kid)
+
+		parts := strings.Split(keys.sign(t, alg, kid, validClaims("billing")), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		signature[len(signature)-1] ^= 1
+		_, err = v.verify(parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature))
+		assert.Equal(t, ErrInvalidToken, err, kid)
+
+		_, err = v.verify(parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature[1:]))
+		assert.Equal(t, ErrInvalidToken, err, kid)
+
+		_, err = v.verify(parts[0] + "." + parts[1] + ".!!")
+		assert.Equal(t, ErrInvalidToken, err, kid)
+	}
+}
+
+func TestJWTClaimsWithinLeeway(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	v, err := newJWTVerifier(bytes.NewReader(keys.jwks()), "", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	claims := validClaims("billing")
+	claims["exp"] = now.Add(-jwtLeeway / 2).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Nil(t, err)
+
+	claims["exp"] = now.Add(-2 * jwtLeeway).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrTokenExpired, err)
+
+	claims = validClaims("billing")
+	claims["nbf"] = now.Add(jwtLeeway / 2).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Nil(t, err)
+
+	claims["nbf"] = now.Add(2 * jwtLeeway).Unix()
+	_, err = v.verify(keys.sign(t, "RS256", "rsa1", claims))
+	assert.Equal(t, ErrTokenExpired, err)
+}
+
+func TestJWKSRefusesWeakRSAKeys(t *testing.T) {
+	b64 := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+
+	jwks := func(bits uint) string {
+		n := new(big.Int).Lsh(big.NewInt(1), bits-1)
+		n.SetBit(n, 0, 1)
+		return `{"keys":[{"kty":"RSA","kid":"rsa1","n":"` + b64(n) + `","e":"AQAB"}]}`
+	}
+
+	_, err := newJWTVerifier(strings.NewReader(jwks(1024)), "", "")
+	assert.Equal(t, ErrWeakSigningKey, err)
+	_, err = newJWTVerifier(strings.NewReader(jwks(2047)), "", "")
+	assert.Equal(t, ErrWeakSigningKey, err)
+	_, err = newJWTVerifier(strings.NewReader(jwks(2048)), "", "")
+	assert.Nil(t, err)
+}
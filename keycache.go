@@ -0,0 +1,177 @@
+package esatompubpg
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+)
+
+//Environment variables used to configure data key caching. Data keys are reused for up to
+//KEY_CACHE_MAX_MESSAGES messages or KEY_CACHE_MAX_AGE (a duration such as 5m), whichever comes
+//first. If neither is set, a new data key is generated for every message.
+const (
+	KeyCacheMaxMessages = "KEY_CACHE_MAX_MESSAGES"
+	KeyCacheMaxAge      = "KEY_CACHE_MAX_AGE"
+)
+
+//Data key cache counters, exposed via expvar as atompub.keycache
+var (
+	keyCacheHits      = new(expvar.Int)
+	keyCacheMisses    = new(expvar.Int)
+	keyCacheRotations = new(expvar.Int)
+)
+
+func init() {
+	stats := expvar.NewMap("atompub.keycache")
+	stats.Set("hits", keyCacheHits)
+	stats.Set("misses", keyCacheMisses)
+	stats.Set("rotations", keyCacheRotations)
+}
+
+//dataKeyCache hands out a data key for reuse until it has been used for maxMessages messages
+//or is older than maxAge, at which point a new key is generated and the old one zeroized.
+type dataKeyCache struct {
+	sync.Mutex
+	keyProvider KeyProvider
+	maxMessages int
+	maxAge      time.Duration
+	current     *DataKey
+	uses        int
+	created     time.Time
+	generation  int
+	expiryTimer *time.Timer
+	now         func() time.Time
+	afterFunc   func(time.Duration, func()) *time.Timer
+}
+
+func newDataKeyCache(keyProvider KeyProvider, maxMessages int, maxAge time.Duration) *dataKeyCache {
+	return &dataKeyCache{
+		keyProvider: keyProvider,
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		now:         time.Now,
+		afterFunc:   time.AfterFunc,
+	}
+}
+
+func (c *dataKeyCache) expired() bool {
+	if c.current == nil {
+		return true
+	}
+
+	if c.maxMessages > 0 && c.uses >= c.maxMessages {
+		return true
+	}
+
+	if c.maxAge > 0 && c.now().Sub(c.created) >= c.maxAge {
+		return true
+	}
+
+	return false
+}
+
+//dataKey returns a copy of the current plaintext key along with a description of the key
+//minus its plaintext, rotating the key first if needed.
+func (c *dataKeyCache) dataKey() ([32]byte, *DataKey, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var key [32]byte
+
+	if c.expired() {
+		if c.current != nil {
+			keyCacheRotations.Add(1)
+			c.evict()
+		}
+
+		keyCacheMisses.Add(1)
+		dataKey, err := c.keyProvider.GenerateDataKey()
+		if err != nil {
+			return key, nil, err
+		}
+
+		if len(dataKey.Plaintext) < 32 {
+			dataKey.zero()
+			return key, nil, ErrInvalidDataKey
+		}
+
+		c.current = dataKey
+		c.uses = 0
+		c.created = c.now()
+		c.generation++
+
+		//Make sure the key doesn't hang around in memory past its age limit when
+		//there's no traffic to trigger a rotation.
+		if c.maxAge > 0 {
+			generation := c.generation
+			c.expiryTimer = c.afterFunc(c.maxAge, func() {
+				c.expire(generation)
+			})
+		}
+	} else {
+		keyCacheHits.Add(1)
+	}
+
+	c.uses++
+	copy(key[:], c.current.Plaintext[0:32])
+	return key, c.current.withoutPlaintext(), nil
+}
+
+func (c *dataKeyCache) expire(generation int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.generation == generation && c.current != nil {
+		log.Debugf("Zeroizing expired data key")
+		c.evict()
+	}
+}
+
+//evict zeroizes and drops the current key. The caller must hold the lock.
+func (c *dataKeyCache) evict() {
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+		c.expiryTimer = nil
+	}
+
+	c.current.zero()
+	c.current = nil
+}
+
+//CacheDataKeys configures the encrypter to reuse each data key for up to maxMessages
+//messages or maxAge, whichever comes first. A zero value disables the corresponding limit;
+//if both are zero data keys are not cached.
+func (ae *AtomEncrypter) CacheDataKeys(maxMessages int, maxAge time.Duration) {
+	if ae.keyProvider == nil || (maxMessages <= 0 && maxAge <= 0) {
+		ae.keyCache = nil
+		return
+	}
+
+	ae.keyCache = newDataKeyCache(ae.keyProvider, maxMessages, maxAge)
+}
+
+func keyCacheConfigFromEnv(env *envinject.InjectedEnv) (int, time.Duration, error) {
+	var maxMessages int
+	var maxAge time.Duration
+	var err error
+
+	if val := env.Getenv(KeyCacheMaxMessages); val != "" {
+		maxMessages, err = strconv.Atoi(val)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if val := env.Getenv(KeyCacheMaxAge); val != "" {
+		maxAge, err = time.ParseDuration(val)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return maxMessages, maxAge, nil
+}
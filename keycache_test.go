@@ -0,0 +1,141 @@
+package esatompubpg
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+//countingKeyProvider wraps a key provider, recording the keys it generates
+type countingKeyProvider struct {
+	KeyProvider
+	generated [][]byte
+}
+
+func (kp *countingKeyProvider) GenerateDataKey() (*DataKey, error) {
+	dataKey, err := kp.KeyProvider.GenerateDataKey()
+	if err == nil {
+		kp.generated = append(kp.generated, dataKey.Plaintext)
+	}
+	return dataKey, err
+}
+
+func newCountingKeyProvider(t *testing.T) *countingKeyProvider {
+	kp, err := NewLocalKeyProvider(testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &countingKeyProvider{KeyProvider: kp}
+}
+
+func isZeroed(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKeyCacheRotatesAfterMaxMessages(t *testing.T) {
+	kp := newCountingKeyProvider(t)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.CacheDataKeys(3, 0)
+
+	hits := keyCacheHits.Value()
+	rotations := keyCacheRotations.Value()
+
+	for i := 0; i < 3; i++ {
+		out, err := ae.EncryptOutput([]byte("content"))
+		if assert.Nil(t, err) {
+			assert.Equal(t, "content", string(decryptTestOutput(t, kp, out)))
+		}
+	}
+
+	assert.Equal(t, 1, len(kp.generated))
+	assert.Equal(t, hits+2, keyCacheHits.Value())
+	assert.False(t, isZeroed(kp.generated[0]))
+
+	_, err := ae.EncryptOutput([]byte("content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(kp.generated))
+	assert.Equal(t, rotations+1, keyCacheRotations.Value())
+	assert.True(t, isZeroed(kp.generated[0]))
+}
+
+func TestKeyCacheRotatesAfterMaxAge(t *testing.T) {
+	kp := newCountingKeyProvider(t)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.CacheDataKeys(0, time.Minute)
+
+	now := time.Now()
+	var expire func()
+	ae.keyCache.now = func() time.Time { return now }
+	ae.keyCache.afterFunc = func(d time.Duration, f func()) *time.Timer {
+		assert.Equal(t, time.Minute, d)
+		expire = f
+		return nil
+	}
+
+	_, err := ae.EncryptOutput([]byte("content"))
+	assert.Nil(t, err)
+	_, err = ae.EncryptOutput([]byte("content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(kp.generated))
+
+	now = now.Add(time.Minute)
+	_, err = ae.EncryptOutput([]byte("content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(kp.generated))
+	assert.True(t, isZeroed(kp.generated[0]))
+
+	//Expiry with no traffic zeroizes the current key
+	if assert.NotNil(t, expire) {
+		expire()
+		assert.True(t, isZeroed(kp.generated[1]))
+		assert.Nil(t, ae.keyCache.current)
+	}
+
+	_, err = ae.EncryptOutput([]byte("content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(kp.generated))
+}
+
+func TestKeyCacheDisabled(t *testing.T) {
+	kp := newCountingKeyProvider(t)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.CacheDataKeys(0, 0)
+
+	for i := 0; i < 3; i++ {
+		_, err := ae.EncryptOutput([]byte("content"))
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 3, len(kp.generated))
+	for _, key := range kp.generated {
+		assert.True(t, isZeroed(key))
+	}
+}
+
+func TestKeyCacheConfigFromEnv(t *testing.T) {
+	defer os.Unsetenv(KeyCacheMaxMessages)
+	defer os.Unsetenv(KeyCacheMaxAge)
+
+	os.Setenv(KeyCacheMaxMessages, "100")
+	os.Setenv(KeyCacheMaxAge, "5m")
+	env, _ := envinject.NewInjectedEnv()
+
+	maxMessages, maxAge, err := keyCacheConfigFromEnv(env)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 100, maxMessages)
+		assert.Equal(t, 5*time.Minute, maxAge)
+	}
+
+	os.Setenv(KeyCacheMaxAge, "five minutes")
+	_, _, err = keyCacheConfigFromEnv(env)
+	assert.NotNil(t, err)
+}
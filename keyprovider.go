@@ -0,0 +1,190 @@
+package esatompubpg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+)
+
+//Environment variables used to select and configure the key provider
+const (
+	KeyProviderType = "KEY_PROVIDER"
+	KeyFile         = "KEY_FILE"
+	LocalKey        = "LOCAL_KEY"
+)
+
+//Key provider types that may be specified via KEY_PROVIDER
+const (
+	KMSKeyProviderType   = "kms"
+	LocalKeyProviderType = "local"
+)
+
+var ErrUnknownKeyProvider = errors.New("Unknown key provider type")
+var ErrMissingKeyAlias = errors.New("KEY_ALIAS must be specified for the kms key provider")
+var ErrMissingLocalKey = errors.New("KEY_FILE or LOCAL_KEY must be specified for the local key provider")
+var ErrInvalidDataKey = errors.New("Data keys must be 32 bytes long")
+
+//KeyProvider generates the data keys used to encrypt feed output, and decrypts the encrypted
+//form of those data keys so consumers can decrypt the output.
+type KeyProvider interface {
+	GenerateDataKey() (*DataKey, error)
+	DecryptDataKey(encryptedKey []byte) ([]byte, error)
+}
+
+//DataKey holds a generated data key in both plaintext and encrypted form. The plaintext is used
+//to encrypt output, the encrypted form is sent along with the output. Provider and KeyID
+//identify the key provider and master key used to encrypt the data key.
+type DataKey struct {
+	Plaintext    []byte
+	EncryptedKey []byte
+	Provider     string
+	KeyID        string
+}
+
+func (dk *DataKey) zero() {
+	for i := range dk.Plaintext {
+		dk.Plaintext[i] = 0
+	}
+	dk.Plaintext = nil
+}
+
+//withoutPlaintext returns a copy of the data key with the plaintext omitted
+func (dk *DataKey) withoutPlaintext() *DataKey {
+	return &DataKey{
+		EncryptedKey: dk.EncryptedKey,
+		Provider:     dk.Provider,
+		KeyID:        dk.KeyID,
+	}
+}
+
+//NewKeyProvider returns the key provider selected via KEY_PROVIDER. If KEY_PROVIDER is not set,
+//the kms provider is used when KEY_ALIAS is set, the local provider is used when KEY_FILE or
+//LOCAL_KEY is set, and nil is returned otherwise, which means output is not encrypted.
+func NewKeyProvider(env *envinject.InjectedEnv) (KeyProvider, error) {
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	providerType := strings.ToLower(env.Getenv(KeyProviderType))
+	if providerType == "" {
+		switch {
+		case env.Getenv(KeyAlias) != "":
+			providerType = KMSKeyProviderType
+		case env.Getenv(KeyFile) != "" || env.Getenv(LocalKey) != "":
+			providerType = LocalKeyProviderType
+		default:
+			return nil, nil
+		}
+	}
+
+	log.Infof("Using %s key provider", providerType)
+
+	switch providerType {
+	case KMSKeyProviderType:
+		return newKMSKeyProviderFromEnv(env)
+	case LocalKeyProviderType:
+		return newLocalKeyProviderFromEnv(env)
+	default:
+		return nil, ErrUnknownKeyProvider
+	}
+}
+
+//keyProviderType returns the type of the key provider, for reporting its errors
+func keyProviderType(kp KeyProvider) string {
+	switch kp.(type) {
+	case *KMSKeyProvider:
+		return KMSKeyProviderType
+	case *LocalKeyProvider:
+		return LocalKeyProviderType
+	default:
+		return "custom"
+	}
+}
+
+//LocalKeyProvider generates data keys locally, protecting them with a static master key. This is
+//intended for tests and on-prem deployments where KMS is not available.
+type LocalKeyProvider struct {
+	masterKey [32]byte
+	keyID     string
+}
+
+//NewLocalKeyProvider creates a key provider using the given 32 byte master key.
+func NewLocalKeyProvider(masterKey []byte) (*LocalKeyProvider, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidDataKey
+	}
+
+	kp := new(LocalKeyProvider)
+	copy(kp.masterKey[:], masterKey)
+
+	//Identify the master key by a fingerprint so consumers can tell which key to use
+	fingerprint := sha256.Sum256(masterKey)
+	kp.keyID = hex.EncodeToString(fingerprint[:8])
+
+	return kp, nil
+}
+
+//NewLocalKeyProviderFromFile creates a key provider using the base64 encoded master key
+//read from the given file.
+func NewLocalKeyProviderFromFile(keyFile string) (*LocalKeyProvider, error) {
+	encodedKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocalKeyProviderFromEncodedKey(string(encodedKey))
+}
+
+func newLocalKeyProviderFromEncodedKey(encodedKey string) (*LocalKeyProvider, error) {
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLocalKeyProvider(masterKey)
+}
+
+func newLocalKeyProviderFromEnv(env *envinject.InjectedEnv) (KeyProvider, error) {
+	if keyFile := env.Getenv(KeyFile); keyFile != "" {
+		log.Infof("Reading local master key from %s", keyFile)
+		return NewLocalKeyProviderFromFile(keyFile)
+	}
+
+	if encodedKey := env.Getenv(LocalKey); encodedKey != "" {
+		return newLocalKeyProviderFromEncodedKey(encodedKey)
+	}
+
+	return nil, ErrMissingLocalKey
+}
+
+func (kp *LocalKeyProvider) GenerateDataKey() (*DataKey, error) {
+	plaintext := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := encrypt(plaintext, &kp.masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		Plaintext:    plaintext,
+		EncryptedKey: encryptedKey,
+		Provider:     LocalKeyProviderType,
+		KeyID:        kp.keyID,
+	}, nil
+}
+
+func (kp *LocalKeyProvider) DecryptDataKey(encryptedKey []byte) ([]byte, error) {
+	return decrypt(encryptedKey, &kp.masterKey)
+}
@@ -0,0 +1,175 @@
+package esatompubpg
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"golang.org/x/tools/blog/atom"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func decryptTestOutput(t *testing.T, kp KeyProvider, out []byte) []byte {
+	plaintext, err := DecryptOutput(out, kp)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	return plaintext
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	kp, err := NewLocalKeyProvider(testMasterKey)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	dataKey, err := kp.GenerateDataKey()
+	if assert.Nil(t, err) {
+		assert.Equal(t, 32, len(dataKey.Plaintext))
+		assert.NotEqual(t, dataKey.Plaintext, dataKey.EncryptedKey)
+
+		decrypted, err := kp.DecryptDataKey(dataKey.EncryptedKey)
+		if assert.Nil(t, err) {
+			assert.Equal(t, dataKey.Plaintext, decrypted)
+		}
+	}
+
+	_, err = NewLocalKeyProvider([]byte("too short"))
+	assert.Equal(t, ErrInvalidDataKey, err)
+
+	other, _ := NewLocalKeyProvider([]byte("fedcba9876543210fedcba9876543210"))
+	_, err = other.DecryptDataKey(dataKey.EncryptedKey)
+	assert.NotNil(t, err)
+}
+
+func TestNewKeyProviderFromEnv(t *testing.T) {
+	defer os.Unsetenv(KeyProviderType)
+	defer os.Unsetenv(LocalKey)
+	defer os.Unsetenv(KeyFile)
+
+	os.Unsetenv(KeyAlias)
+	os.Unsetenv(KeyFile)
+	os.Unsetenv(LocalKey)
+	os.Unsetenv(KeyProviderType)
+	env, _ := envinject.NewInjectedEnv()
+
+	kp, err := NewKeyProvider(env)
+	assert.Nil(t, err)
+	assert.Nil(t, kp)
+
+	os.Setenv(LocalKey, base64.StdEncoding.EncodeToString(testMasterKey))
+	kp, err = NewKeyProvider(env)
+	if assert.Nil(t, err) {
+		assert.IsType(t, &LocalKeyProvider{}, kp)
+	}
+
+	os.Unsetenv(LocalKey)
+	keyFile, err := ioutil.TempFile("", "keyfile")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(base64.StdEncoding.EncodeToString(testMasterKey) + "\n")
+	keyFile.Close()
+
+	os.Setenv(KeyFile, keyFile.Name())
+	kp, err = NewKeyProvider(env)
+	if assert.Nil(t, err) {
+		assert.IsType(t, &LocalKeyProvider{}, kp)
+	}
+
+	os.Unsetenv(KeyFile)
+	os.Setenv(KeyProviderType, LocalKeyProviderType)
+	_, err = NewKeyProvider(env)
+	assert.Equal(t, ErrMissingLocalKey, err)
+
+	os.Setenv(KeyProviderType, KMSKeyProviderType)
+	_, err = NewKeyProvider(env)
+	assert.Equal(t, ErrMissingKeyAlias, err)
+
+	os.Setenv(KeyProviderType, "vault")
+	_, err = NewKeyProvider(env)
+	assert.Equal(t, ErrUnknownKeyProvider, err)
+}
+
+func TestEncryptOutputWithLocalKeyProvider(t *testing.T) {
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+
+	out, err := ae.EncryptOutput([]byte("some feed content"))
+	if assert.Nil(t, err) {
+		assert.False(t, strings.Contains(string(out), "some feed content"))
+		assert.Equal(t, "some feed content", string(decryptTestOutput(t, kp, out)))
+	}
+
+	plain := NewAtomEncrypterWithKeyProvider(nil)
+	out, err = plain.EncryptOutput([]byte("some feed content"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "some feed content", string(out))
+	}
+}
+
+func TestEncryptedRecentFeed(t *testing.T) {
+	defer os.Unsetenv(LocalKey)
+	os.Unsetenv(KeyAlias)
+	os.Setenv(LocalKey, base64.StdEncoding.EncodeToString(testMasterKey))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+			AddRow([]driver.Value{time.Now(), "1x2x333", 3, "foo", []byte("yeah ok")}...),
+	)
+	mock.ExpectQuery("select feedid").WillReturnRows(
+		sqlmock.NewRows([]string{"feedid"}).AddRow("feed-xxx"),
+	)
+
+	env, _ := envinject.NewInjectedEnv()
+	ae, err := NewAtomEncrypter(env)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	recentHandler, err := NewRecentHandler(pgFeedStore(t, db), "testhost:12345", env, ae)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+
+	r, err := http.NewRequest("GET", RecentHandlerURI, nil)
+	assert.Nil(t, err)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	feedData := decryptTestOutput(t, kp, w.Body.Bytes())
+
+	var feed atom.Feed
+	err = xml.Unmarshal(feedData, &feed)
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(feed.Entry)) {
+		assert.Equal(t, "urn:esid:1x2x333:3", feed.Entry[0].ID)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
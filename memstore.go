@@ -0,0 +1,266 @@
+package esatompubpg
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrDuplicateEvent = errors.New("Event with the same aggregate id and version already added")
+var ErrDuplicateFeed = errors.New("Feed id already in use")
+var ErrInvalidFeedID = errors.New("Invalid feed id")
+var ErrNoRecentEvents = errors.New("No recent events to assign to a feed")
+var ErrInvalidPayload = errors.New("Event payload must be a byte slice")
+
+//MemoryFeedStore is an in-memory feed store for tests and local development. Events are added
+//to the recent page with Add, and assigned to a new feed with CreateFeed, or automatically
+//once the feed threshold is reached. The store is also a notifier, signalling subscribers when
+//events are added and feeds are created.
+type MemoryFeedStore struct {
+	broadcaster
+	mu            sync.RWMutex
+	recent        []atomdata.TimestampedEvent
+	feeds         []memoryFeed
+	events        map[string]atomdata.TimestampedEvent
+	feedThreshold int
+}
+
+//memoryFeed is a feed and its events, oldest first
+type memoryFeed struct {
+	id     string
+	events []atomdata.TimestampedEvent
+}
+
+//NewMemoryFeedStore creates an empty store
+func NewMemoryFeedStore() *MemoryFeedStore {
+	return &MemoryFeedStore{
+		events: make(map[string]atomdata.TimestampedEvent),
+	}
+}
+
+func memoryEventKey(aggregateID string, version int) string {
+	return fmt.Sprintf("%s:%d", aggregateID, version)
+}
+
+//newestFirst returns a copy of the events in reverse order
+func newestFirst(events []atomdata.TimestampedEvent) []atomdata.TimestampedEvent {
+	reversed := make([]atomdata.TimestampedEvent, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		reversed = append(reversed, events[i])
+	}
+
+	return reversed
+}
+
+//SetFeedThreshold sets the number of recent events at which the recent events are assigned to a
+//new feed as events are added, in the same way es-atom-data-pg uses FEED_THRESHOLD. A threshold
+//of 0, the default, means feeds are only created by calling CreateFeed.
+func (s *MemoryFeedStore) SetFeedThreshold(threshold int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feedThreshold = threshold
+}
+
+//Add adds events to the recent page, in the order given. No events are added if any of them
+//have already been added, or if the ids of the feeds they fill can't be generated.
+func (s *MemoryFeedStore) Add(events ...atomdata.TimestampedEvent) error {
+	s.mu.Lock()
+
+	batch := make(map[string]bool)
+	for _, event := range events {
+		if _, ok := event.Payload.([]byte); !ok {
+			s.mu.Unlock()
+			return ErrInvalidPayload
+		}
+
+		key := memoryEventKey(event.Source, event.Version)
+		if _, ok := s.events[key]; ok || batch[key] {
+			s.mu.Unlock()
+			return ErrDuplicateEvent
+		}
+
+		batch[key] = true
+	}
+
+	//The ids of the feeds the events fill are generated up front, so nothing is added if that
+	//fails
+	var feedIDs []string
+	if s.feedThreshold > 0 {
+		for i := 0; i < (len(s.recent)+len(events))/s.feedThreshold; i++ {
+			feedID, err := newFeedID()
+			if err != nil {
+				s.mu.Unlock()
+				return err
+			}
+
+			feedIDs = append(feedIDs, feedID)
+		}
+	}
+
+	var signal Signal
+	for _, event := range events {
+		s.events[memoryEventKey(event.Source, event.Version)] = event
+		s.recent = append(s.recent, event)
+		signal |= SignalNewEvents
+
+		if s.feedThreshold > 0 && len(s.recent) >= s.feedThreshold {
+			s.feeds = append(s.feeds, memoryFeed{id: feedIDs[0], events: s.recent})
+			feedIDs = feedIDs[1:]
+			s.recent = nil
+			signal |= SignalNewFeed
+		}
+	}
+
+	s.mu.Unlock()
+
+	if signal != 0 {
+		s.broadcast(signal)
+	}
+
+	return nil
+}
+
+//CreateFeed assigns the events in the recent page to a new feed with the given id
+func (s *MemoryFeedStore) CreateFeed(feedID string) error {
+	s.mu.Lock()
+
+	if len(s.recent) == 0 {
+		s.mu.Unlock()
+		return ErrNoRecentEvents
+	}
+
+	if feedID == "" || feedID == "recent" {
+		s.mu.Unlock()
+		return ErrInvalidFeedID
+	}
+
+	if s.feedIndex(feedID) >= 0 {
+		s.mu.Unlock()
+		return ErrDuplicateFeed
+	}
+
+	s.feeds = append(s.feeds, memoryFeed{id: feedID, events: s.recent})
+	s.recent = nil
+
+	s.mu.Unlock()
+
+	s.broadcast(SignalNewFeed)
+	return nil
+}
+
+//newFeedID returns a random (version 4) UUID for use as a feed id
+func newFeedID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+//feedIndex returns the index of the feed, or -1 if there is no such feed. The caller must hold
+//the lock.
+func (s *MemoryFeedStore) feedIndex(feedID string) int {
+	for i, feed := range s.feeds {
+		if feed.id == feedID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *MemoryFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return newestFirst(s.recent), nil
+}
+
+func (s *MemoryFeedStore) RetrieveLastFeed() (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.feeds) == 0 {
+		return "", nil
+	}
+
+	return s.feeds[len(s.feeds)-1].id, nil
+}
+
+func (s *MemoryFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.feedIndex(feedID)
+	if i < 0 {
+		return nil, nil
+	}
+
+	return newestFirst(s.feeds[i].events), nil
+}
+
+func (s *MemoryFeedStore) RetrievePreviousFeed(feedID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.feedIndex(feedID)
+	if i <= 0 {
+		return "", nil
+	}
+
+	return s.feeds[i-1].id, nil
+}
+
+func (s *MemoryFeedStore) RetrieveNextFeed(feedID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.feedIndex(feedID)
+	if i < 0 || i == len(s.feeds)-1 {
+		return "", nil
+	}
+
+	return s.feeds[i+1].id, nil
+}
+
+func (s *MemoryFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	event, ok := s.events[memoryEventKey(aggregateID, version)]
+	if !ok {
+		return event, ErrEventNotFound
+	}
+
+	return event, nil
+}
+
+func (s *MemoryFeedStore) RetrieveAggregate(aggregateID string, from int, to int, limit int) ([]atomdata.TimestampedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []atomdata.TimestampedEvent
+	for _, event := range s.events {
+		if event.Source == aggregateID && event.Version >= from && (to == 0 || event.Version <= to) {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Version < events[j].Version
+	})
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
@@ -0,0 +1,183 @@
+package esatompubpg
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+//MetricsRecorder records the metrics of serving the feed. The library doesn't depend on any
+//particular metrics system; embedding applications implement the recorder for theirs, and wire
+//it in with InstrumentHandler, NewInstrumentedFeedStore and AtomEncrypter.SetMetricsRecorder.
+type MetricsRecorder interface {
+	//ObserveRequest records a request served by the named route, with the response status and
+	//the number of bytes written in the response body
+	ObserveRequest(route string, status int, duration time.Duration, size int)
+
+	//ObserveEntries records the number of entries served in a page by the named route
+	ObserveEntries(route string, entries int)
+
+	//ObserveQuery records a feed store call, named for the FeedStore method
+	ObserveQuery(call string, duration time.Duration, err error)
+
+	//ObserveEncryption records the encryption of a response, including obtaining the data key
+	ObserveEncryption(duration time.Duration, err error)
+
+	//ObserveKeyProviderError records a failure to obtain a data key from the given type of key
+	//provider, e.g. a KMS error
+	ObserveKeyProviderError(provider string, err error)
+}
+
+type metricsContextKey int
+
+const routeMetricsContextKey metricsContextKey = 0
+
+//routeMetrics is the recorder for an instrumented route, carried in the request context so the
+//handler can record the entries served.
+type routeMetrics struct {
+	route    string
+	recorder MetricsRecorder
+}
+
+//statusRecorder captures the status and size of a response, for metrics, traces and logs
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+//Flush passes flushes on, so instrumented handlers can still stream their responses
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//InstrumentHandler wraps a handler to record its requests under the given route name. The
+//handlers in this package also record the entries served in each page when instrumented. A nil
+//recorder returns the handler as is.
+func InstrumentHandler(route string, recorder MetricsRecorder, h func(rw http.ResponseWriter, req *http.Request)) func(rw http.ResponseWriter, req *http.Request) {
+	if recorder == nil {
+		return h
+	}
+
+	metrics := &routeMetrics{route: route, recorder: recorder}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := &statusRecorder{ResponseWriter: rw}
+
+		h(w, req.WithContext(context.WithValue(req.Context(), routeMetricsContextKey, metrics)))
+
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		recorder.ObserveRequest(route, status, time.Since(start), w.size)
+	}
+}
+
+//observeEntries records the entries served in a page if the handler is instrumented
+func observeEntries(req *http.Request, entries int) {
+	if metrics, ok := req.Context().Value(routeMetricsContextKey).(*routeMetrics); ok {
+		metrics.recorder.ObserveEntries(metrics.route, entries)
+	}
+}
+
+//instrumentedFeedStore records the latency of the calls to a feed store
+type instrumentedFeedStore struct {
+	store    FeedStore
+	recorder MetricsRecorder
+}
+
+//NewInstrumentedFeedStore wraps the store to record the latency and errors of its calls with
+//the recorder.
+func NewInstrumentedFeedStore(store FeedStore, recorder MetricsRecorder) (FeedStore, error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
+	}
+
+	if recorder == nil {
+		return store, nil
+	}
+
+	return &instrumentedFeedStore{store: store, recorder: recorder}, nil
+}
+
+func (s *instrumentedFeedStore) observe(call string, start time.Time, err error) {
+	s.recorder.ObserveQuery(call, time.Since(start), err)
+}
+
+func (s *instrumentedFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	start := time.Now()
+	events, err := s.store.RetrieveRecent()
+	s.observe("RetrieveRecent", start, err)
+	return events, err
+}
+
+func (s *instrumentedFeedStore) RetrieveLastFeed() (string, error) {
+	start := time.Now()
+	feedID, err := s.store.RetrieveLastFeed()
+	s.observe("RetrieveLastFeed", start, err)
+	return feedID, err
+}
+
+func (s *instrumentedFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	start := time.Now()
+	events, err := s.store.RetrieveArchive(feedID)
+	s.observe("RetrieveArchive", start, err)
+	return events, err
+}
+
+func (s *instrumentedFeedStore) RetrievePreviousFeed(feedID string) (string, error) {
+	start := time.Now()
+	previous, err := s.store.RetrievePreviousFeed(feedID)
+	s.observe("RetrievePreviousFeed", start, err)
+	return previous, err
+}
+
+func (s *instrumentedFeedStore) RetrieveNextFeed(feedID string) (string, error) {
+	start := time.Now()
+	next, err := s.store.RetrieveNextFeed(feedID)
+	s.observe("RetrieveNextFeed", start, err)
+	return next, err
+}
+
+//RetrieveEvent records ErrEventNotFound as a successful call, as it's a normal outcome rather
+//than a failure of the store
+func (s *instrumentedFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	start := time.Now()
+	event, err := s.store.RetrieveEvent(aggregateID, version)
+	observed := err
+	if err == ErrEventNotFound {
+		observed = nil
+	}
+	s.observe("RetrieveEvent", start, observed)
+	return event, err
+}
+
+func (s *instrumentedFeedStore) RetrieveAggregate(aggregateID string, from int, to int, limit int) ([]atomdata.TimestampedEvent, error) {
+	start := time.Now()
+	events, err := s.store.RetrieveAggregate(aggregateID, from, to, limit)
+	s.observe("RetrieveAggregate", start, err)
+	return events, err
+}
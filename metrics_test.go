@@ -0,0 +1,131 @@
+package esatompubpg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+//testMetrics records the observations made, formatted for easy comparison
+type testMetrics struct {
+	sync.Mutex
+	requests          []string
+	entries           []string
+	queries           []string
+	encryptions       []string
+	keyProviderErrors []string
+}
+
+func (m *testMetrics) ObserveRequest(route string, status int, duration time.Duration, size int) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests = append(m.requests, fmt.Sprintf("%s %d %t", route, status, size > 0))
+}
+
+func (m *testMetrics) ObserveEntries(route string, entries int) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries = append(m.entries, fmt.Sprintf("%s %d", route, entries))
+}
+
+func (m *testMetrics) ObserveQuery(call string, duration time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.queries = append(m.queries, fmt.Sprintf("%s %t", call, err == nil))
+}
+
+func (m *testMetrics) ObserveEncryption(duration time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.encryptions = append(m.encryptions, fmt.Sprintf("%t", err == nil))
+}
+
+func (m *testMetrics) ObserveKeyProviderError(provider string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.keyProviderErrors = append(m.keyProviderErrors, provider)
+}
+
+type failingKeyProvider struct {
+	KeyProvider
+}
+
+func (kp *failingKeyProvider) GenerateDataKey() (*DataKey, error) {
+	return nil, errors.New("key provider unavailable")
+}
+
+func TestInstrumentedHandlers(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2))
+	store.CreateFeed("feed1")
+	store.Add(testEvent("agg", 3))
+
+	metrics := new(testMetrics)
+	instrumentedStore, err := NewInstrumentedFeedStore(store, metrics)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+	recentHandler, _ := NewRecentHandler(instrumentedStore, "testhost:12345", env, ae)
+	archiveHandler, _ := NewArchiveHandler(instrumentedStore, "testhost:12345", env, ae)
+	eventHandler, _ := NewEventRetrieveHandler(instrumentedStore, env, ae)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, InstrumentHandler("recent", metrics, recentHandler))
+	router.HandleFunc(ArchiveHandlerURI, InstrumentHandler("archive", metrics, archiveHandler))
+	router.HandleFunc(RetrieveEventHanderURI, InstrumentHandler("event", metrics, eventHandler))
+	router.HandleFunc(PingURI, InstrumentHandler("ping", metrics, PingHandler))
+
+	for _, uri := range []string{"/notifications/recent", "/notifications/feed1", "/notifications/feed1", "/events/agg/9", PingURI} {
+		r, _ := http.NewRequest("GET", uri, nil)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	assert.Equal(t, []string{"recent 200 true", "archive 200 true", "archive 200 true", "event 404 true", "ping 200 false"}, metrics.requests)
+
+	//The second archive request is served from the cache, without querying the store
+	assert.Equal(t, []string{"recent 1", "archive 2", "archive 2"}, metrics.entries)
+	assert.Equal(t, []string{
+		"RetrieveRecent true", "RetrieveLastFeed true",
+		"RetrieveArchive true", "RetrievePreviousFeed true", "RetrieveNextFeed true",
+		"RetrieveNextFeed true",
+		"RetrieveEvent true",
+	}, metrics.queries)
+
+	//Without a recorder nothing is instrumented
+	_, err = NewInstrumentedFeedStore(nil, metrics)
+	assert.Equal(t, ErrMissingFeedStore, err)
+	uninstrumented, _ := NewInstrumentedFeedStore(store, nil)
+	assert.Equal(t, store, uninstrumented)
+}
+
+func TestEncryptionMetrics(t *testing.T) {
+	kp, err := NewLocalKeyProvider(testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := new(testMetrics)
+	ae := NewAtomEncrypterWithKeyProvider(kp)
+	ae.SetMetricsRecorder(metrics)
+	_, err = ae.EncryptOutput([]byte("feed"))
+	assert.Nil(t, err)
+
+	ae = NewAtomEncrypterWithKeyProvider(&failingKeyProvider{kp})
+	ae.SetMetricsRecorder(metrics)
+	_, err = ae.EncryptOutput([]byte("feed"))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"true", "false"}, metrics.encryptions)
+	assert.Equal(t, []string{"custom"}, metrics.keyProviderErrors)
+}
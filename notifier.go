@@ -0,0 +1,303 @@
+package esatompubpg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+//Signal indicates what changed in the event store. Signals may be combined, e.g.
+//SignalNewEvents|SignalNewFeed
+type Signal int
+
+const (
+	SignalNewEvents Signal = 1 << iota
+	SignalNewFeed
+)
+
+//Has reports whether the signal includes the other signal
+func (s Signal) Has(other Signal) bool {
+	return s&other == other
+}
+
+//NotifyChannel is the channel the triggers in sql/atom_notify.sql publish to. The payload is
+//events when events are added and feed when a feed is created.
+//NOTIFY_POLL_INTERVAL (a duration such as 10s) sets how often the PG notifier checks for changes
+//itself, in case notifications are missed. It defaults to DefaultNotifyPollInterval.
+//DB_SSLMODE is the libpq ssl mode of the notifier's listener connection, such as require or
+//verify-full, and defaults to DefaultDBSSLMode.
+const (
+	NotifyChannel             = "es_atom_pub"
+	NotifyPollInterval        = "NOTIFY_POLL_INTERVAL"
+	DefaultNotifyPollInterval = 5 * time.Second
+	DBSSLMode                 = "DB_SSLMODE"
+	DefaultDBSSLMode          = "disable"
+)
+
+//Notifier broadcasts changes to the event store to subscribers
+type Notifier interface {
+	Subscribe() *Subscription
+}
+
+//Subscription delivers signals on C until closed. Signals are coalesced: if the subscriber has
+//not received a pending signal when another is sent, the subscriber gets a single signal
+//combining the two.
+type Subscription struct {
+	C           <-chan Signal
+	c           chan Signal
+	broadcaster *broadcaster
+}
+
+//Close unsubscribes
+func (s *Subscription) Close() {
+	s.broadcaster.unsubscribe(s)
+}
+
+type broadcaster struct {
+	sync.Mutex
+	subscriptions map[*Subscription]bool
+}
+
+//Subscribe returns a new subscription
+func (b *broadcaster) Subscribe() *Subscription {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[*Subscription]bool)
+	}
+
+	c := make(chan Signal, 1)
+	s := &Subscription{C: c, c: c, broadcaster: b}
+	b.subscriptions[s] = true
+	return s
+}
+
+func (b *broadcaster) unsubscribe(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.subscriptions, s)
+}
+
+func (b *broadcaster) broadcast(signal Signal) {
+	b.Lock()
+	defer b.Unlock()
+
+	for s := range b.subscriptions {
+		combined := signal
+		select {
+		case pending := <-s.c:
+			combined |= pending
+		default:
+		}
+
+		s.c <- combined
+	}
+}
+
+//FakeNotifier is a notifier whose signals are sent by calling Notify, for testing components
+//that use a notifier.
+type FakeNotifier struct {
+	broadcaster
+}
+
+//Notify sends the signal to all subscribers
+func (n *FakeNotifier) Notify(signal Signal) {
+	n.broadcast(signal)
+}
+
+//pgListener is the subset of pq.Listener used by the PG notifier
+type pgListener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+//PGNotifier signals changes to the event store using Postgres LISTEN/NOTIFY, as published by the
+//triggers in sql/atom_notify.sql. The listener connection is reestablished automatically if
+//lost. Notifications can be lost while the connection is down, and are never sent if the
+//triggers are not installed, so the notifier also polls the event store and signals any
+//changes it finds.
+type PGNotifier struct {
+	broadcaster
+	db           *sql.DB
+	listener     pgListener
+	pollInterval time.Duration
+	eventCount   int64
+	lastFeed     string
+	polled       bool
+}
+
+//NewPGNotifier creates a notifier listening on a dedicated connection to the database
+//identified by DB_USER, DB_PASSWORD, DB_HOST, DB_PORT and DB_NAME, the settings the connection
+//pool is opened with, using the DB_SSLMODE ssl mode. The db is used for polling.
+func NewPGNotifier(db *sql.DB, env *envinject.InjectedEnv) (*PGNotifier, error) {
+	if db == nil {
+		return nil, ErrBadDBConnection
+	}
+
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	pollInterval := DefaultNotifyPollInterval
+	if val := env.Getenv(NotifyPollInterval); val != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listener := pq.NewListener(pgConnectString(env), time.Second, time.Minute, logListenerEvent)
+	return newPGNotifier(db, listener, pollInterval), nil
+}
+
+//pgConnectString returns the connection string for the database identified by DB_USER,
+//DB_PASSWORD, DB_HOST, DB_PORT and DB_NAME, with the ssl mode given by DB_SSLMODE, which
+//defaults to DefaultDBSSLMode. Values are quoted so they can contain spaces and quotes, and
+//settings that aren't configured are left to the driver's defaults.
+func pgConnectString(env *envinject.InjectedEnv) string {
+	sslMode := env.Getenv(DBSSLMode)
+	if sslMode == "" {
+		sslMode = DefaultDBSSLMode
+	}
+
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"user", env.Getenv("DB_USER")},
+		{"password", env.Getenv("DB_PASSWORD")},
+		{"dbname", env.Getenv("DB_NAME")},
+		{"host", env.Getenv("DB_HOST")},
+		{"port", env.Getenv("DB_PORT")},
+		{"sslmode", sslMode},
+	}
+
+	var parts []string
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+
+		value := strings.Replace(setting.value, `\`, `\\`, -1)
+		value = strings.Replace(value, `'`, `\'`, -1)
+		parts = append(parts, fmt.Sprintf("%s='%s'", setting.key, value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func newPGNotifier(db *sql.DB, listener pgListener, pollInterval time.Duration) *PGNotifier {
+	return &PGNotifier{
+		db:           db,
+		listener:     listener,
+		pollInterval: pollInterval,
+	}
+}
+
+func logListenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected:
+		log.Infof("Listening for notifications on %s", NotifyChannel)
+	case pq.ListenerEventReconnected:
+		log.Infof("Reconnected to listen for notifications on %s", NotifyChannel)
+	case pq.ListenerEventDisconnected:
+		log.Warnf("Lost notification listener connection: %v", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Warnf("Error connecting notification listener: %v", err)
+	}
+}
+
+//Run listens for notifications until the context is done, returning the context's error.
+func (n *PGNotifier) Run(ctx context.Context) error {
+	defer n.listener.Close()
+
+	if err := n.listener.Listen(NotifyChannel); err != nil {
+		log.Warnf("Error listening on %s, relying on polling: %s", NotifyChannel, err.Error())
+	}
+
+	n.poll()
+
+	ticker := time.NewTicker(n.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case notification := <-n.listener.NotificationChannel():
+			//A nil notification is sent when the connection has been reestablished, in
+			//which case notifications may have been missed.
+			if notification == nil {
+				n.poll()
+				continue
+			}
+
+			switch notification.Extra {
+			case "events":
+				n.broadcast(SignalNewEvents)
+			case "feed":
+				n.broadcast(SignalNewFeed)
+			default:
+				log.Warnf("Unexpected notification on %s: %s", NotifyChannel, notification.Extra)
+			}
+
+		case <-ticker.C:
+			n.poll()
+			if err := n.listener.Ping(); err != nil {
+				log.Debugf("Notification listener ping failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+//poll checks for new events and feeds since the last poll, broadcasting any changes found.
+//Events are only ever appended, and the recent events are only removed from recent when a
+//feed is created, so the count of recent events changes whenever events are added unless a
+//feed is created too, which the newest feed id shows. Only the recent events are counted so
+//the poll stays cheap however large the event store grows.
+func (n *PGNotifier) poll() {
+	var eventCount int64
+	err := n.db.QueryRow("select count(*) from t_aeae_atom_event where feedid is null").Scan(&eventCount)
+	if err != nil {
+		log.Warnf("Error polling for new events: %s", err.Error())
+		return
+	}
+
+	lastFeed, err := atomdata.RetrieveLastFeed(n.db)
+	if err != nil {
+		log.Warnf("Error polling for new feeds: %s", err.Error())
+		return
+	}
+
+	var signal Signal
+	if eventCount != n.eventCount {
+		signal |= SignalNewEvents
+	}
+
+	if lastFeed != n.lastFeed {
+		signal |= SignalNewFeed
+	}
+
+	n.eventCount = eventCount
+	n.lastFeed = lastFeed
+
+	if n.polled && signal != 0 {
+		n.broadcast(signal)
+	}
+
+	n.polled = true
+}
@@ -0,0 +1,245 @@
+package esatompubpg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+type fakeListener struct {
+	notify   chan *pq.Notification
+	channels []string
+	closed   bool
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{notify: make(chan *pq.Notification)}
+}
+
+func (l *fakeListener) Listen(channel string) error {
+	l.channels = append(l.channels, channel)
+	return nil
+}
+
+func (l *fakeListener) NotificationChannel() <-chan *pq.Notification {
+	return l.notify
+}
+
+func (l *fakeListener) Ping() error {
+	return errors.New("not connected")
+}
+
+func (l *fakeListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func receiveSignal(t *testing.T, s *Subscription) Signal {
+	select {
+	case signal := <-s.C:
+		return signal
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for signal")
+		return 0
+	}
+}
+
+func TestSignalCoalescing(t *testing.T) {
+	var notifier FakeNotifier
+	s1 := notifier.Subscribe()
+	s2 := notifier.Subscribe()
+
+	notifier.Notify(SignalNewEvents)
+	assert.Equal(t, SignalNewEvents, receiveSignal(t, s1))
+
+	notifier.Notify(SignalNewFeed)
+	assert.Equal(t, SignalNewFeed, receiveSignal(t, s1))
+
+	//s2 hasn't received anything yet, so gets both signals at once
+	signal := receiveSignal(t, s2)
+	assert.True(t, signal.Has(SignalNewEvents))
+	assert.True(t, signal.Has(SignalNewFeed))
+
+	s2.Close()
+	notifier.Notify(SignalNewEvents)
+	assert.Equal(t, SignalNewEvents, receiveSignal(t, s1))
+	select {
+	case <-s2.C:
+		t.Error("unexpected signal after close")
+	default:
+	}
+}
+
+func expectNotifierPoll(mock sqlmock.Sqlmock, eventCount int, lastFeed string) {
+	mock.ExpectQuery(regexp.QuoteMeta("select count(*) from t_aeae_atom_event where feedid is null")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(eventCount))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow(lastFeed))
+}
+
+func TestPGNotifierPoll(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The first poll records the state, and later polls signal what changed
+	expectNotifierPoll(mock, 3, "feed1")
+	expectNotifierPoll(mock, 3, "feed1")
+	expectNotifierPoll(mock, 5, "feed1")
+	expectNotifierPoll(mock, 5, "feed2")
+	mock.ExpectQuery(regexp.QuoteMeta("select count(*) from t_aeae_atom_event where feedid is null")).WillReturnError(errors.New("kaboom"))
+
+	notifier := newPGNotifier(db, newFakeListener(), time.Hour)
+	subscription := notifier.Subscribe()
+
+	noSignal := func() {
+		select {
+		case signal := <-subscription.C:
+			t.Errorf("unexpected signal %d", signal)
+		default:
+		}
+	}
+
+	notifier.poll()
+	noSignal()
+	notifier.poll()
+	noSignal()
+	notifier.poll()
+	assert.Equal(t, SignalNewEvents, receiveSignal(t, subscription))
+	notifier.poll()
+	assert.Equal(t, SignalNewFeed, receiveSignal(t, subscription))
+	notifier.poll()
+	noSignal()
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGConnectString(t *testing.T) {
+	for _, name := range []string{"DB_USER", "DB_PASSWORD", "DB_NAME", "DB_HOST", "DB_PORT", DBSSLMode} {
+		defer os.Unsetenv(name)
+	}
+
+	os.Setenv("DB_USER", "atom")
+	os.Setenv("DB_PASSWORD", `p@ss word's \ secret`)
+	os.Setenv("DB_NAME", "events")
+	os.Setenv("DB_HOST", "db.example.com")
+	os.Setenv("DB_PORT", "")
+
+	env, _ := envinject.NewInjectedEnv()
+	assert.Equal(t, `user='atom' password='p@ss word\'s \\ secret' dbname='events' host='db.example.com' sslmode='disable'`,
+		pgConnectString(env))
+
+	os.Setenv(DBSSLMode, "verify-full")
+	env, _ = envinject.NewInjectedEnv()
+	assert.True(t, strings.HasSuffix(pgConnectString(env), ` sslmode='verify-full'`))
+}
+
+func TestPGNotifier(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The initial poll, then the poll on reconnecting
+	expectNotifierPoll(mock, 10, "feed1")
+	expectNotifierPoll(mock, 12, "feed2")
+
+	listener := newFakeListener()
+	notifier := newPGNotifier(db, listener, time.Hour)
+	subscription := notifier.Subscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- notifier.Run(ctx)
+	}()
+
+	listener.notify <- &pq.Notification{Channel: NotifyChannel, Extra: "events"}
+	assert.Equal(t, SignalNewEvents, receiveSignal(t, subscription))
+
+	listener.notify <- &pq.Notification{Channel: NotifyChannel, Extra: "feed"}
+	assert.Equal(t, SignalNewFeed, receiveSignal(t, subscription))
+
+	//Notifications may have been missed while reconnecting, so the notifier checks for changes
+	listener.notify <- nil
+	assert.Equal(t, SignalNewEvents|SignalNewFeed, receiveSignal(t, subscription))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, []string{NotifyChannel}, listener.channels)
+	assert.True(t, listener.closed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestNewPGNotifier(t *testing.T) {
+	env, _ := envinject.NewInjectedEnv()
+
+	_, err := NewPGNotifier(nil, env)
+	assert.Equal(t, ErrBadDBConnection, err)
+
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+
+	_, err = NewPGNotifier(db, nil)
+	assert.Equal(t, ErrMissingInjectedEnv, err)
+
+	notifier, err := NewPGNotifier(db, env)
+	if assert.Nil(t, err) {
+		assert.Equal(t, DefaultNotifyPollInterval, notifier.pollInterval)
+	}
+}
+
+func TestStreamWithNotifier(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(1))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(1))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+
+	var notifier FakeNotifier
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, err := NewStreamHandler(pgFeedStore(t, db), "testhost:12345", env, NewAtomEncrypterWithKeyProvider(nil), &notifier)
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	//Headers are sent once the first check for new entries is done, and nothing is checked
+	//again until the notifier signals new events.
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	notifier.Notify(SignalNewEvents)
+
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "id: ") {
+			assert.Equal(t, "id: urn:esid:agg:2", lines.Text())
+			break
+		}
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
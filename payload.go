@@ -0,0 +1,227 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrMissingPayloadRenderer = errors.New("Nil payload renderer passed to factory method")
+var ErrInvalidJSONPayload = errors.New("Payload is not valid JSON")
+var ErrInvalidXMLPayload = errors.New("Payload is not well formed XML")
+var ErrXMLPayloadNotElement = errors.New("XML payload is not a single element")
+var ErrUnknownPayloadFormat = errors.New("Unknown payload format")
+var ErrMalformedPayloadFormats = errors.New("Malformed payload formats, expected typecode=format pairs")
+
+//Payloads of typecodes with no renderer are served base64 encoded as application/octet-stream.
+//PAYLOAD_FORMATS registers the built in renderers for typecodes, as a comma separated list of
+//typecode=format pairs where the format is json or xml, e.g. OrderCreated=json,Invoiced=xml
+const (
+	OctetStreamContentType = "application/octet-stream"
+	PayloadFormats         = "PAYLOAD_FORMATS"
+)
+
+//PayloadRenderer renders the payloads of events with a given typecode as entry content
+type PayloadRenderer interface {
+	//ContentType is the media type of the rendered payloads
+	ContentType() string
+
+	//RenderPayload renders an event payload
+	RenderPayload(payload []byte) ([]byte, error)
+}
+
+type payloadRenderer struct {
+	contentType string
+	render      func(payload []byte) ([]byte, error)
+}
+
+func (r *payloadRenderer) ContentType() string {
+	return r.contentType
+}
+
+func (r *payloadRenderer) RenderPayload(payload []byte) ([]byte, error) {
+	return r.render(payload)
+}
+
+//NewPayloadRenderer creates a renderer from a function producing content of the given media
+//type, e.g. one converting protobuf messages to JSON with protojson.
+func NewPayloadRenderer(contentType string, render func(payload []byte) ([]byte, error)) PayloadRenderer {
+	return &payloadRenderer{contentType: contentType, render: render}
+}
+
+//JSONPayloadRenderer passes JSON payloads through as application/json content
+var JSONPayloadRenderer = NewPayloadRenderer(JSONContentType, func(payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, ErrInvalidJSONPayload
+	}
+
+	return payload, nil
+})
+
+//XMLPayloadRenderer passes XML payloads through as application/xml content, which is inlined
+//in atom entries. The XML declaration, if any, is removed as the payload is embedded. As
+//RFC 4287 requires inline XML content to be a single element, other payloads are rejected.
+var XMLPayloadRenderer = NewPayloadRenderer(XMLContentType, func(payload []byte) ([]byte, error) {
+	payload = bytes.TrimSpace(payload)
+	if bytes.HasPrefix(payload, []byte("<?xml")) {
+		end := bytes.Index(payload, []byte("?>"))
+		if end < 0 {
+			return nil, ErrInvalidXMLPayload
+		}
+		payload = bytes.TrimSpace(payload[end+2:])
+	}
+
+	//Inline content must be a single element, so only whitespace, comments and processing
+	//instructions are allowed outside it
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	depth, roots := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidXMLPayload
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return nil, ErrXMLPayloadNotElement
+			}
+		case xml.Directive:
+			if depth == 0 {
+				return nil, ErrXMLPayloadNotElement
+			}
+		}
+	}
+
+	if roots != 1 {
+		return nil, ErrXMLPayloadNotElement
+	}
+
+	return payload, nil
+})
+
+var payloadFormats = map[string]PayloadRenderer{
+	"json": JSONPayloadRenderer,
+	"xml":  XMLPayloadRenderer,
+}
+
+//The registry of payload renderers, keyed by typecode
+var payloadRenderers = struct {
+	sync.RWMutex
+	renderers map[string]PayloadRenderer
+}{renderers: make(map[string]PayloadRenderer)}
+
+//RegisterPayloadRenderer registers the renderer for the payloads of events with the typecode,
+//replacing any renderer already registered for it.
+func RegisterPayloadRenderer(typeCode string, renderer PayloadRenderer) error {
+	if renderer == nil {
+		return ErrMissingPayloadRenderer
+	}
+
+	payloadRenderers.Lock()
+	defer payloadRenderers.Unlock()
+	payloadRenderers.renderers[typeCode] = renderer
+	return nil
+}
+
+//RegisterPayloadRenderers registers the built in renderers for the typecodes given by
+//PAYLOAD_FORMATS
+func RegisterPayloadRenderers(env *envinject.InjectedEnv) error {
+	if env == nil {
+		return ErrMissingInjectedEnv
+	}
+
+	formats := env.Getenv(PayloadFormats)
+	if formats == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(formats, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return ErrMalformedPayloadFormats
+		}
+
+		renderer, ok := payloadFormats[strings.ToLower(parts[1])]
+		if !ok {
+			return ErrUnknownPayloadFormat
+		}
+
+		RegisterPayloadRenderer(parts[0], renderer)
+	}
+
+	return nil
+}
+
+func payloadRendererFor(typeCode string) PayloadRenderer {
+	payloadRenderers.RLock()
+	defer payloadRenderers.RUnlock()
+	return payloadRenderers.renderers[typeCode]
+}
+
+//entryContent renders the event payload, as redacted for the consumer, as entry content with
+//the renderer registered for its typecode. The payload is base64 encoded if there's no renderer
+//for the typecode, or if the renderer fails.
+func entryContent(event atomdata.TimestampedEvent, payload []byte) *Content {
+	if renderer := payloadRendererFor(event.TypeCode); renderer != nil {
+		rendered, err := renderer.RenderPayload(payload)
+		if err == nil {
+			return newContent(renderer.ContentType(), rendered)
+		}
+
+		log.Warnf("Error rendering %s payload of %s: %s", event.TypeCode, entryID(event), err.Error())
+	}
+
+	return newContent(OctetStreamContentType, payload)
+}
+
+//newContent creates entry content of the media type as RFC 4287 requires: XML is inlined,
+//text is escaped, and anything else is base64 encoded.
+func newContent(contentType string, body []byte) *Content {
+	switch {
+	case isXMLMediaType(contentType):
+		return &Content{Type: contentType, XML: string(body)}
+	case strings.HasPrefix(contentType, "text/"):
+		return &Content{Type: contentType, Body: string(body)}
+	default:
+		return &Content{Type: contentType, Body: base64.StdEncoding.EncodeToString(body)}
+	}
+}
+
+func isXMLMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == XMLContentType || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == JSONContentType || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,156 @@
+package esatompubpg
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/goes"
+)
+
+func payloadEvent(typeCode string, version int, payload string) atomdata.TimestampedEvent {
+	return atomdata.TimestampedEvent{
+		Event: goes.Event{
+			Source:   "payload-agg",
+			Version:  version,
+			TypeCode: typeCode,
+			Payload:  []byte(payload),
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+func TestPayloadRenderers(t *testing.T) {
+	assert.Equal(t, ErrMissingPayloadRenderer, RegisterPayloadRenderer("payload-nil", nil))
+
+	RegisterPayloadRenderer("payload-json", JSONPayloadRenderer)
+	RegisterPayloadRenderer("payload-xml", XMLPayloadRenderer)
+	RegisterPayloadRenderer("payload-text", NewPayloadRenderer("text/plain", func(payload []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(payload))), nil
+	}))
+	RegisterPayloadRenderer("payload-broken", NewPayloadRenderer(JSONContentType, func(payload []byte) ([]byte, error) {
+		return nil, errors.New("can't render")
+	}))
+
+	var feed Feed
+	addItemsToFeed(&feed, []atomdata.TimestampedEvent{
+		payloadEvent("payload-json", 1, `{"order":1}`),
+		payloadEvent("payload-xml", 2, `<?xml version="1.0"?><order id="1">a &amp; b</order>`),
+		payloadEvent("payload-text", 3, "hello"),
+		payloadEvent("payload-broken", 4, "\x00\x01"),
+		payloadEvent("payload-none", 5, "opaque"),
+		payloadEvent("payload-json", 6, "not json"),
+	}, nil, "testhost:12345", "https")
+
+	out, err := marshalFeed(&feed, AtomContentType)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	//XML payloads are inline, not escaped
+	assert.True(t, strings.Contains(string(out), `<content type="application/xml"><order id="1">a &amp; b</order></content>`), string(out))
+	assert.True(t, strings.Contains(string(out), `<category term="payload-json" scheme="`+TypeCodeScheme+`"></category>`))
+
+	var parsed Feed
+	if !assert.Nil(t, xml.Unmarshal(out, &parsed)) || !assert.Equal(t, 6, len(parsed.Entry)) {
+		return
+	}
+
+	var expected = []struct {
+		typeCode    string
+		contentType string
+		payload     string
+	}{
+		{"payload-json", JSONContentType, `{"order":1}`},
+		{"payload-xml", XMLContentType, `<order id="1">a &amp; b</order>`},
+		{"payload-text", "text/plain", "HELLO"},
+		{"payload-broken", OctetStreamContentType, "\x00\x01"},
+		{"payload-none", OctetStreamContentType, "opaque"},
+		{"payload-json", OctetStreamContentType, "not json"},
+	}
+
+	for i, entry := range parsed.Entry {
+		assert.Equal(t, expected[i].typeCode, entry.TypeCode())
+		assert.Equal(t, expected[i].contentType, entry.Content.Type, expected[i].typeCode)
+
+		payload, err := entry.Content.Payload()
+		assert.Nil(t, err)
+		assert.Equal(t, expected[i].payload, string(payload), expected[i].typeCode)
+	}
+
+	//JSON content is embedded as is in the JSON Feed representation
+	jsonFeed := NewJSONFeed(&parsed)
+	assert.Equal(t, "payload-json", jsonFeed.Items[0].Atom.TypeCode)
+	assert.Equal(t, `{"order":1}`, jsonFeed.Items[0].ContentText)
+	assert.Equal(t, json.RawMessage(`{"order":1}`), jsonFeed.Items[0].Atom.Content)
+	assert.Equal(t, `<order id="1">a &amp; b</order>`, jsonFeed.Items[1].ContentText)
+	assert.Nil(t, jsonFeed.Items[1].Atom.Content)
+	assert.Equal(t, "b3BhcXVl", jsonFeed.Items[4].ContentText)
+}
+
+func TestXMLPayloadRenderer(t *testing.T) {
+	for _, payload := range []string{
+		`<order/>`,
+		`<?xml version="1.0"?>` + "\n" + `<order><item/><item/></order>`,
+		`<!-- order --> <order>a</order> <?pi data?>`,
+	} {
+		rendered, err := XMLPayloadRenderer.RenderPayload([]byte(payload))
+		assert.Nil(t, err, payload)
+		assert.NotEqual(t, 0, len(rendered), payload)
+	}
+
+	for _, payload := range []string{`<a/><b/>`, `bare text`, `<a/> trailing`, `<!DOCTYPE a><a/>`, ``} {
+		_, err := XMLPayloadRenderer.RenderPayload([]byte(payload))
+		assert.Equal(t, ErrXMLPayloadNotElement, err, payload)
+	}
+
+	_, err := XMLPayloadRenderer.RenderPayload([]byte(`<a>`))
+	assert.Equal(t, ErrInvalidXMLPayload, err)
+}
+
+func TestXMLPayloadFallback(t *testing.T) {
+	RegisterPayloadRenderer("payload-xml-fallback", XMLPayloadRenderer)
+
+	//Payloads that aren't a single element are served base64 encoded rather than inlined
+	for _, payload := range []string{`<a/><b/>`, `bare text`} {
+		content := entryContent(payloadEvent("payload-xml-fallback", 1, payload), []byte(payload))
+		assert.Equal(t, OctetStreamContentType, content.Type, payload)
+		assert.Equal(t, "", content.XML, payload)
+
+		decoded, err := content.Payload()
+		assert.Nil(t, err)
+		assert.Equal(t, payload, string(decoded))
+	}
+
+	content := entryContent(payloadEvent("payload-xml-fallback", 1, `<a/>`), []byte(`<a/>`))
+	assert.Equal(t, XMLContentType, content.Type)
+	assert.Equal(t, `<a/>`, content.XML)
+}
+
+func TestRegisterPayloadRenderers(t *testing.T) {
+	defer os.Unsetenv(PayloadFormats)
+
+	assert.Equal(t, ErrMissingInjectedEnv, RegisterPayloadRenderers(nil))
+
+	os.Setenv(PayloadFormats, "payload-env-json=json, payload-env-xml=XML")
+	env, _ := envinject.NewInjectedEnv()
+	if assert.Nil(t, RegisterPayloadRenderers(env)) {
+		assert.Equal(t, JSONPayloadRenderer, payloadRendererFor("payload-env-json"))
+		assert.Equal(t, XMLPayloadRenderer, payloadRendererFor("payload-env-xml"))
+	}
+
+	os.Setenv(PayloadFormats, "payload-env-proto=protobuf")
+	env, _ = envinject.NewInjectedEnv()
+	assert.Equal(t, ErrUnknownPayloadFormat, RegisterPayloadRenderers(env))
+
+	os.Setenv(PayloadFormats, "payload-env-json")
+	env, _ = envinject.NewInjectedEnv()
+	assert.Equal(t, ErrMalformedPayloadFormats, RegisterPayloadRenderers(env))
+}
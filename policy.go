@@ -0,0 +1,129 @@
+package esatompubpg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrMalformedPolicy = errors.New("Policy grants need at least one typecode or aggregate prefix")
+
+//DefaultPolicyConsumer is the policy entry applied to authenticated consumers without an entry
+//of their own. Consumers are refused if there is no entry for them and no default.
+const DefaultPolicyConsumer = "*"
+
+//Grant is the set of events a consumer may see: those with one of the typecodes, or for an
+//aggregate whose id starts with one of the prefixes. The typecode * grants all events.
+type Grant struct {
+	TypeCodes         []string `json:"typecodes"`
+	AggregatePrefixes []string `json:"aggregatePrefixes"`
+	id                string
+}
+
+//Policy maps consumers, identified by the JWT subject or API key name, to their grants. It is
+//read from JSON of the form
+//
+//	{"consumers": {"billing": {"typecodes": ["OrderPlaced"], "aggregatePrefixes": ["invoice-"]}}}
+type Policy struct {
+	Consumers map[string]*Grant `json:"consumers"`
+}
+
+//LoadPolicy reads a policy
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	var policy Policy
+	if err := json.NewDecoder(r).Decode(&policy); err != nil {
+		return nil, err
+	}
+
+	for consumer, grant := range policy.Consumers {
+		if grant == nil || len(grant.TypeCodes)+len(grant.AggregatePrefixes) == 0 {
+			return nil, fmt.Errorf("%s: %s", consumer, ErrMalformedPolicy.Error())
+		}
+
+		sort.Strings(grant.TypeCodes)
+		sort.Strings(grant.AggregatePrefixes)
+
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(grant.TypeCodes, "\n") + "\n\n" + strings.Join(grant.AggregatePrefixes, "\n")))
+		grant.id = fmt.Sprintf("%x", h.Sum64())
+	}
+
+	return &policy, nil
+}
+
+//grant returns the grant for the consumer, which is nil when there is no policy as all events
+//may then be seen. The second result is false if the policy has no grant for the consumer.
+func (p *Policy) grant(consumer string) (*Grant, bool) {
+	if p == nil {
+		return nil, true
+	}
+
+	if grant, ok := p.Consumers[consumer]; ok {
+		return grant, true
+	}
+
+	grant, ok := p.Consumers[DefaultPolicyConsumer]
+	return grant, ok
+}
+
+//allowsAll reports whether the grant covers all events, in which case there's no need to
+//check them
+func (g *Grant) allowsAll() bool {
+	if g == nil {
+		return true
+	}
+
+	i := sort.SearchStrings(g.TypeCodes, "*")
+	return i < len(g.TypeCodes) && g.TypeCodes[i] == "*"
+}
+
+func (g *Grant) allows(event atomdata.TimestampedEvent) bool {
+	if g.allowsAll() {
+		return true
+	}
+
+	i := sort.SearchStrings(g.TypeCodes, event.TypeCode)
+	if i < len(g.TypeCodes) && g.TypeCodes[i] == event.TypeCode {
+		return true
+	}
+
+	for _, prefix := range g.AggregatePrefixes {
+		if strings.HasPrefix(event.Source, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//apply returns the events the grant allows, in the order given
+func (g *Grant) apply(events []atomdata.TimestampedEvent) []atomdata.TimestampedEvent {
+	if g.allowsAll() {
+		return events
+	}
+
+	var allowed []atomdata.TimestampedEvent
+	for _, event := range events {
+		if g.allows(event) {
+			allowed = append(allowed, event)
+		}
+	}
+
+	return allowed
+}
+
+//key identifies the grant, and is empty when all events are allowed. Consumers with the same
+//grant have the same key, so they share cached pages.
+func (g *Grant) key() string {
+	if g.allowsAll() {
+		return ""
+	}
+
+	return g.id
+}
@@ -0,0 +1,150 @@
+package esatompubpg
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"golang.org/x/tools/blog/atom"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(`{"consumers": {
+		"billing": {"typecodes": ["OrderPlaced", "InvoiceSent"], "aggregatePrefixes": ["invoice-"]},
+		"shipping": {"typecodes": ["InvoiceSent", "OrderPlaced"], "aggregatePrefixes": ["invoice-"]},
+		"*": {"typecodes": ["*"]}
+	}}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	billing, ok := policy.grant("billing")
+	assert.True(t, ok)
+	assert.True(t, billing.allows(typedEvent("order-1", 1, "OrderPlaced")))
+	assert.True(t, billing.allows(typedEvent("invoice-1", 1, "InvoiceVoided")))
+	assert.False(t, billing.allows(typedEvent("order-1", 2, "OrderShipped")))
+
+	//Consumers with the same grant share cached pages
+	shipping, _ := policy.grant("shipping")
+	assert.Equal(t, billing.key(), shipping.key())
+	assert.NotEqual(t, "", billing.key())
+
+	//Consumers without a grant of their own get the default
+	other, ok := policy.grant("other")
+	assert.True(t, ok)
+	assert.True(t, other.allowsAll())
+	assert.Equal(t, "", other.key())
+
+	var noPolicy *Policy
+	grant, ok := noPolicy.grant("anyone")
+	assert.True(t, ok)
+	assert.Nil(t, grant)
+	assert.True(t, grant.allows(typedEvent("order-1", 1, "OrderPlaced")))
+
+	_, err = LoadPolicy(strings.NewReader(`{"consumers": {"billing": {}}}`))
+	assert.NotNil(t, err)
+	_, err = LoadPolicy(strings.NewReader(`{"consumers": `))
+	assert.NotNil(t, err)
+}
+
+func TestHandlersWithPolicy(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(typedEvent("order-1", 1, "OrderPlaced"), typedEvent("invoice-1", 1, "InvoiceSent"))
+	store.CreateFeed("feed1")
+	store.Add(typedEvent("order-1", 2, "OrderShipped"), typedEvent("invoice-1", 2, "InvoicePaid"))
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	recentHandler, _ := NewRecentHandler(store, "testhost:12345", env, ae)
+	archiveHandler, _ := NewArchiveHandler(store, "testhost:12345", env, ae)
+	eventHandler, _ := NewEventRetrieveHandler(store, env, ae)
+	aggregateHandler, _ := NewAggregateRetrieveHandler(store, "testhost:12345", env, ae)
+	streamHandler, _ := NewStreamHandler(store, "testhost:12345", env, ae, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(StreamHandlerURI, streamHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+	router.HandleFunc(RetrieveAggregateHandlerURI, aggregateHandler)
+
+	policy, _ := LoadPolicy(strings.NewReader(`{"consumers": {
+		"billing": {"aggregatePrefixes": ["invoice-"]},
+		"audit": {"typecodes": ["*"]}
+	}}`))
+	a := new(Authenticator)
+	a.SetAPIKeys(map[string]string{"billing": "billing-key", "audit": "audit-key"})
+	a.SetPolicy(policy)
+	handler := a.Middleware(router)
+
+	get := func(uri string, key string, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.Header.Set(APIKeyHeader, key)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	entryIDs := func(w *httptest.ResponseRecorder) []string {
+		var feed atom.Feed
+		var ids []string
+		if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed)) {
+			for _, entry := range feed.Entry {
+				ids = append(ids, entry.ID)
+			}
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"urn:esid:invoice-1:2"}, entryIDs(get("/notifications/recent", "billing-key", "")))
+	assert.Equal(t, []string{"urn:esid:invoice-1:2", "urn:esid:order-1:2"}, entryIDs(get("/notifications/recent", "audit-key", "")))
+
+	//Archive pages are cached per grant, and only privately
+	w := get("/notifications/feed1", "billing-key", "")
+	assert.Equal(t, []string{"urn:esid:invoice-1:1"}, entryIDs(w))
+	assert.Equal(t, "private, max-age=2592000", w.Header().Get("Cache-Control"))
+	billingETag := w.Header().Get("ETag")
+
+	w = get("/notifications/feed1", "audit-key", "")
+	assert.Equal(t, []string{"urn:esid:invoice-1:1", "urn:esid:order-1:1"}, entryIDs(w))
+	assert.Equal(t, `"feed1"`, w.Header().Get("ETag"))
+	assert.NotEqual(t, billingETag, w.Header().Get("ETag"))
+	assert.Equal(t, http.StatusOK, get("/notifications/feed1", "billing-key", `"feed1"`).Result().StatusCode)
+	assert.Equal(t, http.StatusNotModified, get("/notifications/feed1", "billing-key", billingETag).Result().StatusCode)
+
+	//Events the consumer may not see are forbidden, even when the client has them cached
+	assert.Equal(t, http.StatusOK, get("/events/invoice-1/1", "billing-key", "").Result().StatusCode)
+	assert.Equal(t, http.StatusForbidden, get("/events/order-1/1", "billing-key", "").Result().StatusCode)
+	assert.Equal(t, http.StatusForbidden, get("/events/order-1/1", "billing-key", `"order-1:1"`).Result().StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/events/order-1/9", "billing-key", "").Result().StatusCode)
+	assert.Equal(t, http.StatusNotModified, get("/events/order-1/1", "audit-key", `"order-1:1"`).Result().StatusCode)
+
+	w = get("/events/order-1", "billing-key", "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var page AggregateEvents
+	if assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &page)) {
+		assert.Equal(t, 0, len(page.Events))
+	}
+
+	//Only the events the consumer may see are streamed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequest("GET", StreamHandlerURI, nil)
+	r = r.WithContext(ctx)
+	r.Header.Set(APIKeyHeader, "billing-key")
+	r.Header.Set("Last-Event-ID", "urn:esid:order-1:1")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	ids, _ := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:invoice-1:1", "urn:esid:invoice-1:2"}, ids)
+}
@@ -0,0 +1,390 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrMalformedRedactionPath = errors.New("Malformed redaction path")
+var ErrUnknownRedactionAction = errors.New("Unknown redaction action, expected drop, mask or hash")
+var ErrUnredactablePayload = errors.New("Payload with redaction rules is not JSON")
+
+//Redaction actions, and the configuration of the redaction policy. REDACTION_POLICY_FILE
+//names the JSON file with the rules, and REDACTION_HASH_KEY, if set, is the key used to hash
+//values with HMAC-SHA256 rather than plain SHA-256, so low entropy values such as email
+//addresses can't be recovered by hashing candidates.
+const (
+	DropAction         = "drop"
+	MaskAction         = "mask"
+	HashAction         = "hash"
+	RedactionMask      = "****"
+	RedactionPolicyEnv = "REDACTION_POLICY_FILE"
+	RedactionHashKey   = "REDACTION_HASH_KEY"
+)
+
+//RedactionRule redacts the fields of a JSON payload at the path, e.g. customer.email or
+//items[*].card. A * segment matches every field of an object, [*] every element of an array,
+//and [n] the nth element. The rule applies to all consumers unless it lists the consumers it
+//applies to, and consumers listed in except see the fields as is.
+type RedactionRule struct {
+	Path      string   `json:"path"`
+	Action    string   `json:"action"`
+	Consumers []string `json:"consumers"`
+	Except    []string `json:"except"`
+	segments  []pathSegment
+}
+
+//RedactionPolicy maps typecodes to the redaction rules for their payloads. It is read from
+//JSON of the form
+//
+//	{"typecodes": {"OrderPlaced": [{"path": "customer.email", "action": "mask"}]}}
+type RedactionPolicy struct {
+	TypeCodes map[string][]*RedactionRule `json:"typecodes"`
+	hashKey   []byte
+}
+
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+//parseRedactionPath splits a path into its segments. An array index of -1 is [*].
+func parseRedactionPath(path string) ([]pathSegment, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, ErrMalformedRedactionPath
+	}
+
+	var segments []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+			part = part[i:]
+		} else {
+			part = ""
+		}
+
+		if strings.Contains(key, "]") {
+			return nil, ErrMalformedRedactionPath
+		}
+
+		if key != "" {
+			segments = append(segments, pathSegment{key: key})
+		} else if part == "" {
+			return nil, ErrMalformedRedactionPath
+		}
+
+		for part != "" {
+			end := strings.Index(part, "]")
+			if !strings.HasPrefix(part, "[") || end < 0 {
+				return nil, ErrMalformedRedactionPath
+			}
+
+			index := -1
+			if part[1:end] != "*" {
+				var err error
+				index, err = strconv.Atoi(part[1:end])
+				if err != nil || index < 0 {
+					return nil, ErrMalformedRedactionPath
+				}
+			}
+
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+			part = part[end+1:]
+		}
+	}
+
+	return segments, nil
+}
+
+//LoadRedactionPolicy reads a redaction policy
+func LoadRedactionPolicy(r io.Reader) (*RedactionPolicy, error) {
+	var policy RedactionPolicy
+	if err := json.NewDecoder(r).Decode(&policy); err != nil {
+		return nil, err
+	}
+
+	for typeCode, rules := range policy.TypeCodes {
+		for _, rule := range rules {
+			if rule == nil {
+				return nil, fmt.Errorf("%s: %s", typeCode, ErrMalformedRedactionPath.Error())
+			}
+
+			switch rule.Action {
+			case DropAction, MaskAction, HashAction:
+			default:
+				return nil, fmt.Errorf("%s %s: %s", typeCode, rule.Path, ErrUnknownRedactionAction.Error())
+			}
+
+			segments, err := parseRedactionPath(rule.Path)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %s", typeCode, rule.Path, err.Error())
+			}
+			rule.segments = segments
+		}
+	}
+
+	return &policy, nil
+}
+
+//NewRedactionPolicy reads the redaction policy named by REDACTION_POLICY_FILE. It returns nil
+//if no policy is configured.
+func NewRedactionPolicy(env *envinject.InjectedEnv) (*RedactionPolicy, error) {
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	policyFile := env.Getenv(RedactionPolicyEnv)
+	if policyFile == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy, err := LoadRedactionPolicy(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if key := env.Getenv(RedactionHashKey); key != "" {
+		policy.hashKey = []byte(key)
+	}
+
+	return policy, nil
+}
+
+//redaction is the set of rules of the policy that apply to a consumer
+type redaction struct {
+	rules   map[string][]*RedactionRule
+	hashKey []byte
+	id      string
+}
+
+func (r *RedactionRule) appliesTo(consumer string) bool {
+	for _, except := range r.Except {
+		if except == consumer {
+			return false
+		}
+	}
+
+	if len(r.Consumers) == 0 {
+		return true
+	}
+
+	for _, c := range r.Consumers {
+		if c == consumer {
+			return true
+		}
+	}
+
+	return false
+}
+
+//forConsumer returns the redaction for the consumer, which is nil if no rules apply. The
+//redaction id identifies the rules and the hash key, so consumers they apply to alike share
+//cached pages, and pages cached under a policy that has since changed aren't served.
+func (p *RedactionPolicy) forConsumer(consumer string) *redaction {
+	if p == nil {
+		return nil
+	}
+
+	//Typecodes are hashed in order so the id is the same for every request
+	typeCodes := make([]string, 0, len(p.TypeCodes))
+	for typeCode := range p.TypeCodes {
+		typeCodes = append(typeCodes, typeCode)
+	}
+	sort.Strings(typeCodes)
+
+	r := &redaction{rules: make(map[string][]*RedactionRule), hashKey: p.hashKey}
+	h := fnv.New64a()
+	for _, typeCode := range typeCodes {
+		for _, rule := range p.TypeCodes[typeCode] {
+			if rule.appliesTo(consumer) {
+				r.rules[typeCode] = append(r.rules[typeCode], rule)
+				fmt.Fprintf(h, "%q\n%q\n%q\n%q\n%q\n",
+					typeCode, rule.Path, rule.Action, rule.Consumers, rule.Except)
+			}
+		}
+	}
+
+	if len(r.rules) == 0 {
+		return nil
+	}
+
+	//The key itself isn't hashed into the id, only a fingerprint of it
+	if p.hashKey != nil {
+		fingerprint := sha256.Sum256(p.hashKey)
+		fmt.Fprintf(h, "key\n%x\n", fingerprint)
+	}
+
+	r.id = fmt.Sprintf("%x", h.Sum64())
+	return r
+}
+
+//forRequest returns the redaction applying to the consumer making the request
+func (p *RedactionPolicy) forRequest(req *http.Request) *redaction {
+	return p.forConsumer(ConsumerID(req))
+}
+
+//key identifies the redaction, and is empty when no rules apply
+func (r *redaction) key() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.id
+}
+
+//payload returns the event payload with the rules for its typecode applied. If there are rules
+//but the payload can't be redacted, it's withheld rather than served as is.
+func (r *redaction) payload(event atomdata.TimestampedEvent) []byte {
+	payload := event.Payload.([]byte)
+	if r == nil || len(r.rules[event.TypeCode]) == 0 {
+		return payload
+	}
+
+	redacted, err := r.redact(r.rules[event.TypeCode], payload)
+	if err != nil {
+		log.Warnf("Withholding payload of %s: %s", entryID(event), err.Error())
+		return []byte{}
+	}
+
+	return redacted
+}
+
+func (r *redaction) redact(rules []*RedactionRule, payload []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, ErrUnredactablePayload
+	}
+
+	//Content after the first value would go out unredacted, so the payload must be one value
+	if err := decoder.Decode(new(interface{})); err != io.EOF {
+		return nil, ErrUnredactablePayload
+	}
+
+	for _, rule := range rules {
+		doc, _ = r.apply(rule, doc, rule.segments)
+	}
+
+	return json.Marshal(doc)
+}
+
+//apply applies the rule to the fields of the node at the path, returning the redacted node and
+//whether anything was redacted
+func (r *redaction) apply(rule *RedactionRule, node interface{}, path []pathSegment) (interface{}, bool) {
+	if len(path) == 0 {
+		return node, false
+	}
+
+	seg, rest := path[0], path[1:]
+	changed := false
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if seg.isIndex {
+			return node, false
+		}
+
+		for k, v := range n {
+			if seg.key != "*" && seg.key != k {
+				continue
+			}
+
+			if len(rest) == 0 {
+				if rule.Action == DropAction {
+					delete(n, k)
+				} else {
+					n[k] = r.replace(rule, v)
+				}
+				changed = true
+				continue
+			}
+
+			var c bool
+			n[k], c = r.apply(rule, v, rest)
+			changed = changed || c
+		}
+
+		return n, changed
+
+	case []interface{}:
+		if !seg.isIndex && seg.key != "*" {
+			return node, false
+		}
+
+		result := make([]interface{}, 0, len(n))
+		for i, v := range n {
+			if seg.isIndex && seg.index >= 0 && seg.index != i {
+				result = append(result, v)
+				continue
+			}
+
+			if len(rest) == 0 {
+				changed = true
+				if rule.Action != DropAction {
+					result = append(result, r.replace(rule, v))
+				}
+				continue
+			}
+
+			var c bool
+			v, c = r.apply(rule, v, rest)
+			changed = changed || c
+			result = append(result, v)
+		}
+
+		return result, changed
+	}
+
+	return node, false
+}
+
+//replace returns the masked or hashed value. Strings are hashed as is, other values as JSON.
+func (r *redaction) replace(rule *RedactionRule, value interface{}) interface{} {
+	if rule.Action == MaskAction {
+		return RedactionMask
+	}
+
+	var h hash.Hash
+	if r.hashKey != nil {
+		h = hmac.New(sha256.New, r.hashKey)
+	} else {
+		h = sha256.New()
+	}
+
+	if s, ok := value.(string); ok {
+		h.Write([]byte(s))
+	} else {
+		b, _ := json.Marshal(value)
+		h.Write(b)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,375 @@
+package esatompubpg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/goes"
+)
+
+func TestParseRedactionPath(t *testing.T) {
+	var pathTests = []struct {
+		path     string
+		expected []pathSegment
+	}{
+		{"email", []pathSegment{{key: "email"}}},
+		{"$.customer.email", []pathSegment{{key: "customer"}, {key: "email"}}},
+		{"items[*].card", []pathSegment{{key: "items"}, {index: -1, isIndex: true}, {key: "card"}}},
+		{"items[2]", []pathSegment{{key: "items"}, {index: 2, isIndex: true}}},
+		{"$[0].*", []pathSegment{{index: 0, isIndex: true}, {key: "*"}}},
+		{"grid[1][*]", []pathSegment{{key: "grid"}, {index: 1, isIndex: true}, {index: -1, isIndex: true}}},
+	}
+
+	for _, test := range pathTests {
+		segments, err := parseRedactionPath(test.path)
+		assert.Nil(t, err, test.path)
+		assert.Equal(t, test.expected, segments, test.path)
+	}
+
+	for _, path := range []string{"", "$", "a..b", "items[", "items[x]", "items[-1]", "items]"} {
+		_, err := parseRedactionPath(path)
+		assert.Equal(t, ErrMalformedRedactionPath, err, path)
+	}
+}
+
+func TestLoadRedactionPolicy(t *testing.T) {
+	_, err := LoadRedactionPolicy(strings.NewReader(`{"typecodes": {"A": [{"path": "a", "action": "encrypt"}]}}`))
+	assert.NotNil(t, err)
+	_, err = LoadRedactionPolicy(strings.NewReader(`{"typecodes": {"A": [{"path": "a[", "action": "drop"}]}}`))
+	assert.NotNil(t, err)
+	_, err = LoadRedactionPolicy(strings.NewReader(`{"typecodes": `))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, (*RedactionPolicy)(nil).forConsumer("billing"))
+
+	policy, err := LoadRedactionPolicy(strings.NewReader(`{"typecodes": {
+		"A": [{"path": "a", "action": "drop"}, {"path": "b", "action": "mask", "consumers": ["partner"]}],
+		"B": [{"path": "c", "action": "hash", "except": ["audit"]}]
+	}}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	everyone := policy.forConsumer("")
+	partner := policy.forConsumer("partner")
+	audit := policy.forConsumer("audit")
+	assert.Equal(t, 1, len(everyone.rules["A"]))
+	assert.Equal(t, 2, len(partner.rules["A"]))
+	assert.Equal(t, 0, len(audit.rules["B"]))
+	assert.Equal(t, everyone.key(), policy.forConsumer("billing").key())
+	assert.NotEqual(t, everyone.key(), partner.key())
+	assert.NotEqual(t, everyone.key(), audit.key())
+}
+
+func redactionEvent(typeCode string, version int, payload string) atomdata.TimestampedEvent {
+	return atomdata.TimestampedEvent{
+		Event: goes.Event{
+			Source:   "customer-1",
+			Version:  version,
+			TypeCode: typeCode,
+			Payload:  []byte(payload),
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	policy, err := LoadRedactionPolicy(strings.NewReader(`{"typecodes": {"CustomerCreated": [
+		{"path": "customer.ssn", "action": "drop"},
+		{"path": "customer.email", "action": "mask"},
+		{"path": "customer.phone", "action": "hash"},
+		{"path": "cards[*].number", "action": "mask"},
+		{"path": "cards[1]", "action": "drop"},
+		{"path": "notes.*", "action": "mask"},
+		{"path": "missing.field", "action": "drop"}
+	]}}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	r := policy.forConsumer("")
+	redacted := r.payload(redactionEvent("CustomerCreated", 1, `{
+		"customer": {"name": "Alice", "ssn": "123-45-6789", "email": "alice@example.com", "phone": "555-0100", "age": 42},
+		"cards": [{"number": "4111111111111111", "expiry": "12/30"}, {"number": "5500000000000004"}],
+		"notes": {"a": "secret note", "b": {"c": "secret"}}
+	}`))
+
+	var doc map[string]interface{}
+	if !assert.Nil(t, json.Unmarshal(redacted, &doc), string(redacted)) {
+		return
+	}
+
+	h := sha256.Sum256([]byte("555-0100"))
+	assert.Equal(t, map[string]interface{}{
+		"customer": map[string]interface{}{
+			"name":  "Alice",
+			"email": RedactionMask,
+			"phone": hex.EncodeToString(h[:]),
+			"age":   float64(42),
+		},
+		"cards": []interface{}{
+			map[string]interface{}{"number": RedactionMask, "expiry": "12/30"},
+		},
+		"notes": map[string]interface{}{"a": RedactionMask, "b": RedactionMask},
+	}, doc)
+
+	//Values are hashed with HMAC when there's a hash key
+	r.hashKey = []byte("key")
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("555-0100"))
+	assert.Equal(t, `{"customer":{"phone":"`+hex.EncodeToString(mac.Sum(nil))+`"}}`,
+		string(r.payload(redactionEvent("CustomerCreated", 1, `{"customer":{"phone":"555-0100"}}`))))
+
+	//Payloads with rules are re-encoded even with nothing to redact, and those without are served as is
+	assert.Equal(t, `{"customer":{"name":"Alice"}}`, string(r.payload(redactionEvent("CustomerCreated", 1, `{ "customer": {"name": "Alice"} }`))))
+	assert.Equal(t, `{"ssn": "123-45-6789"}`, string(r.payload(redactionEvent("Other", 1, `{"ssn": "123-45-6789"}`))))
+
+	//Payloads that can't be redacted are withheld
+	assert.Equal(t, "", string(r.payload(redactionEvent("CustomerCreated", 1, `ssn=123-45-6789`))))
+}
+
+func TestRedactPayloadWithTrailingContent(t *testing.T) {
+	policy, err := LoadRedactionPolicy(strings.NewReader(`{"typecodes": {"CustomerCreated": [
+		{"path": "ssn", "action": "drop"}
+	]}}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	r := policy.forConsumer("")
+	for _, payload := range []string{
+		`{"a":1}{"ssn":"123-45-6789"}`,
+		`{"ssn":"123-45-6789"}{"ssn":"123-45-6789"}`,
+		`{"a":1} trailing`,
+	} {
+		_, err := r.redact(r.rules["CustomerCreated"], []byte(payload))
+		assert.Equal(t, ErrUnredactablePayload, err, payload)
+		assert.Equal(t, "", string(r.payload(redactionEvent("CustomerCreated", 1, payload))), payload)
+	}
+
+	//Trailing whitespace is fine
+	assert.Equal(t, `{"a":1}`, string(r.payload(redactionEvent("CustomerCreated", 1, "{\"a\":1,\"ssn\":\"123-45-6789\"}\n"))))
+}
+
+func TestRedactionKeyChangesWithPolicy(t *testing.T) {
+	load := func(policy string, hashKey string) string {
+		p, err := LoadRedactionPolicy(strings.NewReader(policy))
+		if !assert.Nil(t, err, policy) {
+			return ""
+		}
+		if hashKey != "" {
+			p.hashKey = []byte(hashKey)
+		}
+		return p.forConsumer("partner").key()
+	}
+
+	base := load(`{"typecodes": {"A": [{"path": "a", "action": "hash"}]}}`, "")
+	assert.Equal(t, base, load(`{"typecodes": {"A": [{"path": "a", "action": "hash"}]}}`, ""))
+
+	keys := []string{
+		base,
+		load(`{"typecodes": {"A": [{"path": "b", "action": "hash"}]}}`, ""),
+		load(`{"typecodes": {"A": [{"path": "a", "action": "mask"}]}}`, ""),
+		load(`{"typecodes": {"B": [{"path": "a", "action": "hash"}]}}`, ""),
+		load(`{"typecodes": {"A": [{"path": "a", "action": "hash", "consumers": ["partner"]}]}}`, ""),
+		load(`{"typecodes": {"A": [{"path": "a", "action": "hash", "except": ["audit"]}]}}`, ""),
+		load(`{"typecodes": {"A": [{"path": "a", "action": "hash"}]}}`, "key1"),
+		load(`{"typecodes": {"A": [{"path": "a", "action": "hash"}]}}`, "key2"),
+	}
+
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			assert.NotEqual(t, keys[i], keys[j], "%d %d", i, j)
+		}
+	}
+}
+
+func TestHandlersWithRedaction(t *testing.T) {
+	policyFile, err := ioutil.TempFile("", "redaction")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.Remove(policyFile.Name())
+	policyFile.WriteString(`{"typecodes": {"CustomerCreated": [
+		{"path": "ssn", "action": "drop"},
+		{"path": "email", "action": "mask", "except": ["support"]}
+	]}}`)
+	policyFile.Close()
+
+	os.Setenv(RedactionPolicyEnv, policyFile.Name())
+	defer os.Unsetenv(RedactionPolicyEnv)
+
+	const ssn = "123-45-6789"
+	const email = "alice@example.com"
+	payload := `{"name": "Alice", "ssn": "` + ssn + `", "email": "` + email + `"}`
+
+	store := NewMemoryFeedStore()
+	store.Add(redactionEvent("CustomerCreated", 1, payload))
+	store.CreateFeed("feed1")
+	store.Add(redactionEvent("CustomerCreated", 2, payload))
+
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	recentHandler, _ := NewRecentHandler(store, "testhost:12345", env, ae)
+	archiveHandler, _ := NewArchiveHandler(store, "testhost:12345", env, ae)
+	eventHandler, _ := NewEventRetrieveHandler(store, env, ae)
+	aggregateHandler, _ := NewAggregateRetrieveHandler(store, "testhost:12345", env, ae)
+	streamHandler, _ := NewStreamHandler(store, "testhost:12345", env, ae, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, recentHandler)
+	router.HandleFunc(StreamHandlerURI, streamHandler)
+	router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+	router.HandleFunc(RetrieveEventHanderURI, eventHandler)
+	router.HandleFunc(RetrieveAggregateHandlerURI, aggregateHandler)
+
+	a := new(Authenticator)
+	a.SetAPIKeys(map[string]string{"partner": "partner-key", "support": "support-key"})
+	handler := a.Middleware(router)
+
+	get := func(uri string, key string, accept string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r, _ := http.NewRequest("GET", uri, nil)
+		r = r.WithContext(ctx)
+		r.Header.Set(APIKeyHeader, key)
+		r.Header.Set("Last-Event-ID", "urn:esid:customer-1:1")
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode, uri)
+		return w
+	}
+
+	//payloads returns the response body followed by the decoded payloads in it
+	payloads := func(uri string, w *httptest.ResponseRecorder) []string {
+		body := w.Body.Bytes()
+		decoded := []string{string(body)}
+		decode := func(content string) {
+			p, err := base64.StdEncoding.DecodeString(content)
+			assert.Nil(t, err)
+			decoded = append(decoded, string(p))
+		}
+
+		unmarshal := func(v interface{}) {
+			if isJSONMediaType(w.Header().Get("Content-Type")) {
+				assert.Nil(t, json.Unmarshal(body, v), uri)
+			} else {
+				assert.Nil(t, xml.Unmarshal(body, v), uri)
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(uri, "/notifications/stream"):
+			_, data := streamedEvents(string(body))
+			for _, d := range data {
+				var entry Entry
+				if assert.Nil(t, xml.Unmarshal([]byte(d), &entry)) {
+					decode(entry.Content.Body)
+				}
+			}
+		case strings.HasPrefix(uri, "/notifications/"):
+			if isJSONMediaType(w.Header().Get("Content-Type")) {
+				var jsonFeed JSONFeed
+				unmarshal(&jsonFeed)
+				for _, item := range jsonFeed.Items {
+					decode(item.ContentText)
+				}
+			} else {
+				var feed Feed
+				unmarshal(&feed)
+				for _, entry := range feed.Entry {
+					decode(entry.Content.Body)
+				}
+			}
+		case strings.Count(uri, "/") == 3:
+			var event EventStoreContent
+			unmarshal(&event)
+			decode(event.Content)
+		default:
+			var page AggregateEvents
+			unmarshal(&page)
+			for _, event := range page.Events {
+				decode(event.Content)
+			}
+		}
+
+		assert.True(t, len(decoded) > 1, uri)
+		return decoded
+	}
+
+	uris := []string{
+		"/notifications/recent",
+		"/notifications/feed1",
+		"/notifications/stream",
+		"/events/customer-1/1",
+		"/events/customer-1",
+	}
+
+	//The dropped field never appears, and the masked field only for the excepted consumer
+	for _, uri := range uris {
+		for _, accept := range []string{"", JSONContentType} {
+			for _, p := range payloads(uri, get(uri, "partner-key", accept)) {
+				assert.False(t, strings.Contains(p, ssn), uri)
+				assert.False(t, strings.Contains(p, email), uri)
+			}
+
+			supportPayloads := payloads(uri, get(uri, "support-key", accept))
+			for _, p := range supportPayloads {
+				assert.False(t, strings.Contains(p, ssn), uri)
+			}
+			assert.True(t, strings.Contains(supportPayloads[1], email), uri)
+			assert.True(t, strings.Contains(supportPayloads[1], "Alice"), uri)
+		}
+	}
+
+	//Archive pages and events redacted differently have their own tags and cache entries
+	partnerETag := get("/notifications/feed1", "partner-key", "").Header().Get("ETag")
+	supportETag := get("/notifications/feed1", "support-key", "").Header().Get("ETag")
+	assert.NotEqual(t, `"feed1"`, partnerETag)
+	assert.NotEqual(t, partnerETag, supportETag)
+	assert.NotEqual(t,
+		get("/events/customer-1/1", "partner-key", "").Header().Get("ETag"),
+		get("/events/customer-1/1", "support-key", "").Header().Get("ETag"))
+}
+
+func TestHandlersWithMissingRedactionPolicy(t *testing.T) {
+	os.Setenv(RedactionPolicyEnv, "/no/such/redaction.json")
+	defer os.Unsetenv(RedactionPolicyEnv)
+
+	store := NewMemoryFeedStore()
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	//A policy that can't be read fails the handlers rather than serving payloads unredacted
+	_, err := NewRecentHandler(store, "testhost:12345", env, ae)
+	assert.NotNil(t, err)
+	_, err = NewArchiveHandler(store, "testhost:12345", env, ae)
+	assert.NotNil(t, err)
+	_, err = NewEventRetrieveHandler(store, env, ae)
+	assert.NotNil(t, err)
+	_, err = NewAggregateRetrieveHandler(store, "testhost:12345", env, ae)
+	assert.NotNil(t, err)
+	_, err = NewStreamHandler(store, "testhost:12345", env, ae, nil)
+	assert.NotNil(t, err)
+}
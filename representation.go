@@ -0,0 +1,300 @@
+package esatompubpg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/blog/atom"
+)
+
+//Content types for the supported representations. Feeds default to atom, events default to
+//xml; JSON representations are returned when preferred by the Accept header.
+const (
+	AtomContentType     = "application/atom+xml"
+	JSONFeedContentType = "application/feed+json"
+	XMLContentType      = "application/xml"
+	JSONContentType     = "application/json"
+	JSONFeedVersion     = "https://jsonfeed.org/version/1.1"
+)
+
+var feedContentTypes = []string{AtomContentType, JSONFeedContentType, JSONContentType}
+var eventContentTypes = []string{XMLContentType, JSONContentType}
+
+//FeedHistoryNamespace is the namespace of the RFC 5005 feed history elements, and
+//TypeCodeScheme the scheme of the atom category giving the typecode of an entry's event
+const (
+	FeedHistoryNamespace = "http://purl.org/syndication/history/1.0"
+	TypeCodeScheme       = "urn:esid:typecode"
+)
+
+//Feed is an atom feed document. It follows atom.Feed, adding the fh:archive element, which
+//RFC 5005 requires of archive documents so consumers know their contents won't change,
+//the encryption key of pages whose entries are encrypted, and entries that can carry
+//categories and inline XML content.
+type Feed struct {
+	XMLName       xml.Name       `xml:"http://www.w3.org/2005/Atom feed"`
+	Archive       *struct{}      `xml:"http://purl.org/syndication/history/1.0 archive"`
+	EncryptionKey *EncryptionKey `xml:"http://github.com/xtracdev/es-atom-pub-pg/encryption encryptionKey"`
+	Title         string         `xml:"title"`
+	ID            string         `xml:"id"`
+	Link          []atom.Link    `xml:"link"`
+	Updated       atom.TimeStr   `xml:"updated"`
+	Author        *atom.Person   `xml:"author"`
+	Entry         []*Entry       `xml:"entry"`
+}
+
+//Entry is an atom entry for an event. The event typecode is given as a category with the
+//TypeCodeScheme scheme. Entries sent on the event stream in entry encryption mode carry the
+//encryption key of their content, which feed pages give for all their entries.
+type Entry struct {
+	EncryptionKey *EncryptionKey `xml:"http://github.com/xtracdev/es-atom-pub-pg/encryption encryptionKey"`
+	Title         string         `xml:"title"`
+	ID            string         `xml:"id"`
+	Link          []atom.Link    `xml:"link"`
+	Published     atom.TimeStr   `xml:"published"`
+	Updated       atom.TimeStr   `xml:"updated"`
+	Author        *atom.Person   `xml:"author"`
+	Category      []Category     `xml:"category"`
+	Content       *Content       `xml:"content"`
+}
+
+type Category struct {
+	Term   string `xml:"term,attr"`
+	Scheme string `xml:"scheme,attr,omitempty"`
+}
+
+//Content is the content of an entry, with the media type of the rendered event payload. XML
+//content is inline, other content is text, base64 encoded unless it's a text media type.
+//Encrypted content is application/octet-stream, with the media type of the plaintext given
+//by the contentType attribute in the encryption namespace.
+type Content struct {
+	Type          string `xml:"type,attr"`
+	EncryptedType string `xml:"http://github.com/xtracdev/es-atom-pub-pg/encryption contentType,attr,omitempty"`
+	Body          string `xml:",chardata"`
+	XML           string `xml:",innerxml"`
+}
+
+//TypeCode returns the typecode of the entry's event, or the empty string if the entry has no
+//typecode category, as with entries produced by earlier versions.
+func (e *Entry) TypeCode() string {
+	for _, category := range e.Category {
+		if category.Scheme == TypeCodeScheme {
+			return category.Term
+		}
+	}
+
+	return ""
+}
+
+//Payload returns the rendered payload carried by the content
+func (c *Content) Payload() ([]byte, error) {
+	switch {
+	case isXMLMediaType(c.Type):
+		return []byte(c.XML), nil
+	case strings.HasPrefix(c.Type, "text/"):
+		return []byte(c.Body), nil
+	default:
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(c.Body))
+	}
+}
+
+//JSONFeed is the JSON Feed 1.1 representation of a feed page. JSON Feed has no notion of feed
+//ids or archive link relations, so these are carried in the _atom extension object.
+//Following JSON Feed conventions, next_url refers to the page of older items, which is the
+//prev-archive page.
+type JSONFeed struct {
+	Version string            `json:"version"`
+	Title   string            `json:"title"`
+	FeedURL string            `json:"feed_url,omitempty"`
+	NextURL string            `json:"next_url,omitempty"`
+	Atom    JSONFeedExtension `json:"_atom"`
+	Items   []JSONFeedItem    `json:"items"`
+}
+
+//JSONFeedExtension carries the atom feed id, updated timestamp and link relations, whether
+//the page is an immutable archive, and the key the item content is encrypted with, if it is
+type JSONFeedExtension struct {
+	ID            string         `json:"id"`
+	Updated       string         `json:"updated,omitempty"`
+	Archive       bool           `json:"archive,omitempty"`
+	EncryptionKey *EncryptionKey `json:"encryption_key,omitempty"`
+	Links         []JSONLink     `json:"links"`
+}
+
+type JSONLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+//JSONFeedItem is a feed entry. The content text is the rendered event payload, base64 encoded
+//unless it's text, JSON or XML, and the event typecode and the media type of the content are
+//given in the _atom extension object, along with JSON content as is.
+type JSONFeedItem struct {
+	ID            string                `json:"id"`
+	URL           string                `json:"url,omitempty"`
+	Title         string                `json:"title,omitempty"`
+	ContentText   string                `json:"content_text"`
+	DatePublished string                `json:"date_published,omitempty"`
+	Atom          JSONFeedItemExtension `json:"_atom"`
+}
+
+type JSONFeedItemExtension struct {
+	TypeCode             string          `json:"typecode,omitempty"`
+	ContentType          string          `json:"content_type"`
+	EncryptedContentType string          `json:"encrypted_content_type,omitempty"`
+	Content              json.RawMessage `json:"content,omitempty"`
+}
+
+//NewJSONFeed converts an atom feed to its JSON Feed representation
+func NewJSONFeed(feed *Feed) *JSONFeed {
+	jsonFeed := &JSONFeed{
+		Version: JSONFeedVersion,
+		Title:   feed.Title,
+		Atom: JSONFeedExtension{
+			ID:            feed.ID,
+			Updated:       string(feed.Updated),
+			Archive:       feed.Archive != nil,
+			EncryptionKey: feed.EncryptionKey,
+			Links:         []JSONLink{},
+		},
+		Items: []JSONFeedItem{},
+	}
+
+	for _, l := range feed.Link {
+		jsonFeed.Atom.Links = append(jsonFeed.Atom.Links, JSONLink{Rel: l.Rel, Href: l.Href})
+
+		switch l.Rel {
+		case "self":
+			jsonFeed.FeedURL = l.Href
+		case "prev-archive":
+			jsonFeed.NextURL = l.Href
+		}
+	}
+
+	for _, entry := range feed.Entry {
+		item := JSONFeedItem{
+			ID:            entry.ID,
+			Title:         entry.Title,
+			DatePublished: string(entry.Published),
+			Atom: JSONFeedItemExtension{
+				TypeCode: entry.TypeCode(),
+			},
+		}
+
+		for _, l := range entry.Link {
+			if l.Rel == "self" {
+				item.URL = l.Href
+			}
+		}
+
+		if entry.Content != nil {
+			item.ContentText = entry.Content.Body
+			item.Atom.ContentType = entry.Content.Type
+			item.Atom.EncryptedContentType = entry.Content.EncryptedType
+
+			switch {
+			case isXMLMediaType(entry.Content.Type):
+				item.ContentText = entry.Content.XML
+			case isJSONMediaType(entry.Content.Type):
+				if payload, err := entry.Content.Payload(); err == nil {
+					item.ContentText = string(payload)
+					item.Atom.Content = json.RawMessage(payload)
+				}
+			}
+		}
+
+		jsonFeed.Items = append(jsonFeed.Items, item)
+	}
+
+	return jsonFeed
+}
+
+//marshalFeed renders the feed in the representation indicated by the content type
+func marshalFeed(feed *Feed, contentType string) ([]byte, error) {
+	if contentType == AtomContentType {
+		return xml.Marshal(feed)
+	}
+
+	return json.Marshal(NewJSONFeed(feed))
+}
+
+//marshalEvent renders the event in the representation indicated by the content type
+func marshalEvent(event *EventStoreContent, contentType string) ([]byte, error) {
+	if contentType == XMLContentType {
+		return xml.Marshal(event)
+	}
+
+	return json.Marshal(event)
+}
+
+//negotiateContentType returns the offered content type most preferred by the request's Accept
+//header. Ties go to the earliest offer, and the first offer is returned when the request
+//does not indicate a preference for any of the offers.
+func negotiateContentType(req *http.Request, offers []string) string {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best := offers[0]
+	bestQ := -1.0
+
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best = offer
+			bestQ = q
+		}
+	}
+
+	if bestQ <= 0 {
+		return offers[0]
+	}
+
+	return best
+}
+
+//acceptQuality returns the quality value the Accept header assigns to the given content type,
+//using the most specific matching media range.
+func acceptQuality(accept string, contentType string) float64 {
+	q := 0.0
+	specificity := -1
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch {
+		case mediaType == contentType:
+			s = 2
+		case mediaType == "*/*":
+			s = 0
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")):
+			s = 1
+		default:
+			continue
+		}
+
+		if s <= specificity {
+			continue
+		}
+
+		specificity = s
+		q = 1.0
+		if qval, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qval, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+
+	return q
+}
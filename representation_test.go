@@ -0,0 +1,131 @@
+package esatompubpg
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	var negotiateTests = []struct {
+		accept   string
+		expected string
+	}{
+		{"", AtomContentType},
+		{"*/*", AtomContentType},
+		{"application/atom+xml", AtomContentType},
+		{"application/json", JSONContentType},
+		{"application/feed+json", JSONFeedContentType},
+		{"application/*", AtomContentType},
+		{"text/html", AtomContentType},
+		{"application/atom+xml;q=0.5, application/feed+json", JSONFeedContentType},
+		{"application/json;q=0.9, application/atom+xml;q=0.8", JSONContentType},
+		{"application/json, */*;q=0.1", JSONContentType},
+		{"application/atom+xml;q=0, */*", JSONFeedContentType},
+		{"garbage;;;", AtomContentType},
+	}
+
+	for _, test := range negotiateTests {
+		r, _ := http.NewRequest("GET", RecentHandlerURI, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		assert.Equal(t, test.expected, negotiateContentType(r, feedContentTypes), test.accept)
+	}
+}
+
+func newTestArchiveMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	mock.ExpectQuery("select event_time").WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+			AddRow([]driver.Value{time.Now(), "1x2x333", 3, "foo", []byte("yeah ok")}...),
+	)
+	mock.ExpectQuery("select previous").WillReturnRows(sqlmock.NewRows([]string{"previous"}).AddRow("prev-xxx"))
+	mock.ExpectQuery("select feedid").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("next-xxx"))
+
+	return db, mock
+}
+
+func TestArchiveHandlerJSON(t *testing.T) {
+	defer os.Unsetenv(LocalKey)
+	os.Unsetenv(KeyAlias)
+
+	for _, encrypted := range []bool{false, true} {
+		if encrypted {
+			os.Setenv(LocalKey, base64.StdEncoding.EncodeToString(testMasterKey))
+		}
+
+		db, mock := newTestArchiveMock(t)
+
+		env, _ := envinject.NewInjectedEnv()
+		ae, _ := NewAtomEncrypter(env)
+		archiveHandler, err := NewArchiveHandler(pgFeedStore(t, db), "testhost:12345", env, ae)
+		if !assert.Nil(t, err) {
+			db.Close()
+			return
+		}
+
+		router := mux.NewRouter()
+		router.HandleFunc(ArchiveHandlerURI, archiveHandler)
+
+		r, _ := http.NewRequest("GET", "/notifications/foo", nil)
+		r.Header.Set("Accept", "application/feed+json")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, JSONFeedContentType, w.Header().Get("Content-Type"))
+		assert.Equal(t, "Accept, Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, "max-age=2592000", w.Header().Get("Cache-Control"))
+
+		body := w.Body.Bytes()
+		if encrypted {
+			kp, _ := NewLocalKeyProvider(testMasterKey)
+			body = decryptTestOutput(t, kp, body)
+		}
+
+		var feed JSONFeed
+		err = json.Unmarshal(body, &feed)
+		if assert.Nil(t, err) {
+			assert.Equal(t, JSONFeedVersion, feed.Version)
+			assert.Equal(t, "foo", feed.Atom.ID)
+			assert.True(t, feed.Atom.Archive)
+			assert.Equal(t, "https://testhost:12345/notifications/foo", feed.FeedURL)
+			assert.Equal(t, "https://testhost:12345/notifications/prev-xxx", feed.NextURL)
+			assert.Equal(t, []JSONLink{
+				{Rel: "self", Href: "https://testhost:12345/notifications/foo"},
+				{Rel: "current", Href: "https://testhost:12345/notifications/recent"},
+				{Rel: "prev-archive", Href: "https://testhost:12345/notifications/prev-xxx"},
+				{Rel: "next-archive", Href: "https://testhost:12345/notifications/next-xxx"},
+			}, feed.Atom.Links)
+
+			if assert.Equal(t, 1, len(feed.Items)) {
+				item := feed.Items[0]
+				assert.Equal(t, "urn:esid:1x2x333:3", item.ID)
+				assert.Equal(t, "https://testhost:12345/events/1x2x333/3", item.URL)
+				assert.Equal(t, "foo", item.Atom.TypeCode)
+				assert.Equal(t, OctetStreamContentType, item.Atom.ContentType)
+				assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("yeah ok")), item.ContentText)
+			}
+		}
+
+		assert.Nil(t, mock.ExpectationsWereMet())
+		db.Close()
+	}
+}
@@ -0,0 +1,27 @@
+-- Notifies listeners on the es_atom_pub channel when events are added to the atom
+-- event table or a feed is created, for use by PGNotifier. Notifications are sent once
+-- per statement, with a payload of events or feed. Safe to run more than once.
+
+create or replace function f_aeae_notify_events() returns trigger as $$
+begin
+    perform pg_notify('es_atom_pub', 'events');
+    return null;
+end;
+$$ language plpgsql;
+
+create or replace function f_aefd_notify_feed() returns trigger as $$
+begin
+    perform pg_notify('es_atom_pub', 'feed');
+    return null;
+end;
+$$ language plpgsql;
+
+drop trigger if exists tr_aeae_notify_events on t_aeae_atom_event;
+create trigger tr_aeae_notify_events
+    after insert on t_aeae_atom_event
+    for each statement execute procedure f_aeae_notify_events();
+
+drop trigger if exists tr_aefd_notify_feed on t_aefd_feed;
+create trigger tr_aefd_notify_feed
+    after insert on t_aefd_feed
+    for each statement execute procedure f_aefd_notify_feed();
@@ -0,0 +1,524 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtracdev/envinject"
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+)
+
+var ErrUnknownEventID = errors.New("Unknown event id")
+var ErrStreamingNotSupported = errors.New("Response writer does not support streaming")
+
+//StreamHandlerURI is the URI of the server-sent events stream. Note it must be registered ahead
+//of ArchiveHandlerURI, which would otherwise match it.
+//New entries are polled for every STREAM_POLL_INTERVAL (a duration such as 500ms), which
+//defaults to DefaultStreamPollInterval.
+const (
+	StreamHandlerURI          = "/notifications/stream"
+	StreamPollInterval        = "STREAM_POLL_INTERVAL"
+	DefaultStreamPollInterval = time.Second
+	streamKeepAliveInterval   = 15 * time.Second
+)
+
+//streamPosition identifies the last entry sent to a client, and the archive containing it. The
+//feed id is empty when the entry is in the recent page, or when nothing has been sent from an
+//empty event store.
+type streamPosition struct {
+	feedID  string
+	entryID string
+}
+
+//eventStreamWriter writes server-sent events, deferring the response headers until the stream
+//is started so errors found before then can be reported with an error status. The stream is
+//compressed with the given content coding, flushing the compressor with each event.
+type eventStreamWriter struct {
+	rw         http.ResponseWriter
+	out        io.Writer
+	flusher    http.Flusher
+	encoding   string
+	compressor flushWriter
+	started    bool
+	lastWrite  time.Time
+}
+
+func newEventStreamWriter(rw http.ResponseWriter, encoding string) (*eventStreamWriter, error) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+
+	return &eventStreamWriter{rw: rw, out: rw, flusher: flusher, encoding: encoding}, nil
+}
+
+func (w *eventStreamWriter) start() {
+	if w.started {
+		return
+	}
+
+	w.started = true
+	w.rw.Header().Set("Content-Type", "text/event-stream")
+	w.rw.Header().Set("Cache-Control", "no-store")
+	w.rw.Header().Set("Vary", "Accept-Encoding")
+	if w.compressor = newStreamCompressor(w.encoding, w.rw); w.compressor != nil {
+		setContentEncoding(w.rw, w.encoding)
+		w.out = w.compressor
+	}
+	w.rw.WriteHeader(http.StatusOK)
+	w.flush()
+}
+
+func (w *eventStreamWriter) flush() {
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	w.flusher.Flush()
+	w.lastWrite = time.Now()
+}
+
+//close ends the compressed stream
+func (w *eventStreamWriter) close() {
+	if w.compressor != nil {
+		w.compressor.Close()
+	}
+}
+
+//writeEvent writes an event with the given id. Multi-line data is split over several data
+//fields as required by the event stream format.
+func (w *eventStreamWriter) writeEvent(id string, data []byte) error {
+	w.start()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %s\n", id)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	w.flush()
+	return nil
+}
+
+//keepAlive writes a comment line when nothing has been written for a while, so proxies don't
+//close idle connections.
+func (w *eventStreamWriter) keepAlive() error {
+	if time.Since(w.lastWrite) < streamKeepAliveInterval {
+		return nil
+	}
+
+	if _, err := w.out.Write([]byte(": keepalive\n\n")); err != nil {
+		return err
+	}
+
+	w.flush()
+	return nil
+}
+
+//feedStreamer sends feed entries as server-sent events. Entries are rendered as atom entries
+//and encrypted the same way as feed pages: as a whole in document mode, and in entry mode with
+//only their content encrypted so consumers can still filter them by id, typecode and time.
+//Only the entries selected for the request are sent.
+type feedStreamer struct {
+	//ctx is the request's context, which the entries are encrypted in
+	ctx          context.Context
+	store        FeedStore
+	linkhostport string
+	linkProto    string
+	ae           *AtomEncrypter
+	selection    entrySelection
+}
+
+//send writes the selected events, given newest first as retrieved from the
+//feed, to the stream oldest first. It returns the position of the newest event, which is
+//tracked whether or not the event was selected so it isn't considered again.
+func (s *feedStreamer) send(w *eventStreamWriter, pos streamPosition, feedID string, events []atomdata.TimestampedEvent) (streamPosition, error) {
+	if len(events) == 0 && feedID == "" {
+		return pos, nil
+	}
+
+	selected := s.selection.apply(events)
+	oldestFirst := make([]atomdata.TimestampedEvent, 0, len(selected))
+	for i := len(selected) - 1; i >= 0; i-- {
+		oldestFirst = append(oldestFirst, selected[i])
+	}
+
+	var feed Feed
+	addItemsToFeed(&feed, oldestFirst, s.selection.redaction, s.linkhostport, s.linkProto)
+
+	//The entries sent together share a data key. In entry mode each carries the key, as there's
+	//no feed to give it, otherwise each is sealed in its own envelope.
+	entryMode := s.ae.encryptsEntries()
+	if entryMode {
+		if err := s.ae.encryptEntries(s.ctx, &feed); err != nil {
+			return pos, err
+		}
+
+		for _, entry := range feed.Entry {
+			entry.EncryptionKey = feed.EncryptionKey
+		}
+	}
+
+	outs := make([][]byte, 0, len(feed.Entry))
+	for _, entry := range feed.Entry {
+		var buf bytes.Buffer
+		err := xml.NewEncoder(&buf).EncodeElement(entry, xml.StartElement{
+			Name: xml.Name{Space: "http://www.w3.org/2005/Atom", Local: "entry"},
+		})
+		if err != nil {
+			return pos, err
+		}
+
+		outs = append(outs, buf.Bytes())
+	}
+
+	if !entryMode && len(outs) > 0 {
+		var err error
+		outs, err = s.ae.encryptOutputs(s.ctx, outs, IdentityEncoding)
+		if err != nil {
+			return pos, err
+		}
+	}
+
+	pos.feedID = feedID
+	for i, entry := range feed.Entry {
+		if err := w.writeEvent(entry.ID, outs[i]); err != nil {
+			return pos, err
+		}
+
+		pos.entryID = entry.ID
+	}
+
+	if len(events) > 0 {
+		pos.entryID = entryID(events[0])
+	}
+
+	return pos, nil
+}
+
+//locate checks the entry exists, then walks back through the archives from the newest to
+//find the one containing it, returning its feed id and the entries in it newer than the entry.
+//If the entry id is empty the oldest archive and all its entries are returned, or an empty
+//feed id if there are no archives.
+func (s *feedStreamer) locate(entryID string) (string, []atomdata.TimestampedEvent, error) {
+	//The entry is looked up first, so an unknown or forged id can't make us read every archive
+	if entryID != "" {
+		aggregateID, version, ok := parseEntryID(entryID)
+		if !ok {
+			return "", nil, ErrUnknownEventID
+		}
+
+		_, err := s.store.RetrieveEvent(aggregateID, version)
+		if err == ErrEventNotFound {
+			return "", nil, ErrUnknownEventID
+		} else if err != nil {
+			return "", nil, err
+		}
+	}
+
+	feedID, err := s.store.RetrieveLastFeed()
+	if err != nil {
+		return "", nil, err
+	}
+
+	for feedID != "" {
+		events, err := s.store.RetrieveArchive(feedID)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if i := indexOfEntry(events, entryID); i >= 0 {
+			return feedID, events[:i], nil
+		}
+
+		previous, err := s.store.RetrievePreviousFeed(feedID)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if previous == "" {
+			if entryID == "" {
+				return feedID, events, nil
+			}
+
+			break
+		}
+
+		feedID = previous
+	}
+
+	if entryID == "" {
+		return "", nil, nil
+	}
+
+	return "", nil, ErrUnknownEventID
+}
+
+//advance sends the entries published after the given position, catching up from the
+//archives as needed, and returns the new position.
+func (s *feedStreamer) advance(w *eventStreamWriter, pos streamPosition) (streamPosition, error) {
+	for {
+		recent, err := s.store.RetrieveRecent()
+		if err != nil {
+			return pos, err
+		}
+
+		var next string
+		switch {
+		case pos.feedID == "" && pos.entryID != "":
+			if i := indexOfEntry(recent, pos.entryID); i >= 0 {
+				return s.send(w, pos, "", recent[:i])
+			}
+
+			//The entry is not in the recent page, so it has been archived since it was sent
+			//or the client is resuming from an archived entry.
+			feedID, events, err := s.locate(pos.entryID)
+			if err != nil {
+				return pos, err
+			}
+
+			pos, err = s.send(w, pos, feedID, events)
+			if err != nil {
+				return pos, err
+			}
+
+			continue
+
+		case pos.feedID == "":
+			//Nothing has been sent from an empty event store, so start with the oldest archive
+			//if one has been created since.
+			next, err = s.store.RetrieveLastFeed()
+			if err != nil {
+				return pos, err
+			}
+
+			if next != "" {
+				feedID, events, err := s.locate("")
+				if err != nil {
+					return pos, err
+				}
+
+				pos, err = s.send(w, pos, feedID, events)
+				if err != nil {
+					return pos, err
+				}
+
+				continue
+			}
+
+		default:
+			//The last entry sent is the newest in its archive, so the entries that follow are
+			//in the next archive if there is one, otherwise in recent. The next archive is
+			//checked after reading recent so entries archived in between aren't skipped.
+			next, err = s.store.RetrieveNextFeed(pos.feedID)
+			if err != nil {
+				return pos, err
+			}
+
+			if next != "" {
+				events, err := s.store.RetrieveArchive(next)
+				if err != nil {
+					return pos, err
+				}
+
+				pos, err = s.send(w, pos, next, events)
+				if err != nil {
+					return pos, err
+				}
+
+				continue
+			}
+		}
+
+		return s.send(w, pos, "", recent)
+	}
+}
+
+//entryID returns the atom entry id of an event
+func entryID(event atomdata.TimestampedEvent) string {
+	return fmt.Sprintf("urn:esid:%s:%d", event.Source, event.Version)
+}
+
+//parseEntryID returns the aggregate id and version from an atom entry id of the form
+//urn:esid:<aggregate id>:<version>
+func parseEntryID(id string) (string, int, bool) {
+	if !strings.HasPrefix(id, "urn:esid:") {
+		return "", 0, false
+	}
+
+	id = strings.TrimPrefix(id, "urn:esid:")
+	i := strings.LastIndex(id, ":")
+	if i <= 0 {
+		return "", 0, false
+	}
+
+	version, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return id[:i], version, true
+}
+
+func indexOfEntry(events []atomdata.TimestampedEvent, id string) int {
+	if id == "" {
+		return -1
+	}
+
+	for i, event := range events {
+		if entryID(event) == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+//NewStreamHandler instantiates the handler for the server-sent events stream of new feed
+//entries. This will be served up at /notifications/stream
+//Each event carries an atom entry, encrypted when the feed is encrypted, with the entry id as
+//the event id. In entry encryption mode the entry metadata is in the clear and the entry
+//carries the encryption key of its content, see Entry.DecryptContent.
+//Clients resume by sending the id of the last entry they received in the Last-Event-ID
+//header, in which case the entries published since are sent first, catching up from the
+//archives if the entry is no longer in the recent page. Without a Last-Event-ID only entries
+//published after the request are sent.
+//If a notifier is given new entries are sent as soon as it signals them, otherwise the
+//database is polled for new entries.
+//As with the feed pages, the typecode query parameter restricts the stream to entries with the
+//given typecodes.
+func NewStreamHandler(store FeedStore, linkhostport string, env *envinject.InjectedEnv, ae *AtomEncrypter, notifier Notifier) (func(rw http.ResponseWriter, req *http.Request), error) {
+	if store == nil {
+		return nil, ErrMissingFeedStore
+	}
+
+	if env == nil {
+		return nil, ErrMissingInjectedEnv
+	}
+
+	if ae == nil {
+		return nil, ErrMissingAtomEncrypter
+	}
+
+	linkProto := env.Getenv(LinkProto)
+	if linkProto == "" {
+		linkProto = "https"
+	}
+
+	pollInterval := DefaultStreamPollInterval
+	if val := env.Getenv(StreamPollInterval); val != "" {
+		var err error
+		pollInterval, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	redactionPolicy, err := NewRedactionPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		logger := requestLogger(req)
+		streamer := &feedStreamer{
+			ctx:          req.Context(),
+			store:        store,
+			linkhostport: linkhostport,
+			linkProto:    linkProto,
+			ae:           ae,
+			selection:    selectionFromRequest(req, redactionPolicy),
+		}
+
+		//Encrypted entries don't compress, so the stream is only compressed when the feed isn't
+		//encrypted or only the entry content is
+		encoding := IdentityEncoding
+		if ae.keyProvider == nil || ae.encryptsEntries() {
+			encoding = negotiateEncoding(req)
+		}
+
+		w, err := newEventStreamWriter(rw, encoding)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer w.close()
+
+		//Subscribe before reading the starting position so no signals are missed
+		var signals <-chan Signal
+		interval := pollInterval
+		if notifier != nil {
+			subscription := notifier.Subscribe()
+			defer subscription.Close()
+			signals = subscription.C
+			interval = streamKeepAliveInterval
+		}
+
+		pos := streamPosition{entryID: req.Header.Get("Last-Event-ID")}
+		if pos.entryID == "" {
+			//Start from the newest entry
+			recent, err := store.RetrieveRecent()
+			if err != nil {
+				logger.Warnf("Error retrieving recent items: %s", err.Error())
+				http.Error(rw, "Error retrieving feed items", http.StatusInternalServerError)
+				return
+			}
+
+			if len(recent) > 0 {
+				pos.entryID = entryID(recent[0])
+			} else {
+				pos.feedID, err = store.RetrieveLastFeed()
+				if err != nil {
+					logger.Warnf("Error retrieving last feed id: %s", err.Error())
+					http.Error(rw, "Error retrieving feed id", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		logger.Infof("Streaming entries after %s", pos.entryID)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			pos, err = streamer.advance(w, pos)
+			if err != nil {
+				if w.started {
+					logger.Warnf("Error streaming entries: %s", err.Error())
+				} else if err == ErrUnknownEventID {
+					http.Error(rw, "Unknown Last-Event-ID", http.StatusNotFound)
+				} else {
+					logger.Warnf("Error retrieving feed items: %s", err.Error())
+					http.Error(rw, "Error retrieving feed items", http.StatusInternalServerError)
+				}
+
+				return
+			}
+
+			w.start()
+			if err = w.keepAlive(); err != nil {
+				return
+			}
+
+			select {
+			case <-req.Context().Done():
+				return
+			case <-signals:
+			case <-ticker.C:
+			}
+		}
+	}, nil
+}
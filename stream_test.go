@@ -0,0 +1,280 @@
+package esatompubpg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"golang.org/x/tools/blog/atom"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+//streamEventRows returns rows for events of aggregate agg with the given versions, which
+//should be listed newest first as the feed queries return them.
+func streamEventRows(versions ...int) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"})
+	for _, v := range versions {
+		rows = rows.AddRow(time.Now(), "agg", v, "foo", []byte("yeah ok"))
+	}
+
+	return rows
+}
+
+//eventRow returns the row for an event retrieved by aggregate id and version
+func eventRow() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"event_time", "typecode", "payload"}).AddRow(time.Now(), "foo", []byte("yeah ok"))
+}
+
+func feedRow(feedID string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"feedid"})
+	if feedID != "" {
+		rows = rows.AddRow(feedID)
+	}
+
+	return rows
+}
+
+//streamOnce runs the stream handler for a single poll of the database
+func streamOnce(t *testing.T, db *sql.DB, ae *AtomEncrypter, lastEventID string) *httptest.ResponseRecorder {
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, err := NewStreamHandler(pgFeedStore(t, db), "testhost:12345", env, ae, nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("GET", StreamHandlerURI, nil)
+	r = r.WithContext(ctx)
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+	return w
+}
+
+//streamedEvents returns the ids and data of the events in an event stream
+func streamedEvents(body string) ([]string, []string) {
+	var ids, data []string
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	return ids, data
+}
+
+func TestStreamResumeFromRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(3, 2, 1))
+
+	w := streamOnce(t, db, NewAtomEncrypterWithKeyProvider(nil), "urn:esid:agg:1")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	ids, data := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:2", "urn:esid:agg:3"}, ids)
+	if assert.Equal(t, 2, len(data)) {
+		var entry Entry
+		err = xml.Unmarshal([]byte(data[0]), &entry)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "urn:esid:agg:2", entry.ID)
+			assert.Equal(t, "foo", entry.TypeCode())
+			assert.Equal(t, "https://testhost:12345/events/agg/2", entry.Link[0].Href)
+		}
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamCatchUpFromArchives(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The entry isn't in recent, so check it exists and walk back from the newest archive to
+	//find it...
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(5))
+	mock.ExpectQuery("select").WillReturnRows(eventRow())
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow("feed2"))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(4, 3))
+	mock.ExpectQuery("select previous").WillReturnRows(sqlmock.NewRows([]string{"previous"}).AddRow("feed1"))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+
+	//...then move forward through the following archives to recent
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(5))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow("feed2"))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(4, 3))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(5))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow(""))
+
+	kp, _ := NewLocalKeyProvider(testMasterKey)
+	w := streamOnce(t, db, NewAtomEncrypterWithKeyProvider(kp), "urn:esid:agg:1")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	ids, data := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:2", "urn:esid:agg:3", "urn:esid:agg:4", "urn:esid:agg:5"}, ids)
+	for i, d := range data {
+		var entry atom.Entry
+		err = xml.Unmarshal(decryptTestOutput(t, kp, []byte(d)), &entry)
+		if assert.Nil(t, err) {
+			assert.Equal(t, ids[i], entry.ID)
+		}
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamNewEntries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//Only entries published after the request are sent
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(1))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+
+	w := streamOnce(t, db, NewAtomEncrypterWithKeyProvider(nil), "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	ids, _ := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:2"}, ids)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamFromEmptyStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//Nothing in the store when the request is made, then the first events are published
+	//and archived before the next poll.
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows())
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow(""))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(3))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow("feed1"))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow("feed1"))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+	mock.ExpectQuery("select previous").WillReturnRows(sqlmock.NewRows([]string{"previous"}))
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(3))
+	mock.ExpectQuery("select feedid").WillReturnRows(feedRow(""))
+
+	w := streamOnce(t, db, NewAtomEncrypterWithKeyProvider(nil), "")
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	ids, _ := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:1", "urn:esid:agg:2", "urn:esid:agg:3"}, ids)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamEncryptsBatchWithOneDataKey(t *testing.T) {
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1), testEvent("agg", 2), testEvent("agg", 3), testEvent("agg", 4))
+
+	kp := newCountingKeyProvider(t)
+	env, _ := envinject.NewInjectedEnv()
+	streamHandler, err := NewStreamHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(kp), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("GET", StreamHandlerURI, nil)
+	r = r.WithContext(ctx)
+	r.Header.Set("Last-Event-ID", "urn:esid:agg:1")
+
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+
+	//The entries are sealed in their own envelopes, but under the same data key
+	ids, data := streamedEvents(w.Body.String())
+	assert.Equal(t, []string{"urn:esid:agg:2", "urn:esid:agg:3", "urn:esid:agg:4"}, ids)
+	assert.Equal(t, 1, len(kp.generated))
+	for i, d := range data {
+		var entry atom.Entry
+		err = xml.Unmarshal(decryptTestOutput(t, kp, []byte(d)), &entry)
+		if assert.Nil(t, err) {
+			assert.Equal(t, ids[i], entry.ID)
+		}
+	}
+}
+
+func TestStreamUnknownLastEventID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The entry is looked up rather than searched for in the archives
+	mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+	mock.ExpectQuery("select").WillReturnRows(sqlmock.NewRows([]string{"event_time", "typecode", "payload"}))
+
+	w := streamOnce(t, db, NewAtomEncrypterWithKeyProvider(nil), "urn:esid:nope:1")
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	//Ids that aren't entry ids aren't looked up at all
+	for _, id := range []string{"nope", "urn:esid:nope", "urn:esid::1", "urn:esid:nope:x"} {
+		mock.ExpectQuery("select event_time").WillReturnRows(streamEventRows(2, 1))
+
+		w = streamOnce(t, db, NewAtomEncrypterWithKeyProvider(nil), id)
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, id)
+		assert.Nil(t, mock.ExpectationsWereMet(), id)
+	}
+}
+
+func TestParseStreamEntryID(t *testing.T) {
+	aggregateID, version, ok := parseEntryID("urn:esid:a:b:12")
+	assert.True(t, ok)
+	assert.Equal(t, "a:b", aggregateID)
+	assert.Equal(t, 12, version)
+
+	_, _, ok = parseEntryID("urn:esid:a:")
+	assert.False(t, ok)
+}
+
+func TestStreamHandlerConfig(t *testing.T) {
+	env, _ := envinject.NewInjectedEnv()
+	ae := NewAtomEncrypterWithKeyProvider(nil)
+
+	_, err := NewStreamHandler(nil, "testhost:12345", env, ae, nil)
+	assert.Equal(t, ErrMissingFeedStore, err)
+
+	db, _, _ := sqlmock.New()
+	defer db.Close()
+
+	_, err = NewStreamHandler(pgFeedStore(t, db), "testhost:12345", nil, ae, nil)
+	assert.Equal(t, ErrMissingInjectedEnv, err)
+
+	_, err = NewStreamHandler(pgFeedStore(t, db), "testhost:12345", env, nil, nil)
+	assert.Equal(t, ErrMissingAtomEncrypter, err)
+}
@@ -0,0 +1,216 @@
+package esatompubpg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+)
+
+var ErrMissingTLSKey = errors.New("TLS_KEY_FILE must be set with TLS_CERT_FILE")
+var ErrNoClientCAs = errors.New("No CA certificates found in client CA file")
+
+//TLS is enabled by setting TLS_CERT_FILE and TLS_KEY_FILE to PEM encoded certificate and key
+//files. Client certificates are required and verified against the CA certificates in
+//TLS_CLIENT_CA_FILE when it is set. The files are checked for changes every
+//TLS_RELOAD_INTERVAL (a duration such as 1m), which defaults to DefaultTLSReloadInterval.
+const (
+	TLSCertFile              = "TLS_CERT_FILE"
+	TLSKeyFile               = "TLS_KEY_FILE"
+	TLSClientCAFile          = "TLS_CLIENT_CA_FILE"
+	TLSReloadInterval        = "TLS_RELOAD_INTERVAL"
+	DefaultTLSReloadInterval = 30 * time.Second
+)
+
+//CertReloader serves the certificate and client CAs read from files, reloading them when the
+//files change so certificates can be rotated without a restart. If the new files can't be
+//loaded the previous certificate and CAs continue to be used.
+type CertReloader struct {
+	mu        sync.RWMutex
+	certFile  string
+	keyFile   string
+	caFile    string
+	interval  time.Duration
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modified  map[string]time.Time
+}
+
+//NewTLSConfig returns the TLS configuration for the feed listener given by the environment,
+//along with the reloader that keeps it up to date. The configuration is nil if TLS is not
+//configured.
+func NewTLSConfig(env *envinject.InjectedEnv) (*tls.Config, *CertReloader, error) {
+	if env == nil {
+		return nil, nil, ErrMissingInjectedEnv
+	}
+
+	certFile := env.Getenv(TLSCertFile)
+	if certFile == "" {
+		return nil, nil, nil
+	}
+
+	keyFile := env.Getenv(TLSKeyFile)
+	if keyFile == "" {
+		return nil, nil, ErrMissingTLSKey
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile, env.Getenv(TLSClientCAFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if val := env.Getenv(TLSReloadInterval); val != "" {
+		reloader.interval, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return reloader.TLSConfig(), reloader, nil
+}
+
+//NewCertReloader loads the certificate and key, and the client CAs if a CA file is given
+func NewCertReloader(certFile string, keyFile string, caFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: DefaultTLSReloadInterval,
+		modified: make(map[string]time.Time),
+	}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+
+	return files
+}
+
+//Reload loads the files if any of them have changed since they were last loaded, reporting
+//whether they were reloaded.
+func (r *CertReloader) Reload() (bool, error) {
+	r.mu.RLock()
+	previous := r.modified
+	r.mu.RUnlock()
+
+	modified := make(map[string]time.Time)
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+
+		modified[file] = info.ModTime()
+		if !info.ModTime().Equal(previous[file]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, ErrNoClientCAs
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modified = modified
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+//Run checks the files for changes until the context is done
+func (r *CertReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				log.Warnf("Error reloading TLS certificates, continuing with current ones: %s", err.Error())
+			} else if reloaded {
+				log.Info("Reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+//GetCertificate returns the current certificate, for use in a tls.Config
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+//TLSConfig returns a configuration that serves the current certificate, and requires client
+//certificates signed by the current client CAs if a CA file was given.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if r.caFile != "" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := config.Clone()
+			r.mu.RLock()
+			clientConfig.ClientCAs = r.clientCAs
+			r.mu.RUnlock()
+			return clientConfig, nil
+		}
+	}
+
+	return config
+}
+
+//ClientCertSubject returns the subject of the verified client certificate the request was
+//made with, or the empty string if the request was not made with a client certificate.
+func ClientCertSubject(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return req.TLS.VerifiedChains[0][0].Subject.String()
+}
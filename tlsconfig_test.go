@@ -0,0 +1,191 @@
+package esatompubpg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+//newTestCert creates a certificate with the given common name, self signed if the parent is nil
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"xtracdev"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyFile != "" {
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	env, _ := envinject.NewInjectedEnv()
+	config, reloader, err := NewTLSConfig(env)
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+	assert.Nil(t, reloader)
+
+	_, _, err = NewTLSConfig(nil)
+	assert.Equal(t, ErrMissingInjectedEnv, err)
+
+	os.Setenv(TLSCertFile, "cert.pem")
+	defer os.Unsetenv(TLSCertFile)
+	env, _ = envinject.NewInjectedEnv()
+	_, _, err = NewTLSConfig(env)
+	assert.Equal(t, ErrMissingTLSKey, err)
+
+	os.Setenv(TLSKeyFile, "nope.pem")
+	defer os.Unsetenv(TLSKeyFile)
+	env, _ = envinject.NewInjectedEnv()
+	_, _, err = NewTLSConfig(env)
+	assert.NotNil(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atompubtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca := newTestCert(t, "test ca", nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "server1", ca).write(t, certFile, keyFile)
+
+	reloader, err := NewCertReloader(certFile, keyFile, caFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var subject string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		subject = ClientCertSubject(req)
+	}))
+	ts.TLS = reloader.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+	}
+
+	//Client certificates are required and must be signed by the CA
+	_, err = client().Get(ts.URL)
+	assert.NotNil(t, err)
+
+	_, err = client(newTestCert(t, "rogue", nil).tlsCertificate()).Get(ts.URL)
+	assert.NotNil(t, err)
+
+	res, err := client(newTestCert(t, "consumer1", ca).tlsCertificate()).Get(ts.URL)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, "CN=consumer1,O=xtracdev", subject)
+		assert.Equal(t, "server1", res.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	//Nothing is reloaded until the files change
+	reloaded, err := reloader.Reload()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	//A rotated certificate is served once reloaded
+	newTestCert(t, "server2", ca).write(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	reloaded, err = reloader.Reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+
+	res, err = client(newTestCert(t, "consumer1", ca).tlsCertificate()).Get(ts.URL)
+	if assert.Nil(t, err) {
+		res.Body.Close()
+		assert.Equal(t, "server2", res.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	//A bad update is reported and the current certificate kept
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+	_, err = reloader.Reload()
+	assert.NotNil(t, err)
+
+	cert, _ := reloader.GetCertificate(nil)
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, "server2", parsed.Subject.CommonName)
+}
+
+func TestClientCertSubjectWithoutTLS(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	assert.Equal(t, "", ClientCertSubject(r))
+}
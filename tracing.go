@@ -0,0 +1,150 @@
+package esatompubpg
+
+import (
+	"context"
+	"net/http"
+
+	atomdata "github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//tracerName identifies the spans created by this package
+const tracerName = "github.com/xtracdev/es-atom-pub-pg"
+
+//Spans are created with the global tracer provider, which doesn't record anything unless the
+//application installs an SDK tracer provider with otel.SetTracerProvider.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+//endSpan ends the span, marking it as failed if there was an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//traceContextPropagator extracts the W3C traceparent and tracestate headers of incoming requests
+var traceContextPropagator = propagation.TraceContext{}
+
+//TraceHandler wraps a handler to serve each request in a server span for the given route,
+//continuing the trace given by the request's W3C traceparent header if there is one. The
+//handlers in this package create child spans for each stage of serving the request: feed store
+//calls, rendering, and encryption, including obtaining data keys.
+func TraceHandler(route string, h func(rw http.ResponseWriter, req *http.Request)) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx := traceContextPropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path),
+			))
+		defer span.End()
+
+		if id := RequestID(req); id != "" {
+			span.SetAttributes(attribute.String("http.request.id", id))
+		}
+
+		if record := requestRecordFromContext(req.Context()); record != nil && span.SpanContext().IsValid() {
+			record.traceID = span.SpanContext().TraceID().String()
+		}
+
+		w := &statusRecorder{ResponseWriter: rw}
+		h(w, req.WithContext(ctx))
+
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+//tracedFeedStore creates a span for each call to a feed store made while serving a request
+type tracedFeedStore struct {
+	ctx   context.Context
+	store FeedStore
+}
+
+//traceFeedStore returns the store wrapped to trace its calls as children of the context's span,
+//or the store itself if the context's span isn't being recorded.
+func traceFeedStore(ctx context.Context, store FeedStore) FeedStore {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return store
+	}
+
+	return &tracedFeedStore{ctx: ctx, store: store}
+}
+
+func (s *tracedFeedStore) RetrieveRecent() ([]atomdata.TimestampedEvent, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveRecent")
+	events, err := s.store.RetrieveRecent()
+	span.SetAttributes(attribute.Int("atompub.events", len(events)))
+	endSpan(span, err)
+	return events, err
+}
+
+func (s *tracedFeedStore) RetrieveLastFeed() (string, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveLastFeed")
+	feedID, err := s.store.RetrieveLastFeed()
+	endSpan(span, err)
+	return feedID, err
+}
+
+func (s *tracedFeedStore) RetrieveArchive(feedID string) ([]atomdata.TimestampedEvent, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveArchive", attribute.String("atompub.feed_id", feedID))
+	events, err := s.store.RetrieveArchive(feedID)
+	span.SetAttributes(attribute.Int("atompub.events", len(events)))
+	endSpan(span, err)
+	return events, err
+}
+
+func (s *tracedFeedStore) RetrievePreviousFeed(feedID string) (string, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrievePreviousFeed", attribute.String("atompub.feed_id", feedID))
+	previous, err := s.store.RetrievePreviousFeed(feedID)
+	endSpan(span, err)
+	return previous, err
+}
+
+func (s *tracedFeedStore) RetrieveNextFeed(feedID string) (string, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveNextFeed", attribute.String("atompub.feed_id", feedID))
+	next, err := s.store.RetrieveNextFeed(feedID)
+	endSpan(span, err)
+	return next, err
+}
+
+func (s *tracedFeedStore) RetrieveEvent(aggregateID string, version int) (atomdata.TimestampedEvent, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveEvent",
+		attribute.String("atompub.aggregate_id", aggregateID),
+		attribute.Int("atompub.version", version))
+	event, err := s.store.RetrieveEvent(aggregateID, version)
+	if err == ErrEventNotFound {
+		span.End()
+		return event, err
+	}
+	endSpan(span, err)
+	return event, err
+}
+
+func (s *tracedFeedStore) RetrieveAggregate(aggregateID string, from int, to int, limit int) ([]atomdata.TimestampedEvent, error) {
+	_, span := startSpan(s.ctx, "FeedStore.RetrieveAggregate",
+		attribute.String("atompub.aggregate_id", aggregateID),
+		attribute.Int("atompub.from", from),
+		attribute.Int("atompub.to", to))
+	events, err := s.store.RetrieveAggregate(aggregateID, from, to, limit)
+	span.SetAttributes(attribute.Int("atompub.events", len(events)))
+	endSpan(span, err)
+	return events, err
+}
@@ -0,0 +1,130 @@
+package esatompubpg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//recordSpans installs a tracer provider that records the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	return recorder
+}
+
+func TestTraceHandler(t *testing.T) {
+	spans := recordSpans(t)
+
+	store := NewMemoryFeedStore()
+	store.Add(testEvent("agg", 1))
+
+	kp, err := NewLocalKeyProvider(testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	recentHandler, _ := NewRecentHandler(store, "testhost:12345", env, NewAtomEncrypterWithKeyProvider(kp))
+
+	var traceFields map[string]interface{}
+	router := mux.NewRouter()
+	router.HandleFunc(RecentHandlerURI, TraceHandler("recent", func(rw http.ResponseWriter, req *http.Request) {
+		traceFields = requestLogger(req).Data
+		recentHandler(rw, req)
+	}))
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	ended := spans.Ended()
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range ended {
+		names[span.Name()] = span
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	}
+
+	server, ok := names["GET recent"]
+	if assert.True(t, ok) {
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceFields["trace_id"])
+		assert.Equal(t, server.SpanContext().SpanID().String(), traceFields["span_id"])
+	}
+
+	for _, name := range []string{"FeedStore.RetrieveRecent", "FeedStore.RetrieveLastFeed", "render", "AtomEncrypter.EncryptOutput"} {
+		if span, ok := names[name]; assert.True(t, ok, name) {
+			assert.Equal(t, server.SpanContext().SpanID(), span.Parent().SpanID(), name)
+		}
+	}
+
+	if span, ok := names["KeyProvider.GenerateDataKey"]; assert.True(t, ok) {
+		assert.Equal(t, names["AtomEncrypter.EncryptOutput"].SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
+
+func TestTraceHandlerAccessLog(t *testing.T) {
+	spans := recordSpans(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc(PingURI, TraceHandler("ping", PingHandler))
+
+	var out bytes.Buffer
+	handler := NewAccessLogger(&out, router).Middleware(router)
+
+	get := func(traceparent string) map[string]interface{} {
+		out.Reset()
+		r, _ := http.NewRequest("GET", PingURI, nil)
+		if traceparent != "" {
+			r.Header.Set("traceparent", traceparent)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &entry), out.String())
+		return entry
+	}
+
+	//The access log entry carries the trace id of the request's span alongside the request id
+	entry := get("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entry["trace_id"])
+	assert.Contains(t, entry, "request_id")
+
+	entry = get("")
+	ended := spans.Ended()
+	if assert.Equal(t, 2, len(ended)) {
+		assert.Equal(t, ended[1].SpanContext().TraceID().String(), entry["trace_id"])
+	}
+
+	//Requests that aren't traced have no trace id
+	out.Reset()
+	NewAccessLogger(&out, nil).Middleware(http.HandlerFunc(PingHandler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", PingURI, nil))
+	assert.NotContains(t, out.String(), "trace_id")
+}
+
+func TestUntracedRequests(t *testing.T) {
+	store := NewMemoryFeedStore()
+	assert.Equal(t, store, traceFeedStore(context.Background(), store))
+
+	r, _ := http.NewRequest("GET", "/notifications/recent", nil)
+	assert.Equal(t, 0, len(requestLogger(r).Data))
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -11,36 +9,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
+	atompub "github.com/xtracdev/es-atom-pub-pg"
 )
 
-//Decrypt from cryptopasta commit bc3a108a5776376aa811eea34b93383837994340
-//used via the CC0 license. See https://github.com/gtank/cryptopasta
-func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("malformed ciphertext")
-	}
-
-	return gcm.Open(nil,
-		ciphertext[:gcm.NonceSize()],
-		ciphertext[gcm.NonceSize():],
-		nil,
-	)
-}
-
 func readRecent(feedUrl string) ([]byte, error) {
 
 	parsed, err := url.Parse(feedUrl)
@@ -79,36 +51,26 @@ func readRecent(feedUrl string) ([]byte, error) {
 	return bytes, nil
 }
 
-func decryptMessage(svc *kms.KMS, parts []string) ([]byte, error) {
-	//Decode the key and the text
-	keyBytes, err := base64.StdEncoding.DecodeString(parts[0])
-	if err != nil {
-		return nil, err
-	}
-
-	//Get the encrypted bytes
-	msgBytes, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return nil, err
-	}
+//keyProviderFor returns a key provider able to decrypt the data key in the given envelope. The
+//local key provider reads its master key from KEY_FILE or LOCAL_KEY.
+func keyProviderFor(envelope *atompub.Envelope) (atompub.KeyProvider, error) {
+	switch envelope.Header.KeyProvider {
+	case atompub.KMSKeyProviderType:
+		return atompub.NewKMSKeyProvider("")
+	case atompub.LocalKeyProviderType:
+		if keyFile := os.Getenv(atompub.KeyFile); keyFile != "" {
+			return atompub.NewLocalKeyProviderFromFile(keyFile)
+		}
 
-	//Decrypt the encryption key
-	di := &kms.DecryptInput{
-		CiphertextBlob: keyBytes,
-	}
+		masterKey, err := base64.StdEncoding.DecodeString(os.Getenv(atompub.LocalKey))
+		if err != nil {
+			return nil, err
+		}
 
-	decryptedKey, err := svc.Decrypt(di)
-	if err != nil {
-		return nil, err
+		return atompub.NewLocalKeyProvider(masterKey)
+	default:
+		return nil, atompub.ErrUnknownKeyProvider
 	}
-
-	//Use the decrypted key to decrypt the message text
-	decryptKey := [32]byte{}
-
-	copy(decryptKey[:], decryptedKey.Plaintext[0:32])
-
-	return Decrypt(msgBytes, &decryptKey)
-
 }
 
 func main() {
@@ -118,15 +80,6 @@ func main() {
 		return
 	}
 
-	//KMS set up
-	sess, err := session.NewSession()
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-
-	svc := kms.New(sess)
-
 	feedUrl := os.Args[1] + "/notifications/recent"
 
 	for i := 0; i < 1; i++ {
@@ -137,15 +90,23 @@ func main() {
 			break
 		}
 
-		//Now split the output into two parts - the encrypted key
-		//and the encrypted text
-		parts := strings.Split(string(bytes), "::")
-		if len(parts) != 2 {
-			fmt.Println("Expected two parts, got ", len(parts))
+		//Decode the envelope holding the encrypted key and the encrypted text
+		envelope, err := atompub.DecodeEnvelope(bytes)
+		if err == atompub.ErrNotEnvelope {
+			fmt.Println("Not encrypted :\n", string(bytes))
+			break
+		} else if err != nil {
+			fmt.Println(err)
+			break
+		}
+
+		kp, err := keyProviderFor(envelope)
+		if err != nil {
+			fmt.Println(err)
 			break
 		}
 
-		decypted, err := decryptMessage(svc, parts)
+		decypted, err := envelope.Open(kp)
 		if err != nil {
 			fmt.Println(err)
 			break